@@ -4,19 +4,20 @@
 package main
 
 import (
-	"fmt"
-	"log"
-
 	"github.com/docopt/docopt-go"
 	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/logger"
 	"github.com/goshuirc/bnc/lib/setup"
 
 	// Different parts of the project acting independantly
 	"github.com/goshuirc/bnc/lib/components/componentLoader"
 
 	"github.com/goshuirc/bnc/lib/datastores/buntdb"
+	"github.com/goshuirc/bnc/lib/datastores/sql"
 )
 
+var mainLog = bncLog.New("core")
+
 func main() {
 	usage := `GoshuBNC.
 
@@ -25,67 +26,161 @@ GoshuBNC is an IRC bouncer.
 Usage:
 	bnc init [--conf <filename>]
 	bnc start [--conf <filename>]
+	bnc upgrade [--conf <filename>]
+	bnc migrate-storage --from <type> --to <type> [--from-database <database>] [--to-database <database>] [--conf <filename>]
 	bnc -h | --help
 	bnc --version
 
 Options:
-	--conf <filename>  Configuration file to use [default: bnc.yaml].
-	-h --help          Show this screen.
-	--version          Show version.`
+	--conf <filename>           Configuration file to use [default: bnc.yaml].
+	--from <type>               Storage type to copy from (buntdb, sqlite or postgres).
+	--to <type>                 Storage type to copy to (buntdb, sqlite or postgres).
+	--from-database <database>  Database to copy from, if it's not the one in the config file.
+	--to-database <database>    Database to copy to, if it's not the one in the config file.
+	-h --help                   Show this screen.
+	--version                   Show version.`
 
 	arguments, _ := docopt.Parse(usage, nil, true, ircbnc.SemVer, false)
 
 	configfile := arguments["--conf"].(string)
 	config, err := ircbnc.LoadConfig(configfile)
 	if err != nil {
-		log.Fatal("Config file did not load successfully:", err.Error())
+		mainLog.Fatal("Config file did not load successfully", "error", err)
+	}
+
+	err = bncLog.Configure(config.Bouncer.Log)
+	if err != nil {
+		mainLog.Fatal("Could not set up logging", "error", err)
 	}
 
-	data, dataType := getDataStoreInstance(config)
+	if arguments["upgrade"].(bool) {
+		upgradeStorage(config)
+		return
+	}
+
+	if arguments["migrate-storage"].(bool) {
+		migrateStorage(config, arguments)
+		return
+	}
+
+	data, dataType := getDataStoreInstance(config.Bouncer.Storage)
 	if data == nil {
-		log.Fatal("No valid storage engines have been confugured")
+		mainLog.Fatal("No valid storage engines have been configured")
 	} else {
-		log.Println("Using storage " + dataType)
+		mainLog.Info("Using storage", "type", dataType)
 	}
 
 	manager := ircbnc.NewManager(config, data)
 
 	dataErr := data.Init(manager)
 	if dataErr != nil {
-		log.Fatalln(dataErr.Error())
+		mainLog.Fatal("Could not open storage", "error", dataErr)
 	}
 
 	if arguments["init"].(bool) {
 		setupErr := data.Setup()
 		if setupErr != nil {
-			log.Fatal("Could not initialise the database: ", err.Error())
+			mainLog.Fatal("Could not initialise the database", "error", setupErr)
 		}
 
 		ircsetup.InitialSetup(manager)
 
 	} else if arguments["start"].(bool) {
-		fmt.Println("Starting", ircsetup.CbCyan("GoshuBNC"))
+		mainLog.Info("Starting GoshuBNC")
 
 		// Start the different components
 		bncComponentLoader.Run(manager)
 
 		err = manager.Run()
 		if err != nil {
-			log.Fatal(err.Error())
+			mainLog.Fatal("Bouncer stopped", "error", err)
 		}
 	}
 }
 
-func getDataStoreInstance(config *ircbnc.Config) (ircbnc.DataStoreInterface, string) {
+func getDataStoreInstance(storage map[string]string) (ircbnc.DataStoreInterface, string) {
 	var data ircbnc.DataStoreInterface
 
-	storageType, _ := config.Bouncer.Storage["type"]
+	storageType, _ := storage["type"]
 	if storageType == "" {
 		storageType = "buntdb"
 	}
 
 	if storageType == "buntdb" {
 		data = &bncDataStoreBuntdb.DataStore{}
+	} else if bncDataStoreSql.IsStorageType(storageType) {
+		data = &bncDataStoreSql.DataStore{}
 	}
 	return data, storageType
 }
+
+// upgradeStorage backs up the datastore and upgrades it to the latest schema
+func upgradeStorage(config *ircbnc.Config) {
+	storageType, _ := config.Bouncer.Storage["type"]
+	if storageType != "" && storageType != "buntdb" {
+		mainLog.Info("This storage is upgraded automatically when GoshuBNC starts", "type", storageType)
+		return
+	}
+
+	err := bncDataStoreBuntdb.UpgradeDB(config.Bouncer.Storage["database"])
+	if err != nil {
+		mainLog.Fatal("Could not upgrade the database", "error", err)
+	}
+
+	mainLog.Info("The database is up to date")
+}
+
+// migrateStorage copies everything from one storage engine into another
+func migrateStorage(config *ircbnc.Config, arguments map[string]interface{}) {
+	from := openStorage(config, arguments["--from"].(string), arguments["--from-database"])
+	defer from.Close()
+	to := openStorage(config, arguments["--to"].(string), arguments["--to-database"])
+	defer to.Close()
+
+	err := ircbnc.CopyDataStore(from, to)
+	if err != nil {
+		// Fatal skips the deferred closes
+		from.Close()
+		to.Close()
+		mainLog.Fatal("Could not migrate storage", "error", err)
+	}
+
+	mainLog.Info("Storage has been copied. Update the storage section of your config file to start using it.")
+}
+
+// openStorage opens the given storage engine using the database from the command line, or
+// the config file if it's configured to use that engine
+func openStorage(config *ircbnc.Config, storageType string, database interface{}) ircbnc.DataStoreInterface {
+	storage := map[string]string{}
+	for key, val := range config.Bouncer.Storage {
+		storage[key] = val
+	}
+
+	configType := storage["type"]
+	if configType == "" {
+		configType = "buntdb"
+	}
+
+	storage["type"] = storageType
+	if database != nil {
+		storage["database"] = database.(string)
+	} else if configType != storageType {
+		mainLog.Fatal("The config file doesn't use this storage, give its database on the command line", "type", storageType)
+	}
+
+	data, _ := getDataStoreInstance(storage)
+	if data == nil {
+		mainLog.Fatal("Unknown storage type", "type", storageType)
+	}
+
+	// Each datastore gets its own config so they see their own storage settings
+	storageConfig := *config
+	storageConfig.Bouncer.Storage = storage
+
+	err := data.Init(ircbnc.NewManager(&storageConfig, data))
+	if err != nil {
+		mainLog.Fatal("Could not open storage", "type", storageType, "error", err)
+	}
+
+	return data
+}
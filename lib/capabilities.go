@@ -30,15 +30,19 @@ func init() {
 	CapInviteNotify(&Capabilities)
 	CapUserhostInNames(&Capabilities)
 	CapBatch(&Capabilities)
+	CapMessageTags(&Capabilities)
+	CapReadMarker(&Capabilities)
+	CapSasl(&Capabilities)
 }
 
-// SupportedString returns a list ready to send to the client of all our CAPs
-func (caps *CapManager) SupportedString() string {
+// SupportedString returns a list ready to send to the client of all our CAPs, with
+// their values if the client supports them
+func (caps *CapManager) SupportedString(withValues bool) string {
 	capList := " "
 
 	for cap, val := range caps.Supported {
 		capList += cap
-		if val != "" {
+		if val != "" && withValues {
 			capList += "=" + val
 		}
 		capList += " "
@@ -133,7 +137,7 @@ func CapServerTime(caps *CapManager) {
 			_, exists := message.Tags["time"]
 			if !exists {
 				message.Tags["time"] = ircmsg.TagValue{
-					Value:    time.Now().UTC().Format(time.RFC3339),
+					Value:    time.Now().UTC().Format(TimestampFormat),
 					HasValue: true,
 				}
 			}
@@ -262,7 +266,64 @@ func CapUserhostInNames(caps *CapManager) {
  * Not used on it's own, but other commands such as CHATHISTORY make use of it
  */
 func CapBatch(caps *CapManager) {
-	caps.Supported["batch"] = ""
+	name := "batch"
+	caps.Supported[name] = ""
+
+	caps.FnsInitListener[name] = func(listener *Listener) {
+		listener.TagsEnabled = true
+	}
+}
+
+/**
+ * CAP: message-tags
+ */
+func CapMessageTags(caps *CapManager) {
+	name := "message-tags"
+	caps.Supported[name] = ""
+
+	caps.FnsInitListener[name] = func(listener *Listener) {
+		listener.TagsEnabled = true
+	}
+
+	caps.FnsMessageToClient = append(
+		caps.FnsMessageToClient,
+		func(listener *Listener, message *ircmsg.IrcMessage) bool {
+			if listener.IsCapEnabled(name) {
+				return false
+			}
+
+			// TAGMSG only exists to carry tags
+			if message.Command == "TAGMSG" {
+				return true
+			}
+
+			// Other caps turn tags on, so strip out the msgid and client-only tags
+			delete(message.Tags, "msgid")
+			for tag := range message.Tags {
+				if strings.HasPrefix(tag, "+") {
+					delete(message.Tags, tag)
+				}
+			}
+
+			return false
+		},
+	)
+}
+
+/**
+ * CAP: draft/read-marker
+ * The MARKREAD command itself is handled in commandhandlers.go
+ */
+func CapReadMarker(caps *CapManager) {
+	caps.Supported["draft/read-marker"] = ""
+}
+
+/**
+ * CAP: sasl
+ * The AUTHENTICATE command itself is handled in commandhandlers.go
+ */
+func CapSasl(caps *CapManager) {
+	caps.Supported["sasl"] = strings.Join(ListenerSaslMechanisms, ",")
 }
 
 func SplitMask(mask string) (string, string, string) {
@@ -0,0 +1,509 @@
+package ircbnc
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib/ircclient"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// ChannelState is what we know about a channel we're joined to on a network, so that
+// attaching clients can be sent it without asking the server again.
+type ChannelState struct {
+	Name        string
+	Topic       string
+	TopicSetter string
+	TopicTime   time.Time
+
+	// Modes maps each channel mode that is set to its parameter, if it has one
+	Modes   map[rune]string
+	Members map[string]*ChannelMember
+
+	// receivingNames is set while a NAMES reply is coming in
+	receivingNames bool
+	// modeQueried is set until the reply to the MODE we send after joining comes in
+	modeQueried bool
+}
+
+// ChannelMember is a user in a channel.
+type ChannelMember struct {
+	Nick string
+	Mask string
+	// Prefixes holds the member's channel privileges, highest first, eg. "@+"
+	Prefixes string
+}
+
+// NewChannelState returns an empty ChannelState for the given channel.
+func NewChannelState(name string) *ChannelState {
+	return &ChannelState{
+		Name:    name,
+		Modes:   make(map[rune]string),
+		Members: make(map[string]*ChannelMember),
+	}
+}
+
+// ModeString returns the channel modes and their parameters, eg. ["+kl", "key", "20"].
+func (channel *ChannelState) ModeString() []string {
+	modes := []rune{}
+	for mode := range channel.Modes {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+
+	modeString := "+"
+	params := []string{}
+	for _, mode := range modes {
+		modeString += string(mode)
+		if channel.Modes[mode] != "" {
+			params = append(params, channel.Modes[mode])
+		}
+	}
+
+	return append([]string{modeString}, params...)
+}
+
+// NamesSymbol returns the channel type symbol used in NAMES replies
+func (channel *ChannelState) NamesSymbol() string {
+	if _, secret := channel.Modes['s']; secret {
+		return "@"
+	}
+	if _, private := channel.Modes['p']; private {
+		return "*"
+	}
+	return "="
+}
+
+// Names returns the members of the channel as they appear in a NAMES reply. Only the
+// highest prefix is included as we don't offer multi-prefix.
+func (channel *ChannelState) Names() []string {
+	names := []string{}
+	for _, member := range channel.Members {
+		name := member.Nick
+		if member.Mask != "" {
+			name = member.Mask
+		}
+		if member.Prefixes != "" {
+			name = member.Prefixes[:1] + name
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel returns the state of a channel we're joined to, or nil if we're not in it.
+func (sc *ServerConnection) Channel(name string) *ChannelState {
+	sc.channelsLock.RLock()
+	defer sc.channelsLock.RUnlock()
+	return sc.channels[strings.ToLower(name)]
+}
+
+// chanPrefixes returns the channel membership modes and prefixes the server supports,
+// eg. "ov" and "@+".
+func (sc *ServerConnection) chanPrefixes() (string, string) {
+	sc.Foo.RLock()
+	prefix, exists := sc.Foo.Supported["PREFIX"]
+	sc.Foo.RUnlock()
+	if !exists {
+		prefix = "(ov)@+"
+	}
+
+	end := strings.Index(prefix, ")")
+	if !strings.HasPrefix(prefix, "(") || end == -1 {
+		return "", ""
+	}
+
+	return prefix[1:end], prefix[end+1:]
+}
+
+// chanModeTypes returns the list, always-parameter, set-parameter and no-parameter
+// channel modes the server supports.
+func (sc *ServerConnection) chanModeTypes() []string {
+	sc.Foo.RLock()
+	chanmodes, exists := sc.Foo.Supported["CHANMODES"]
+	sc.Foo.RUnlock()
+	if !exists {
+		chanmodes = "beI,k,l,imnpst"
+	}
+
+	types := strings.SplitN(chanmodes, ",", 4)
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	return types
+}
+
+// splitNamesPrefix splits the privilege prefixes off the front of a NAMES entry.
+func (sc *ServerConnection) splitNamesPrefix(name string) (string, string) {
+	_, prefixes := sc.chanPrefixes()
+
+	i := 0
+	for i < len(name) && strings.IndexByte(prefixes, name[i]) != -1 {
+		i++
+	}
+
+	return name[:i], name[i:]
+}
+
+// setMemberPrefix adds or removes a privilege prefix, keeping them in order of rank.
+func (sc *ServerConnection) setMemberPrefix(member *ChannelMember, prefix byte, adding bool) {
+	_, prefixes := sc.chanPrefixes()
+
+	newPrefixes := ""
+	for i := 0; i < len(prefixes); i++ {
+		p := prefixes[i]
+		if p == prefix {
+			if adding {
+				newPrefixes += string(p)
+			}
+		} else if strings.IndexByte(member.Prefixes, p) != -1 {
+			newPrefixes += string(p)
+		}
+	}
+
+	member.Prefixes = newPrefixes
+}
+
+func (sc *ServerConnection) isOwnNick(nick string) bool {
+	return strings.ToLower(nick) == strings.ToLower(sc.Foo.Nick)
+}
+
+func (sc *ServerConnection) channelStateJoin(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 1 {
+		return
+	}
+
+	nick, _, _ := SplitMask(message.Prefix)
+	name := message.Params[0]
+
+	sc.channelsLock.Lock()
+	channel, exists := sc.channels[strings.ToLower(name)]
+	if sc.isOwnNick(nick) {
+		channel = NewChannelState(name)
+		sc.channels[strings.ToLower(name)] = channel
+		exists = true
+	}
+	if exists {
+		channel.Members[strings.ToLower(nick)] = &ChannelMember{
+			Nick: nick,
+			Mask: message.Prefix,
+		}
+	}
+	if sc.isOwnNick(nick) {
+		channel.modeQueried = true
+	}
+	sc.channelsLock.Unlock()
+
+	// Servers don't tell us the channel modes when we join
+	if sc.isOwnNick(nick) {
+		sc.Foo.WriteLine("MODE %s", name)
+	}
+}
+
+func (sc *ServerConnection) channelStatePart(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 1 {
+		return
+	}
+
+	nick, _, _ := SplitMask(message.Prefix)
+	sc.removeChannelMember(message.Params[0], nick)
+}
+
+func (sc *ServerConnection) channelStateKick(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 {
+		return
+	}
+
+	sc.removeChannelMember(message.Params[0], message.Params[1])
+}
+
+func (sc *ServerConnection) removeChannelMember(name string, nick string) {
+	sc.channelsLock.Lock()
+	defer sc.channelsLock.Unlock()
+
+	if sc.isOwnNick(nick) {
+		delete(sc.channels, strings.ToLower(name))
+		return
+	}
+
+	channel, exists := sc.channels[strings.ToLower(name)]
+	if exists {
+		delete(channel.Members, strings.ToLower(nick))
+	}
+}
+
+func (sc *ServerConnection) channelStateQuit(message *ircmsg.IrcMessage) {
+	nick, _, _ := SplitMask(message.Prefix)
+
+	sc.channelsLock.Lock()
+	for _, channel := range sc.channels {
+		delete(channel.Members, strings.ToLower(nick))
+	}
+	sc.channelsLock.Unlock()
+}
+
+func (sc *ServerConnection) channelStateNick(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 1 {
+		return
+	}
+
+	oldNick, username, host := SplitMask(message.Prefix)
+	newNick := message.Params[0]
+
+	sc.channelsLock.Lock()
+	for _, channel := range sc.channels {
+		member, exists := channel.Members[strings.ToLower(oldNick)]
+		if !exists {
+			continue
+		}
+
+		delete(channel.Members, strings.ToLower(oldNick))
+		member.Nick = newNick
+		if member.Mask != "" {
+			member.Mask = newNick + "!" + username + "@" + host
+		}
+		channel.Members[strings.ToLower(newNick)] = member
+	}
+	sc.channelsLock.Unlock()
+}
+
+func (sc *ServerConnection) channelStateTopic(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 {
+		return
+	}
+
+	setter, _, _ := SplitMask(message.Prefix)
+
+	sc.channelsLock.Lock()
+	channel, exists := sc.channels[strings.ToLower(message.Params[0])]
+	if exists {
+		channel.Topic = message.Params[1]
+		channel.TopicSetter = setter
+		channel.TopicTime = time.Now()
+	}
+	sc.channelsLock.Unlock()
+}
+
+// channelStateNumeric handles the numerics that tell us about a channel's topic, modes
+// and members. They all have our nick and the channel name as their first params.
+func (sc *ServerConnection) channelStateNumeric(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 {
+		return
+	}
+
+	name := message.Params[1]
+	if message.Command == ircclient.RPL_NAMREPLY {
+		// 353 nick = #channel :names
+		if len(message.Params) < 4 {
+			return
+		}
+		name = message.Params[2]
+	}
+
+	sc.channelsLock.Lock()
+	defer sc.channelsLock.Unlock()
+
+	channel, exists := sc.channels[strings.ToLower(name)]
+	if !exists {
+		return
+	}
+
+	switch message.Command {
+	case ircclient.RPL_TOPIC:
+		if len(message.Params) >= 3 {
+			channel.Topic = message.Params[2]
+		}
+
+	case ircclient.RPL_TOPICTIME:
+		if len(message.Params) >= 4 {
+			channel.TopicSetter = message.Params[2]
+			topicTime, err := strconv.ParseInt(message.Params[3], 10, 64)
+			if err == nil {
+				channel.TopicTime = time.Unix(topicTime, 0)
+			}
+		}
+
+	case ircclient.RPL_CHANNELMODEIS:
+		channel.Modes = make(map[rune]string)
+		sc.applyChannelModes(channel, message.Params[2:])
+
+	case ircclient.RPL_NAMREPLY:
+		// A new NAMES reply replaces whatever members we had
+		if !channel.receivingNames {
+			channel.receivingNames = true
+			channel.Members = make(map[string]*ChannelMember)
+		}
+
+		for _, name := range strings.Fields(message.Params[3]) {
+			prefixes, mask := sc.splitNamesPrefix(name)
+			nick, _, _ := SplitMask(mask)
+			member := &ChannelMember{
+				Nick:     nick,
+				Prefixes: prefixes,
+			}
+			if mask != nick {
+				member.Mask = mask
+			}
+			channel.Members[strings.ToLower(nick)] = member
+		}
+
+	case ircclient.RPL_ENDOFNAMES:
+		channel.receivingNames = false
+	}
+}
+
+// ownModeReply returns true for the replies to the MODE we send after joining a channel.
+// Clients didn't ask for them, so they aren't passed on.
+func (sc *ServerConnection) ownModeReply(message *ircmsg.IrcMessage) bool {
+	sc.channelsLock.Lock()
+	defer sc.channelsLock.Unlock()
+
+	// The creation time can only come straight after the modes
+	modeReplyChannel := sc.modeReplyChannel
+	sc.modeReplyChannel = ""
+
+	if len(message.Params) < 2 {
+		return false
+	}
+	name := strings.ToLower(message.Params[1])
+
+	switch message.Command {
+	case ircclient.RPL_CHANNELMODEIS:
+		channel, exists := sc.channels[name]
+		if !exists || !channel.modeQueried {
+			return false
+		}
+		channel.modeQueried = false
+		sc.modeReplyChannel = name
+		return true
+
+	case ircclient.RPL_CHANNELCREATED:
+		return name == modeReplyChannel
+	}
+
+	return false
+}
+
+func (sc *ServerConnection) channelStateMode(message *ircmsg.IrcMessage) {
+	if len(message.Params) < 2 {
+		return
+	}
+
+	sc.channelsLock.Lock()
+	defer sc.channelsLock.Unlock()
+
+	channel, exists := sc.channels[strings.ToLower(message.Params[0])]
+	if exists {
+		sc.applyChannelModes(channel, message.Params[1:])
+	}
+}
+
+// applyChannelModes applies a mode change such as ["+o-k", "nick", "key"] to the channel.
+func (sc *ServerConnection) applyChannelModes(channel *ChannelState, params []string) {
+	if len(params) == 0 {
+		return
+	}
+
+	prefixModes, prefixes := sc.chanPrefixes()
+	modeTypes := sc.chanModeTypes()
+
+	args := params[1:]
+	nextArg := func() string {
+		if len(args) == 0 {
+			return ""
+		}
+		arg := args[0]
+		args = args[1:]
+		return arg
+	}
+
+	adding := true
+	for _, mode := range params[0] {
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+
+		case strings.ContainsRune(prefixModes, mode):
+			member, exists := channel.Members[strings.ToLower(nextArg())]
+			if exists {
+				prefix := prefixes[strings.IndexRune(prefixModes, mode)]
+				sc.setMemberPrefix(member, prefix, adding)
+			}
+
+		case strings.ContainsRune(modeTypes[0], mode):
+			// We don't keep track of ban lists and the like
+			nextArg()
+
+		case strings.ContainsRune(modeTypes[1], mode):
+			arg := nextArg()
+			if adding {
+				channel.Modes[mode] = arg
+			} else {
+				delete(channel.Modes, mode)
+			}
+
+		case strings.ContainsRune(modeTypes[2], mode):
+			if adding {
+				channel.Modes[mode] = nextArg()
+			} else {
+				delete(channel.Modes, mode)
+			}
+
+		default:
+			if adding {
+				channel.Modes[mode] = ""
+			} else {
+				delete(channel.Modes, mode)
+			}
+		}
+	}
+}
+
+// clearChannelState forgets every channel, eg. when we lose our connection
+func (sc *ServerConnection) clearChannelState() {
+	sc.channelsLock.Lock()
+	sc.channels = make(map[string]*ChannelState)
+	sc.channelsLock.Unlock()
+}
+
+// DumpChannelState sends the listener a JOIN for the channel followed by its topic and
+// member list, the same as the server would have.
+func (sc *ServerConnection) DumpChannelState(listener *Listener, channel *ChannelState) {
+	sc.channelsLock.RLock()
+	defer sc.channelsLock.RUnlock()
+
+	nick := listener.ClientNick
+	sc.sendToListener(listener, sc.CurrentMask, "JOIN", channel.Name)
+
+	if channel.Topic != "" {
+		sc.sendToListener(listener, listener.Source, ircclient.RPL_TOPIC, nick, channel.Name, channel.Topic)
+		if channel.TopicSetter != "" {
+			topicTime := strconv.FormatInt(channel.TopicTime.Unix(), 10)
+			sc.sendToListener(listener, listener.Source, ircclient.RPL_TOPICTIME, nick, channel.Name, channel.TopicSetter, topicTime)
+		}
+	}
+
+	// Keep each line well under the 512 byte limit
+	symbol := channel.NamesSymbol()
+	names := channel.Names()
+	line := ""
+	for _, name := range names {
+		if line != "" && len(line)+len(name) > 400 {
+			sc.sendToListener(listener, listener.Source, ircclient.RPL_NAMREPLY, nick, symbol, channel.Name, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += name
+	}
+	if line != "" {
+		sc.sendToListener(listener, listener.Source, ircclient.RPL_NAMREPLY, nick, symbol, channel.Name, line)
+	}
+	sc.sendToListener(listener, listener.Source, ircclient.RPL_ENDOFNAMES, nick, channel.Name, "End of /NAMES list")
+}
@@ -0,0 +1,102 @@
+package ircbnc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyChannelModes(t *testing.T) {
+	tests := []struct {
+		supported map[string]string
+		modes     map[rune]string
+		params    []string
+		want      []string
+		prefixes  map[string]string
+	}{
+		{
+			params: []string{"+nt"},
+			want:   []string{"+nt"},
+		},
+		{
+			modes:  map[rune]string{'n': "", 't': ""},
+			params: []string{"-t+s"},
+			want:   []string{"+ns"},
+		},
+		{
+			params: []string{"+kl", "secret", "20"},
+			want:   []string{"+kl", "secret", "20"},
+		},
+		{
+			// k needs its parameter to be removed, l doesn't
+			modes:  map[rune]string{'k': "secret", 'l': "20"},
+			params: []string{"-lk", "secret"},
+			want:   []string{"+"},
+		},
+		{
+			// Bans aren't kept, but their masks mustn't be taken as other parameters
+			params: []string{"+bk", "*!*@example.com", "secret"},
+			want:   []string{"+k", "secret"},
+		},
+		{
+			params:   []string{"+o-v", "dan", "dan"},
+			want:     []string{"+"},
+			prefixes: map[string]string{"dan": "@", "ed": ""},
+		},
+		{
+			// Prefixes are kept in order of rank, whichever order they're given in
+			params:   []string{"+vo", "ed", "ed"},
+			want:     []string{"+"},
+			prefixes: map[string]string{"dan": "+", "ed": "@+"},
+		},
+		{
+			// Modes for people who aren't in the channel are ignored
+			params:   []string{"+o", "someone"},
+			want:     []string{"+"},
+			prefixes: map[string]string{"dan": "+", "ed": ""},
+		},
+		{
+			supported: map[string]string{
+				"PREFIX":    "(qaohv)~&@%+",
+				"CHANMODES": "beIq,k,fl,imnpst",
+			},
+			params:   []string{"+qhf", "dan", "ed", "[5t]:15"},
+			want:     []string{"+f", "[5t]:15"},
+			prefixes: map[string]string{"dan": "~+", "ed": "%"},
+		},
+		{
+			// Unknown modes without parameters are kept
+			params: []string{"+Cz"},
+			want:   []string{"+Cz"},
+		},
+		{
+			params: []string{},
+			want:   []string{"+"},
+		},
+	}
+
+	for _, test := range tests {
+		sc := NewServerConnection()
+		for name, value := range test.supported {
+			sc.Foo.Supported[name] = value
+		}
+
+		channel := NewChannelState("#chan")
+		for mode, param := range test.modes {
+			channel.Modes[mode] = param
+		}
+		channel.Members["dan"] = &ChannelMember{Nick: "dan", Prefixes: "+"}
+		channel.Members["ed"] = &ChannelMember{Nick: "ed"}
+
+		sc.applyChannelModes(channel, test.params)
+
+		got := channel.ModeString()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("applyChannelModes(%q) left modes %q, want %q", test.params, got, test.want)
+		}
+		for nick, prefixes := range test.prefixes {
+			if channel.Members[nick].Prefixes != prefixes {
+				t.Errorf("applyChannelModes(%q) left %s with prefixes %q, want %q", test.params, nick, channel.Members[nick].Prefixes, prefixes)
+			}
+		}
+	}
+}
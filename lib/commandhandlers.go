@@ -4,14 +4,23 @@
 package ircbnc
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
-	"log"
-
+	"github.com/goshuirc/bnc/lib/ircclient"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+// ListenerSaslMechanisms are the SASL mechanisms clients can use to log in to us
+var ListenerSaslMechanisms = []string{"PLAIN", "EXTERNAL"}
+
+// maxSaslFailures is how many failed SASL logins a client gets before we disconnect it
+const maxSaslFailures = 3
+
 func loadClientCommands() {
 	ClientCommands["NICK"] = ClientCommand{
 		usablePreReg: true,
@@ -32,7 +41,9 @@ func loadClientCommands() {
 			}
 			//TODO(dan): Handle NICK messages when connected to servers.
 			//listener.Send(nil, "", "ERROR", "We're supposed to handle NICK changes here!")
-			listener.ServerConnection.Nickname = nick
+			if listener.ServerConnection != nil {
+				listener.ServerConnection.Nickname = nick
+			}
 			return false
 		},
 	}
@@ -47,6 +58,14 @@ func loadClientCommands() {
 				listener.regLocks.Set("user", true)
 			}
 
+			// Clients with a known certificate don't need to send PASS. They can choose
+			// their network with a username of "<username>[@<client>]/<network>"
+			if !listener.Registered && listener.User == nil && listener.CertFP != "" {
+				listener.certLogin = msg.Params[0]
+				listener.certLoginPending = true
+				listener.tryCertLogin()
+			}
+
 			return true
 		},
 	}
@@ -63,46 +82,27 @@ func loadClientCommands() {
 			splitString := strings.SplitN(msg.Params[0], ":", 2)
 
 			if len(splitString) < 2 {
-				listener.Send(nil, "", "ERROR", `Password must be of the format "<username>/<network>:<password>"`)
+				listener.Send(nil, "", "ERROR", `Password must be of the format "<username>[@<client>]/<network>:<password>", or use "*" as the network for all of them`)
 				listener.Socket.Close()
 				return true
 			}
 
 			password := splitString[1]
-
-			var userid, networkID string
-			if strings.Contains(splitString[0], "/") {
-				splitString = strings.Split(splitString[0], "/")
-				userid, networkID = splitString[0], splitString[1]
-			} else {
-				userid = splitString[0]
-			}
+			userid, clientID, networkID := splitLogin(splitString[0])
 
 			authedUserId, authSuccess := listener.Manager.Ds.AuthUser(userid, password)
 			if !authSuccess {
+				listener.Manager.Bus.Dispatch(HookAuthFailedName, &HookAuthFailed{
+					Listener: listener,
+					Method:   "PASS",
+				})
 				listener.Socket.SetFinalData(fmt.Sprintf(":%s 464 %s :Invalid password\n", listener.Manager.Source, listener.ClientNick))
 				listener.Socket.Close()
 				return true
 			}
 
-			user := listener.Manager.Users[authedUserId]
-			listener.User = user
-
-			// An empty network ID may be a user logging in just to control his account or networks
-			if networkID != "" {
-				network, netExists := user.Networks[networkID]
-				if netExists {
-					network.AddListener(listener)
-
-					if !network.Foo.Connected {
-						go network.Connect()
-					}
-				} else {
-					log.Printf("Network %s/%s doesnt exist", userid, networkID)
-				}
-			}
-
-			listener.regLocks.Set("pass", true)
+			user := listener.Manager.User(authedUserId)
+			listener.LogIn(user, clientID, networkID)
 			return true
 		},
 	}
@@ -116,7 +116,9 @@ func loadClientCommands() {
 
 			command := strings.ToUpper(getParam(&msg, 0))
 			if command == "LS" {
-				capList := Capabilities.SupportedString()
+				// Only clients that know about CAP 302 understand values like sasl=PLAIN
+				version, _ := strconv.Atoi(getParam(&msg, 1))
+				capList := Capabilities.SupportedString(version >= 302)
 				listener.Send(nil, "", "CAP", "*", "LS", capList)
 
 			} else if command == "REQ" {
@@ -149,6 +151,160 @@ func loadClientCommands() {
 
 			} else if command == "END" {
 				listener.regLocks.Set("cap", true)
+				listener.tryCertLogin()
+			}
+
+			return true
+		},
+	}
+
+	ClientCommands["AUTHENTICATE"] = ClientCommand{
+		usablePreReg: true,
+		minParams:    1,
+		handler: func(listener *Listener, msg ircmsg.IrcMessage) bool {
+			nick := listener.ClientNick
+
+			if !listener.IsCapEnabled("sasl") || listener.Registered {
+				listener.Send(nil, listener.Manager.Source, ircclient.ERR_SASLFAIL, nick, "SASL authentication failed")
+				return true
+			}
+			if listener.User != nil {
+				listener.Send(nil, listener.Manager.Source, ircclient.ERR_SASLALREADY, nick, "You have already authenticated")
+				return true
+			}
+
+			data := msg.Params[0]
+			if data == "*" {
+				listener.saslMechanism = ""
+				listener.saslResponse = ""
+				listener.Send(nil, listener.Manager.Source, ircclient.ERR_SASLABORTED, nick, "SASL authentication aborted")
+				return true
+			}
+
+			// The first AUTHENTICATE picks the mechanism
+			if listener.saslMechanism == "" {
+				mechanism := strings.ToUpper(data)
+				supported := false
+				for _, listenerMechanism := range ListenerSaslMechanisms {
+					if mechanism == listenerMechanism {
+						supported = true
+					}
+				}
+
+				if !supported {
+					listener.Send(nil, listener.Manager.Source, ircclient.RPL_SASLMECHS, nick, strings.Join(ListenerSaslMechanisms, ","), "are available SASL mechanisms")
+					listener.Send(nil, listener.Manager.Source, ircclient.ERR_SASLFAIL, nick, "SASL authentication failed")
+					return true
+				}
+
+				listener.saslMechanism = mechanism
+				listener.Send(nil, "", "AUTHENTICATE", "+")
+				return true
+			}
+
+			// Responses longer than 400 bytes are split over multiple lines
+			if data != "+" {
+				listener.saslResponse += data
+			}
+			if len(listener.saslResponse) > 8192 {
+				listener.saslMechanism = ""
+				listener.saslResponse = ""
+				listener.Send(nil, listener.Manager.Source, ircclient.ERR_SASLTOOLONG, nick, "SASL message too long")
+				return true
+			}
+			if len(data) == 400 {
+				return true
+			}
+
+			mechanism := listener.saslMechanism
+			response, err := base64.StdEncoding.DecodeString(listener.saslResponse)
+			listener.saslMechanism = ""
+			listener.saslResponse = ""
+
+			var user *User
+			var clientID, networkID string
+			if err == nil {
+				switch mechanism {
+				case "PLAIN":
+					user, clientID, networkID = saslPlain(listener, response)
+				case "EXTERNAL":
+					user, clientID, networkID = saslExternal(listener, response)
+				}
+			}
+
+			if user == nil {
+				listener.Manager.Bus.Dispatch(HookAuthFailedName, &HookAuthFailed{
+					Listener: listener,
+					Method:   "SASL " + mechanism,
+				})
+				listener.Send(nil, listener.Manager.Source, ircclient.ERR_SASLFAIL, nick, "SASL authentication failed")
+
+				// Don't let one connection keep guessing passwords
+				listener.saslFailures++
+				if listener.saslFailures >= maxSaslFailures {
+					listener.Socket.SetFinalData("ERROR :Too many failed login attempts\r\n")
+					listener.Socket.Close()
+				}
+				return true
+			}
+
+			listener.LogIn(user, clientID, networkID)
+			listener.Send(nil, listener.Manager.Source, ircclient.RPL_LOGGEDIN, nick, fmt.Sprintf("%s!%s@%s", nick, user.ID, listener.Manager.Source), user.ID, "You are now logged in as "+user.ID)
+			listener.Send(nil, listener.Manager.Source, ircclient.RPL_SASLSUCCESS, nick, "SASL authentication successful")
+			return true
+		},
+	}
+
+	ClientCommands["MARKREAD"] = ClientCommand{
+		usablePreReg: false,
+		minParams:    0,
+		handler: func(listener *Listener, msg ircmsg.IrcMessage) bool {
+			if len(msg.Params) < 1 {
+				listener.Send(nil, listener.Manager.Source, "FAIL", "MARKREAD", "NEED_MORE_PARAMS", "Missing parameters")
+				return true
+			}
+
+			target := msg.Params[0]
+			sc := listener.ServerConnection
+			name := target
+			if listener.MultiNetwork {
+				sc, name = listener.splitNetworkTarget(target)
+			}
+			var buffer *ServerConnectionBuffer
+			if sc != nil {
+				buffer = sc.Buffers.Get(name)
+			}
+			if buffer == nil {
+				listener.Send(nil, listener.Manager.Source, "FAIL", "MARKREAD", "INVALID_PARAMS", target, "Unknown target")
+				return true
+			}
+
+			// Asking for the current marker
+			if len(msg.Params) < 2 {
+				listener.SendReadMarker(sc, buffer)
+				return true
+			}
+
+			if !strings.HasPrefix(msg.Params[1], "timestamp=") {
+				listener.Send(nil, listener.Manager.Source, "FAIL", "MARKREAD", "INVALID_PARAMS", target, "Invalid timestamp")
+				return true
+			}
+			seen, err := time.Parse(time.RFC3339, strings.TrimPrefix(msg.Params[1], "timestamp="))
+			if err != nil {
+				listener.Send(nil, listener.Manager.Source, "FAIL", "MARKREAD", "INVALID_PARAMS", target, "Invalid timestamp")
+				return true
+			}
+
+			changed, err := sc.SetReadMarker(buffer, seen)
+			if err != nil {
+				listener.Send(nil, listener.Manager.Source, "FAIL", "MARKREAD", "INTERNAL_ERROR", target, "Could not save the read marker")
+				return true
+			}
+
+			// Every listener has already been told about a new marker. Otherwise let
+			// this one know the marker is still where it was.
+			if !changed {
+				listener.SendReadMarker(sc, buffer)
 			}
 
 			return true
@@ -179,6 +335,12 @@ func loadClientCommands() {
 		usablePreReg: true,
 		minParams:    1,
 		handler: func(listener *Listener, msg ircmsg.IrcMessage) bool {
+			// Multi-network listeners leave channels through forwardMultiNetwork, the
+			// buffer is removed when the server's PART comes back
+			if listener.ServerConnection == nil {
+				return false
+			}
+
 			channelName := msg.Params[0]
 			listener.ServerConnection.Buffers.Remove(channelName)
 			listener.ServerConnection.Save()
@@ -187,6 +349,64 @@ func loadClientCommands() {
 	}
 }
 
+// saslPlain checks a SASL PLAIN response, returning the user it logs in as and the client
+// and network they chose. The authcid may be given as "<username>[@<client>]/<network>",
+// the same as PASS.
+func saslPlain(listener *Listener, response []byte) (*User, string, string) {
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, "", ""
+	}
+
+	userid, clientID, networkID := splitLogin(string(parts[1]))
+	password := string(parts[2])
+
+	authedUserId, authSuccess := listener.Manager.Ds.AuthUser(userid, password)
+	if !authSuccess {
+		return nil, "", ""
+	}
+
+	return listener.Manager.User(authedUserId), clientID, networkID
+}
+
+// saslExternal checks the client's certificate, returning the user it logs in as and the
+// client and network they chose with an optional "<username>[@<client>]/<network>" authzid.
+func saslExternal(listener *Listener, response []byte) (*User, string, string) {
+	if listener.CertFP == "" {
+		return nil, "", ""
+	}
+
+	authedUserId, authSuccess := listener.Manager.Ds.AuthUserByCertFP(listener.CertFP)
+	if !authSuccess {
+		return nil, "", ""
+	}
+
+	userid, clientID, networkID := splitLogin(string(response))
+	if userid != "" && strings.ToLower(userid) != authedUserId {
+		return nil, "", ""
+	}
+
+	return listener.Manager.User(authedUserId), clientID, networkID
+}
+
+// splitLogin splits a "<username>[@<client>]/<network>" login into its username, client
+// and network. The client name lets the bouncer keep track of each of a user's devices.
+func splitLogin(login string) (string, string, string) {
+	var networkID string
+	if strings.Contains(login, "/") {
+		splitString := strings.SplitN(login, "/", 2)
+		login, networkID = splitString[0], splitString[1]
+	}
+
+	var clientID string
+	if strings.Contains(login, "@") {
+		splitString := strings.SplitN(login, "@", 2)
+		login, clientID = splitString[0], splitString[1]
+	}
+
+	return login, clientID, networkID
+}
+
 func getParam(msg *ircmsg.IrcMessage, idx int) string {
 	if len(msg.Params)-1 < idx {
 		return ""
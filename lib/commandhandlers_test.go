@@ -0,0 +1,32 @@
+package ircbnc
+
+import (
+	"testing"
+)
+
+func TestSplitLogin(t *testing.T) {
+	tests := []struct {
+		login    string
+		userID   string
+		clientID string
+		network  string
+	}{
+		{"dan", "dan", "", ""},
+		{"dan/freenode", "dan", "", "freenode"},
+		{"dan@phone", "dan", "phone", ""},
+		{"dan@phone/freenode", "dan", "phone", "freenode"},
+		{"dan/*", "dan", "", "*"},
+		{"dan@phone/*", "dan", "phone", "*"},
+		{"dan@phone@laptop/freenode", "dan", "phone@laptop", "freenode"},
+		{"dan/free/node", "dan", "", "free/node"},
+		{"dan/net@work", "dan", "", "net@work"},
+		{"", "", "", ""},
+	}
+
+	for _, test := range tests {
+		userID, clientID, network := splitLogin(test.login)
+		if userID != test.userID || clientID != test.clientID || network != test.network {
+			t.Errorf("splitLogin(%q) = %q, %q, %q, want %q, %q, %q", test.login, userID, clientID, network, test.userID, test.clientID, test.network)
+		}
+	}
+}
@@ -2,17 +2,25 @@ package bncComponentBouncer
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/ircclient"
+	"github.com/goshuirc/bnc/lib/logger"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+var bouncerLog = bncLog.New("components.bouncer")
+
+// MaxSearchResults is the most messages a single search will return
+const MaxSearchResults = 50
+
 func Run(manager *ircbnc.Manager) {
 	ircbnc.Capabilities.Supported["bouncer"] = ""
+	ircbnc.Capabilities.Supported[CapBouncerNetworks] = ""
+	ircbnc.Capabilities.Supported[CapBouncerNetworksNotify] = ""
 
 	b := &Bouncer{
 		Manager: manager,
@@ -26,6 +34,7 @@ type Bouncer struct {
 
 func (bouncer *Bouncer) RegisterHooks() {
 	bouncer.Manager.Bus.Register(ircbnc.HookIrcRawName, bouncer.onMessage)
+	bouncer.Manager.Bus.Register(ircbnc.HookNetworkStateName, bouncer.onNetworkState)
 }
 
 func (bouncer *Bouncer) onMessage(hook interface{}) {
@@ -44,6 +53,21 @@ func (bouncer *Bouncer) onMessage(hook interface{}) {
 	// Stop the message from being sent upstream
 	event.Halt = true
 
+	if len(msg.Params) < 1 {
+		return
+	}
+
+	// Clients using bouncer-networks send uppercase subcommands, everything else is
+	// handled by our original lowercase ones
+	if bouncer.handleNetworksCommand(listener, msg) {
+		return
+	}
+
+	// The original subcommands all need a logged in user
+	if listener.User == nil {
+		return
+	}
+
 	command := strings.ToLower(msg.Params[0])
 	params := msg.Params[1:]
 
@@ -68,6 +92,8 @@ func (bouncer *Bouncer) onMessage(hook interface{}) {
 		bouncer.commandDelBuffer(listener, params, msg)
 	case "delnetwork":
 		bouncer.commandDelNetwork(listener, params, msg)
+	case "search":
+		bouncer.commandSearch(listener, params, msg)
 	}
 }
 
@@ -111,10 +137,10 @@ func (bouncer *Bouncer) commandDisconnectNetwork(listener *ircbnc.Listener, para
 
 // [c] bouncer listnetworks
 // [s] bouncer listnetworks network=freenode;host=irc.freenode.net;port=6667;state=disconnected;
-// [s] bouncer listnetworks network=snoonet;host=irc.snoonet.org;port=6697;state=connected;tls=1
+// [s] bouncer listnetworks network=snoonet;host=irc.snoonet.org;port=6697;state=connected;tls=1;lag=85
 // [s] bouncer listnetworks end
 func (bouncer *Bouncer) commandListNetworks(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
-	for _, network := range listener.User.Networks {
+	for _, network := range listener.User.NetworkList() {
 		vals := make(map[string]string)
 		vals["network"] = network.Name
 		vals["nick"] = network.Nickname
@@ -122,15 +148,29 @@ func (bouncer *Bouncer) commandListNetworks(listener *ircbnc.Listener, params []
 		vals["host"] = network.Addresses[0].Host
 		vals["port"] = strconv.Itoa(network.Addresses[0].Port)
 		vals["password"] = network.Password
+		vals["sasl-mechanism"] = network.SaslMechanism
+		vals["sasl-account"] = network.SaslAccount
 
 		if network.Addresses[0].UseTLS {
 			vals["tls"] = "1"
 		} else {
 			vals["tls"] = "0"
 		}
+		if network.Addresses[0].Proxy != "" {
+			vals["proxy"] = ircclient.RedactProxy(network.Addresses[0].Proxy)
+		}
+		if network.BindHost != "" {
+			vals["bindhost"] = network.BindHost
+		}
+		if network.AddressFamily != "" {
+			vals["address-family"] = network.AddressFamily
+		}
 		if network.Foo.Connected {
 			vals["state"] = "connected"
 			vals["currentNick"] = network.Foo.Nick
+			if lag, known := network.Foo.Lag(); known {
+				vals["lag"] = strconv.FormatInt(int64(lag/time.Millisecond), 10)
+			}
 		} else {
 			vals["state"] = "disconnected"
 		}
@@ -160,22 +200,69 @@ func (bouncer *Bouncer) commandPlaybackBuffers(listener *ircbnc.Listener, params
 		return
 	}
 
+	listener.SendPlayback(net)
+}
+
+// [c] bouncer search freenode * :some words
+// [c] bouncer search freenode buffer=#chan;after=2019-01-04T14:33:26.123Z;before=2019-01-05T14:33:26.123Z;limit=20 :some words
+// [s] BATCH +ID goshuirc.net/search freenode
+// [s] @batch=ID;time=2019-01-04T15:00:00.000Z;msgid=... :nick PRIVMSG #chan :saying some words
+// [s] BATCH -ID
+// [s] bouncer search freenode ERR_NOTSUPPORTED
+func (bouncer *Bouncer) commandSearch(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 3 {
+		listener.SendLine("BOUNCER search * ERR_INVALIDARGS")
+		return
+	}
+
+	if !listener.User.HasPermission(ircbnc.PermLogSearch) {
+		listener.SendLine("BOUNCER search * ERR_NOPERMISSION")
+		return
+	}
+
+	netName := params[0]
+	net := getNetworkByName(listener, netName)
+	if net == nil {
+		listener.SendLine("BOUNCER search " + netName + " ERR_NETNOTFOUND")
+		return
+	}
+
 	store := bouncer.Manager.Messages
-	if store == nil || !store.SupportsRetrieve() {
+	if store == nil || !store.SupportsSearch() {
+		listener.SendLine("BOUNCER search " + net.Name + " ERR_NOTSUPPORTED")
 		return
 	}
 
-	for _, buffer := range net.Buffers {
-		msgs := store.GetBeforeTime(listener.User.ID, net.Name, buffer.Name, time.Now(), 50)
-		for _, message := range msgs {
-			line, err := message.Line()
-			if err != nil {
-				log.Println("Error building message from storage:", err.Error())
-				continue
-			}
-			listener.SendLine(line)
+	vars := make(map[string]ircmsg.TagValue)
+	if params[1] != "*" {
+		var tagsErr error
+		vars, tagsErr = ircmsg.ParseTags(params[1])
+		if tagsErr != nil {
+			listener.SendLine("BOUNCER search " + net.Name + " ERR_INVALIDARGS")
+			return
 		}
 	}
+
+	var after, before time.Time
+	var err error
+	if val := tagValue(vars, "after", ""); val != "" {
+		after, err = time.Parse(time.RFC3339, val)
+	}
+	if val := tagValue(vars, "before", ""); val != "" && err == nil {
+		before, err = time.Parse(time.RFC3339, val)
+	}
+	limit, limitErr := strconv.Atoi(tagValue(vars, "limit", strconv.Itoa(MaxSearchResults)))
+	if err != nil || limitErr != nil || limit < 1 {
+		listener.SendLine("BOUNCER search " + net.Name + " ERR_INVALIDARGS")
+		return
+	}
+	if limit > MaxSearchResults {
+		limit = MaxSearchResults
+	}
+
+	query := strings.Join(params[2:], " ")
+	msgs := store.Search(listener.User.ID, net.Name, tagValue(vars, "buffer", ""), query, after, before, limit)
+	listener.SendBatch(ircbnc.BatchTypeSearch, []string{net.Name}, msgs)
 }
 
 // [c] bouncer listbuffers <network name>
@@ -202,9 +289,14 @@ func (bouncer *Bouncer) commandListBuffers(listener *ircbnc.Listener, params []s
 
 		if buffer.Channel {
 			vals["channel"] = "1"
-			// TODO: Store the topic in the channels when we have them
 			vals["topic"] = ""
-			vals["joined"] = "1"
+			vals["joined"] = "0"
+
+			channel := net.Channel(buffer.Name)
+			if channel != nil {
+				vals["topic"] = channel.Topic
+				vals["joined"] = "1"
+			}
 		}
 
 		line := ""
@@ -256,16 +348,20 @@ func (bouncer *Bouncer) commandDelNetwork(listener *ircbnc.Listener, params []st
 		return
 	}
 
-	net.Disconnect()
+	err := deleteNetwork(listener, net)
+	if err != nil {
+		listener.SendLine(fmt.Sprintf("BOUNCER delnetwork %s ERR_UNKNOWN :Error saving the network", netName))
+		return
+	}
 	listener.Send(nil, "", "BOUNCER", "state", netName, "disconnected")
-
-	delete(listener.User.Networks, net.Name)
-	listener.Manager.Ds.DelConnection(net)
 }
 
 // [c] bouncer addnetwork network=freenode;host=irc.freenode.net;port=6667;nick=prawnsalad;user=prawn
+// [c] bouncer addnetwork network=freenode;host=irc.freenode.net;sasl-mechanism=PLAIN;sasl-account=prawn;sasl-password=hunter2
+// [c] bouncer addnetwork network=onion;host=example.onion;port=6667;proxy=socks5h://127.0.0.1:9050
 // [s] bouncer addnetwork ERR_NAMEINUSE freenode
 // [s] bouncer addnetwork ERR_NEEDSNAME *
+// [s] bouncer addnetwork ERR_NOPERMISSION *
 // [s] bouncer addnetwork RPL_OK freenode
 func (bouncer *Bouncer) commandAddNetwork(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
 	if len(params) < 1 {
@@ -279,6 +375,11 @@ func (bouncer *Bouncer) commandAddNetwork(listener *ircbnc.Listener, params []st
 		return
 	}
 
+	if !listener.User.CanAddNetwork() {
+		listener.SendLine("BOUNCER addnetwork * ERR_NOPERMISSION")
+		return
+	}
+
 	netName := tagValue(vars, "network", "")
 	netAddress := tagValue(vars, "host", "")
 	netPort, _ := strconv.Atoi(tagValue(vars, "port", "6667"))
@@ -300,6 +401,13 @@ func (bouncer *Bouncer) commandAddNetwork(listener *ircbnc.Listener, params []st
 		return
 	}
 
+	netProxy := tagValue(vars, "proxy", "")
+	_, proxyErr := ircclient.ParseProxy(netProxy)
+	if proxyErr != nil {
+		listener.SendLine("BOUNCER addnetwork " + netName + " ERR_INVALIDARGS :" + proxyErr.Error())
+		return
+	}
+
 	existingNet := getNetworkByName(listener, netName)
 	if existingNet != nil {
 		listener.SendLine("BOUNCER addnetwork " + existingNet.Name + " ERR_NAMEINUSE")
@@ -327,24 +435,44 @@ func (bouncer *Bouncer) commandAddNetwork(listener *ircbnc.Listener, params []st
 		connection.Realname = listener.User.DefaultReal
 	}
 
+	saslErr := connection.SetSasl(
+		tagValue(vars, "sasl-mechanism", ""),
+		tagValue(vars, "sasl-account", ""),
+		tagValue(vars, "sasl-password", ""),
+	)
+	if saslErr != nil {
+		listener.SendLine("BOUNCER addnetwork " + netName + " ERR_INVALIDARGS :" + saslErr.Error())
+		return
+	}
+
+	bindHostErr := connection.SetBindHost(tagValue(vars, "bindhost", ""), tagValue(vars, "address-family", ""))
+	if bindHostErr != nil {
+		listener.SendLine("BOUNCER addnetwork " + netName + " ERR_INVALIDARGS :" + bindHostErr.Error())
+		return
+	}
+
 	newAddress := ircbnc.ServerConnectionAddress{
 		Host:      netAddress,
 		Port:      netPort,
 		UseTLS:    netTls,
-		VerifyTLS: false,
+		VerifyTLS: tagValue(vars, "verify-tls", "1") != "0",
+		Proxy:     netProxy,
 	}
 	connection.Addresses = append(connection.Addresses, newAddress)
-	listener.User.Networks[connection.Name] = connection
-
-	saveErr := listener.Manager.Ds.SaveConnection(connection)
+	saveErr := listener.User.AddNetwork(connection)
 	if saveErr != nil {
 		listener.SendLine("BOUNCER addnetwork " + netName + " ERR_UNKNOWN :Error saving the network")
 	} else {
+		notifyNetwork(listener.Manager, connection, networkAttrValues(connection))
 		listener.SendLine("BOUNCER addnetwork " + netName + " RPL_OK")
 	}
 }
 
 // [c] bouncer changenetwork freenode host=irc.freenode.net;port=6667;
+// [c] bouncer changenetwork freenode sasl-mechanism=EXTERNAL
+// [c] bouncer changenetwork freenode sasl-mechanism=
+// [c] bouncer changenetwork freenode proxy=http://proxy.example.com:3128
+// [c] bouncer changenetwork freenode bindhost=2001:db8::5;address-family=ipv6
 // [s] bouncer changenetwork RPL_OK freenode
 func (bouncer *Bouncer) commandChangeNetwork(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
 	if len(params) < 2 {
@@ -365,6 +493,38 @@ func (bouncer *Bouncer) commandChangeNetwork(listener *ircbnc.Listener, params [
 		return
 	}
 
+	// Every tag is checked before anything is changed, so that an invalid one doesn't
+	// leave the network half updated
+
+	// An empty proxy goes back to connecting directly
+	proxyTag, proxyGiven := vars["proxy"]
+	if proxyGiven {
+		_, proxyErr := ircclient.ParseProxy(proxyTag.Value)
+		if proxyErr != nil {
+			listener.SendLine("BOUNCER changenetwork " + net.Name + " ERR_INVALIDARGS :" + proxyErr.Error())
+			return
+		}
+	}
+
+	// Any SASL details not given are kept as they are
+	saslMechanism := tagValue(vars, "sasl-mechanism", net.SaslMechanism)
+	saslAccount := tagValue(vars, "sasl-account", net.SaslAccount)
+	saslPassword := tagValue(vars, "sasl-password", net.SaslPassword)
+	saslErr := net.CheckSasl(saslMechanism, saslAccount, saslPassword)
+	if saslErr != nil {
+		listener.SendLine("BOUNCER changenetwork " + net.Name + " ERR_INVALIDARGS :" + saslErr.Error())
+		return
+	}
+
+	// Any bind host details not given are kept as they are
+	bindHost := tagValue(vars, "bindhost", net.BindHost)
+	addressFamily := tagValue(vars, "address-family", net.AddressFamily)
+	bindHostErr := net.CheckBindHost(bindHost, addressFamily)
+	if bindHostErr != nil {
+		listener.SendLine("BOUNCER changenetwork " + net.Name + " ERR_INVALIDARGS :" + bindHostErr.Error())
+		return
+	}
+
 	netAddress := tagValue(vars, "host", "")
 	if netAddress != "" {
 		net.Addresses[0].Host = netAddress
@@ -397,10 +557,27 @@ func (bouncer *Bouncer) commandChangeNetwork(listener *ircbnc.Listener, params [
 	} else if netTls == "0" {
 		net.Addresses[0].UseTLS = false
 	}
+
+	netVerifyTls := tagValue(vars, "verify-tls", "")
+	if netVerifyTls == "1" {
+		net.Addresses[0].VerifyTLS = true
+	} else if netVerifyTls == "0" {
+		net.Addresses[0].VerifyTLS = false
+	}
+
+	if proxyGiven {
+		net.Addresses[0].Proxy = proxyTag.Value
+	}
+
+	// These have already been checked so they can't fail
+	net.SetSasl(saslMechanism, saslAccount, saslPassword)
+	net.SetBindHost(bindHost, addressFamily)
+
 	saveErr := listener.Manager.Ds.SaveConnection(net)
 	if saveErr != nil {
 		listener.SendLine("BOUNCER changenetwork " + net.Name + " ERR_UNKNOWN :Error saving the network")
 	} else {
+		notifyNetwork(listener.Manager, net, networkAttrValues(net))
 		listener.SendLine("BOUNCER changenetwork " + net.Name + " RPL_OK")
 	}
 }
@@ -437,9 +614,10 @@ func (bouncer *Bouncer) commandChangeBuffer(listener *ircbnc.Listener, params []
 	if seen != "" {
 		seenTime, seenErr := time.Parse(time.RFC3339, seen)
 		if seenErr != nil {
-			log.Println("Error parsing time for seen in BOUNCER: " + seenErr.Error())
+			bouncerLog.Warn("Could not parse time for seen in BOUNCER", "error", seenErr)
 		} else {
-			buffer.LastSeen = seenTime.UTC()
+			// Lets any other read-marker clients know as well
+			net.SetReadMarker(buffer, seenTime)
 		}
 	}
 
@@ -473,7 +651,7 @@ func tagValue(tags map[string]ircmsg.TagValue, name string, def string) string {
 }
 
 func getNetworkByName(listener *ircbnc.Listener, netName string) *ircbnc.ServerConnection {
-	for _, network := range listener.User.Networks {
+	for _, network := range listener.User.NetworkList() {
 		if strings.ToLower(network.Name) == strings.ToLower(netName) {
 			return network
 		}
@@ -0,0 +1,480 @@
+package bncComponentBouncer
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/ircclient"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// The soju.im/bouncer-networks extension, see https://git.sr.ht/~emersion/soju/tree/master/item/doc/ext/bouncer-networks.md
+const (
+	CapBouncerNetworks       = "soju.im/bouncer-networks"
+	CapBouncerNetworksNotify = "soju.im/bouncer-networks-notify"
+)
+
+// networkAttrs are the attributes clients may set on a network
+var networkAttrs = map[string]bool{
+	"name":           true,
+	"host":           true,
+	"port":           true,
+	"tls":            true,
+	"verify-tls":     true,
+	"proxy":          true,
+	"bindhost":       true,
+	"address-family": true,
+	"nickname":       true,
+	"username":       true,
+	"realname":       true,
+	"pass":           true,
+	"sasl-mechanism": true,
+	"sasl-account":   true,
+	"sasl-password":  true,
+}
+
+// readOnlyNetworkAttrs are the attributes we report but that clients can't change
+var readOnlyNetworkAttrs = map[string]bool{
+	"state": true,
+	"error": true,
+}
+
+// handleNetworksCommand handles the uppercase bouncer-networks subcommands, returning
+// false if the subcommand isn't one of them
+func (bouncer *Bouncer) handleNetworksCommand(listener *ircbnc.Listener, msg ircmsg.IrcMessage) bool {
+	if !listener.IsCapEnabled(CapBouncerNetworks) {
+		return false
+	}
+
+	subcommand := msg.Params[0]
+	params := msg.Params[1:]
+
+	switch subcommand {
+	case "BIND", "LISTNETWORKS", "ADDNETWORK", "CHANGENETWORK", "DELNETWORK":
+	default:
+		return false
+	}
+
+	if listener.User == nil {
+		sendBouncerFail(listener, "ACCOUNT_REQUIRED", subcommand, "", "Authentication required")
+		return true
+	}
+
+	switch subcommand {
+	case "BIND":
+		bouncer.networksBind(listener, params)
+	case "LISTNETWORKS":
+		bouncer.networksList(listener)
+	case "ADDNETWORK":
+		bouncer.networksAdd(listener, params)
+	case "CHANGENETWORK":
+		bouncer.networksChange(listener, params)
+	case "DELNETWORK":
+		bouncer.networksDel(listener, params)
+	}
+
+	return true
+}
+
+// [c] BOUNCER BIND freenode
+// [s] FAIL BOUNCER INVALID_NETID BIND freenode :Unknown network
+func (bouncer *Bouncer) networksBind(listener *ircbnc.Listener, params []string) {
+	if len(params) < 1 {
+		sendBouncerFail(listener, "NEED_MORE_PARAMS", "BIND", "", "Missing network ID")
+		return
+	}
+	if listener.Registered {
+		sendBouncerFail(listener, "REGISTRATION_IS_COMPLETED", "BIND", "", "Cannot bind to a network after registration")
+		return
+	}
+
+	net := getNetworkByName(listener, params[0])
+	if net == nil {
+		sendBouncerFail(listener, "INVALID_NETID", "BIND", params[0], "Unknown network")
+		return
+	}
+
+	listener.LogIn(listener.User, listener.ClientID, net.Name)
+}
+
+// [c] BOUNCER LISTNETWORKS
+// [s] BATCH +ID soju.im/bouncer-networks
+// [s] @batch=ID BOUNCER NETWORK freenode name=freenode;host=irc.freenode.net;state=connected
+// [s] BATCH -ID
+func (bouncer *Bouncer) networksList(listener *ircbnc.Listener) {
+	msgs := []*ircmsg.IrcMessage{}
+	for _, net := range listener.User.NetworkList() {
+		msg := ircmsg.MakeMessage(nil, listener.Manager.Source, "BOUNCER", "NETWORK", net.Name, encodeNetworkAttrs(networkAttrValues(net)))
+		msgs = append(msgs, &msg)
+	}
+
+	listener.SendBatch(CapBouncerNetworks, nil, msgs)
+}
+
+// [c] BOUNCER ADDNETWORK name=freenode;host=irc.freenode.net;port=6697;tls=1
+// [s] BOUNCER ADDNETWORK freenode
+func (bouncer *Bouncer) networksAdd(listener *ircbnc.Listener, params []string) {
+	if len(params) < 1 {
+		sendBouncerFail(listener, "NEED_MORE_PARAMS", "ADDNETWORK", "", "Missing attributes")
+		return
+	}
+
+	if !listener.User.CanAddNetwork() {
+		sendBouncerFail(listener, "NO_PERMISSION", "ADDNETWORK", "", "You don't have permission to add another network")
+		return
+	}
+
+	attrs, ok := parseNetworkAttrs(listener, "ADDNETWORK", params[0])
+	if !ok {
+		return
+	}
+
+	host := tagValue(attrs, "host", "")
+	if host == "" {
+		sendBouncerFail(listener, "NEED_ATTRIBUTE", "ADDNETWORK", "host", "Missing host")
+		return
+	}
+
+	name := tagValue(attrs, "name", host)
+	if getNetworkByName(listener, name) != nil {
+		sendBouncerFail(listener, "INVALID_ATTRIBUTE", "ADDNETWORK", "name", "Network name is already in use")
+		return
+	}
+
+	net := ircbnc.NewServerConnection()
+	net.User = listener.User
+	net.Name = name
+	net.Nickname = listener.User.DefaultNick
+	net.FbNickname = listener.User.DefaultFbNick
+	net.Username = listener.User.DefaultUser
+	net.Realname = listener.User.DefaultReal
+	net.Addresses = append(net.Addresses, ircbnc.ServerConnectionAddress{
+		Host: host,
+		Port: 6697,
+		// New networks use TLS and verify certificates unless told otherwise
+		UseTLS:    true,
+		VerifyTLS: true,
+	})
+
+	if !applyNetworkAttrs(listener, "ADDNETWORK", net, attrs) {
+		return
+	}
+
+	net.Enabled = true
+
+	saveErr := listener.User.AddNetwork(net)
+	if saveErr != nil {
+		sendBouncerFail(listener, "UNKNOWN_ERROR", "ADDNETWORK", "", "Error saving the network")
+		return
+	}
+
+	notifyNetwork(listener.Manager, net, networkAttrValues(net))
+	listener.Send(nil, listener.Manager.Source, "BOUNCER", "ADDNETWORK", net.Name)
+}
+
+// [c] BOUNCER CHANGENETWORK freenode nickname=prawn;port=6697
+// [s] BOUNCER CHANGENETWORK freenode
+func (bouncer *Bouncer) networksChange(listener *ircbnc.Listener, params []string) {
+	if len(params) < 2 {
+		sendBouncerFail(listener, "NEED_MORE_PARAMS", "CHANGENETWORK", "", "Missing network ID or attributes")
+		return
+	}
+
+	net := getNetworkByName(listener, params[0])
+	if net == nil {
+		sendBouncerFail(listener, "INVALID_NETID", "CHANGENETWORK", params[0], "Unknown network")
+		return
+	}
+
+	attrs, ok := parseNetworkAttrs(listener, "CHANGENETWORK", params[1])
+	if !ok {
+		return
+	}
+
+	// The network name is also its ID, which clients expect to stay the same
+	if name, renaming := attrs["name"]; renaming && name.Value != net.Name {
+		sendBouncerFail(listener, "READ_ONLY_ATTRIBUTE", "CHANGENETWORK", "name", "Networks cannot be renamed")
+		return
+	}
+
+	if !applyNetworkAttrs(listener, "CHANGENETWORK", net, attrs) {
+		return
+	}
+
+	saveErr := listener.Manager.Ds.SaveConnection(net)
+	if saveErr != nil {
+		sendBouncerFail(listener, "UNKNOWN_ERROR", "CHANGENETWORK", net.Name, "Error saving the network")
+		return
+	}
+
+	changed := make(map[string]string)
+	all := networkAttrValues(net)
+	for attr := range attrs {
+		changed[attr] = all[attr]
+	}
+	notifyNetwork(listener.Manager, net, changed)
+	listener.Send(nil, listener.Manager.Source, "BOUNCER", "CHANGENETWORK", net.Name)
+}
+
+// [c] BOUNCER DELNETWORK freenode
+// [s] BOUNCER DELNETWORK freenode
+func (bouncer *Bouncer) networksDel(listener *ircbnc.Listener, params []string) {
+	if len(params) < 1 {
+		sendBouncerFail(listener, "NEED_MORE_PARAMS", "DELNETWORK", "", "Missing network ID")
+		return
+	}
+
+	net := getNetworkByName(listener, params[0])
+	if net == nil {
+		sendBouncerFail(listener, "INVALID_NETID", "DELNETWORK", params[0], "Unknown network")
+		return
+	}
+
+	err := deleteNetwork(listener, net)
+	if err != nil {
+		sendBouncerFail(listener, "UNKNOWN_ERROR", "DELNETWORK", net.Name, "Error deleting the network")
+		return
+	}
+	listener.Send(nil, listener.Manager.Source, "BOUNCER", "DELNETWORK", net.Name)
+}
+
+// deleteNetwork disconnects and removes the network, letting clients know it's gone
+func deleteNetwork(listener *ircbnc.Listener, net *ircbnc.ServerConnection) error {
+	err := listener.User.DelNetwork(net)
+	if err != nil {
+		return err
+	}
+
+	notifyNetwork(listener.Manager, net, nil)
+	return nil
+}
+
+// onNetworkState lets bouncer-networks-notify clients know when a network connects or disconnects
+func (bouncer *Bouncer) onNetworkState(hook interface{}) {
+	event := hook.(*ircbnc.HookNetworkState)
+	notifyNetwork(bouncer.Manager, event.Server, map[string]string{
+		"state": event.State,
+		"error": event.Error,
+	})
+}
+
+// notifyNetwork sends the changed attributes of a network to every client of its user
+// that wants to know. A nil attrs means the network has been deleted.
+func notifyNetwork(manager *ircbnc.Manager, net *ircbnc.ServerConnection, attrs map[string]string) {
+	encoded := "*"
+	if attrs != nil {
+		encoded = encodeNetworkAttrs(attrs)
+	}
+
+	for _, listener := range manager.Clients() {
+		if listener.User != net.User || !listener.IsCapEnabled(CapBouncerNetworksNotify) {
+			continue
+		}
+		listener.Send(nil, manager.Source, "BOUNCER", "NETWORK", net.Name, encoded)
+	}
+}
+
+// networkAttrValues returns all of the attributes we report for a network
+func networkAttrValues(net *ircbnc.ServerConnection) map[string]string {
+	attrs := map[string]string{
+		"name":     net.Name,
+		"nickname": net.Nickname,
+		"username": net.Username,
+		"realname": net.Realname,
+		"state":    "disconnected",
+	}
+
+	if len(net.Addresses) > 0 {
+		attrs["host"] = net.Addresses[0].Host
+		attrs["port"] = strconv.Itoa(net.Addresses[0].Port)
+		attrs["tls"] = "0"
+		if net.Addresses[0].UseTLS {
+			attrs["tls"] = "1"
+		}
+		attrs["verify-tls"] = "0"
+		if net.Addresses[0].VerifyTLS {
+			attrs["verify-tls"] = "1"
+		}
+		if net.Addresses[0].Proxy != "" {
+			attrs["proxy"] = ircclient.RedactProxy(net.Addresses[0].Proxy)
+		}
+	}
+
+	if net.BindHost != "" {
+		attrs["bindhost"] = net.BindHost
+	}
+	if net.AddressFamily != "" {
+		attrs["address-family"] = net.AddressFamily
+	}
+
+	if net.SaslMechanism != "" {
+		attrs["sasl-mechanism"] = net.SaslMechanism
+		attrs["sasl-account"] = net.SaslAccount
+	}
+
+	if net.Foo.Connected {
+		attrs["state"] = "connected"
+		// lag is in milliseconds
+		if lag, known := net.Foo.Lag(); known {
+			attrs["lag"] = strconv.FormatInt(int64(lag/time.Millisecond), 10)
+		}
+	} else if net.Foo.Connecting {
+		attrs["state"] = "connecting"
+	}
+
+	return attrs
+}
+
+// parseNetworkAttrs parses a list of attributes, sending a FAIL if it isn't valid
+func parseNetworkAttrs(listener *ircbnc.Listener, subcommand string, attrString string) (map[string]ircmsg.TagValue, bool) {
+	attrs, err := ircmsg.ParseTags(attrString)
+	if err != nil {
+		sendBouncerFail(listener, "INVALID_ATTRIBUTE", subcommand, "", "Invalid attributes")
+		return nil, false
+	}
+
+	for attr := range attrs {
+		if readOnlyNetworkAttrs[attr] {
+			sendBouncerFail(listener, "READ_ONLY_ATTRIBUTE", subcommand, attr, "Attribute is read-only")
+			return nil, false
+		}
+		if !networkAttrs[attr] {
+			sendBouncerFail(listener, "UNKNOWN_ATTRIBUTE", subcommand, attr, "Unknown attribute")
+			return nil, false
+		}
+	}
+
+	return attrs, true
+}
+
+// checkNetworkAttr returns why the value of an attribute is invalid, or an empty string
+// if it's fine
+func checkNetworkAttr(attr string, value string) string {
+	switch attr {
+	case "host":
+		if value == "" {
+			return "Host cannot be empty"
+		}
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return "Invalid port"
+		}
+	case "tls", "verify-tls":
+		if value != "0" && value != "1" {
+			return attr + " must be 0 or 1"
+		}
+	case "proxy":
+		_, err := ircclient.ParseProxy(value)
+		if err != nil {
+			return err.Error()
+		}
+	}
+
+	return ""
+}
+
+// applyNetworkAttrs sets the given attributes on the network, sending a FAIL if one of
+// them is invalid. Everything is checked before anything is changed so that an invalid
+// attribute doesn't leave the network half updated.
+func applyNetworkAttrs(listener *ircbnc.Listener, subcommand string, net *ircbnc.ServerConnection, attrs map[string]ircmsg.TagValue) bool {
+	for attr, tag := range attrs {
+		problem := checkNetworkAttr(attr, tag.Value)
+		if problem != "" {
+			sendBouncerFail(listener, "INVALID_ATTRIBUTE", subcommand, attr, problem)
+			return false
+		}
+	}
+
+	// The bind host and address family are checked together, keeping whichever isn't given
+	_, bindHostGiven := attrs["bindhost"]
+	_, familyGiven := attrs["address-family"]
+	bindHost := tagValue(attrs, "bindhost", net.BindHost)
+	family := tagValue(attrs, "address-family", net.AddressFamily)
+	if bindHostGiven || familyGiven {
+		bindHostErr := net.CheckBindHost(bindHost, family)
+		if bindHostErr != nil {
+			sendBouncerFail(listener, "INVALID_ATTRIBUTE", subcommand, "bindhost", bindHostErr.Error())
+			return false
+		}
+	}
+
+	// Any SASL details not given are kept as they are
+	saslMechanism := tagValue(attrs, "sasl-mechanism", net.SaslMechanism)
+	saslAccount := tagValue(attrs, "sasl-account", net.SaslAccount)
+	saslPassword := tagValue(attrs, "sasl-password", net.SaslPassword)
+	saslErr := net.CheckSasl(saslMechanism, saslAccount, saslPassword)
+	if saslErr != nil {
+		sendBouncerFail(listener, "INVALID_ATTRIBUTE", subcommand, "sasl-mechanism", saslErr.Error())
+		return false
+	}
+
+	if len(net.Addresses) == 0 {
+		net.Addresses = append(net.Addresses, ircbnc.ServerConnectionAddress{})
+	}
+
+	for attr, tag := range attrs {
+		value := tag.Value
+		switch attr {
+		case "host":
+			net.Addresses[0].Host = value
+		case "port":
+			net.Addresses[0].Port, _ = strconv.Atoi(value)
+		case "tls":
+			net.Addresses[0].UseTLS = value == "1"
+		case "verify-tls":
+			net.Addresses[0].VerifyTLS = value == "1"
+		case "proxy":
+			net.Addresses[0].Proxy = value
+		case "nickname":
+			net.Nickname = value
+		case "username":
+			net.Username = value
+		case "realname":
+			net.Realname = value
+		case "pass":
+			net.Password = value
+		}
+	}
+
+	if bindHostGiven || familyGiven {
+		net.SetBindHost(bindHost, family)
+	}
+	net.SetSasl(saslMechanism, saslAccount, saslPassword)
+
+	return true
+}
+
+// encodeNetworkAttrs encodes attributes the same way as message tags
+func encodeNetworkAttrs(attrs map[string]string) string {
+	names := []string{}
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	escaper := strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+	encoded := []string{}
+	for _, name := range names {
+		if attrs[name] == "" {
+			encoded = append(encoded, name)
+		} else {
+			encoded = append(encoded, name+"="+escaper.Replace(attrs[name]))
+		}
+	}
+
+	return strings.Join(encoded, ";")
+}
+
+// [s] FAIL BOUNCER INVALID_NETID CHANGENETWORK freenode :Unknown network
+func sendBouncerFail(listener *ircbnc.Listener, code string, subcommand string, context string, description string) {
+	params := []string{"BOUNCER", code, subcommand}
+	if context != "" {
+		params = append(params, context)
+	}
+	params = append(params, description)
+	listener.Send(nil, listener.Manager.Source, "FAIL", params...)
+}
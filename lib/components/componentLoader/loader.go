@@ -6,11 +6,15 @@ import (
 	// Different parts of the project acting independantly
 	"github.com/goshuirc/bnc/lib/components/bouncer"
 	"github.com/goshuirc/bnc/lib/components/control"
+	"github.com/goshuirc/bnc/lib/components/httpApi"
 	"github.com/goshuirc/bnc/lib/components/messageLogger"
+	"github.com/goshuirc/bnc/lib/components/metrics"
 )
 
 func Run(manager *ircbnc.Manager) {
 	bncComponentControl.Run(manager)
 	bncComponentLogger.Run(manager)
 	bncComponentBouncer.Run(manager)
+	bncComponentHttpApi.Run(manager)
+	bncComponentMetrics.Run(manager)
 }
@@ -2,14 +2,17 @@ package bncComponentControl
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/goshuirc/bnc/lib"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+// searchResults is how many messages the search command shows
+const searchResults = 20
+
 // Nick of the controller
 var control_nick string
 var control_source string
@@ -49,14 +52,59 @@ func onMessage(hook interface{}) {
 		commandConnectNetwork(listener, params, msg)
 	case "disconnect":
 		commandDisconnectNetwork(listener, params, msg)
+	case "setsasl":
+		commandSetSasl(listener, params, msg)
+	case "setbindhost":
+		commandSetBindHost(listener, params, msg)
+	case "genclientcert":
+		commandGenClientCert(listener, params, msg)
+	case "delclientcert":
+		commandDelClientCert(listener, params, msg)
+	case "showcert":
+		commandShowCert(listener, params, msg)
+	case "acceptcert":
+		commandAcceptCert(listener, params, msg)
+	case "addcertfp":
+		commandAddCertFP(listener, params, msg)
+	case "delcertfp":
+		commandDelCertFP(listener, params, msg)
+	case "listcertfps":
+		commandListCertFPs(listener, params, msg)
+	case "search":
+		commandSearch(listener, params, msg)
+	case "multinetwork":
+		commandMultiNetwork(listener, params, msg)
+	case "setpassword":
+		commandSetPassword(listener, params, msg)
+	case "setdefaultnick":
+		commandSetDefaultNick(listener, params, msg)
+	case "setdefaultrealname":
+		commandSetDefaultRealname(listener, params, msg)
+	case "listpermissions":
+		commandListPermissions(listener, params, msg)
+	case "raw":
+		commandRaw(listener, params, msg)
 	}
 
 	// Admin commands
-	// TODO: The role apaprently isnt set or saved. do that.
-	if listener.User.Role == "Owner" {
+	if listener.User.HasPermission(ircbnc.PermUserAdmin) {
 		switch command {
 		case "adduser":
 			commandAddUser(listener, params, msg)
+		case "deluser":
+			commandDelUser(listener, params, msg)
+		case "listusers":
+			commandListUsers(listener, params, msg)
+		case "setrole":
+			commandSetRole(listener, params, msg)
+		case "enableuser":
+			commandEnableUser(listener, params, msg)
+		case "disableuser":
+			commandDisableUser(listener, params, msg)
+		case "addpermission":
+			commandAddPermission(listener, params, msg)
+		case "delpermission":
+			commandDelPermission(listener, params, msg)
 		}
 	}
 }
@@ -70,44 +118,225 @@ func commandAddUser(listener *ircbnc.Listener, params []string, message ircmsg.I
 	manager := listener.Manager
 	data := manager.Ds
 
-	newUsername := params[0]
+	newUsername, err := ircbnc.BncName(params[0])
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
 	newPassword := params[1]
-	_, exists := manager.Users[newUsername]
-	if exists {
+	if manager.User(newUsername) != nil {
 		listener.SendStatus("User " + newUsername + " already exists")
 		return
 	}
 
 	user := ircbnc.NewUser(listener.Manager)
 	user.Name = newUsername
-	user.Role = "User"
+	user.Role = ircbnc.RoleUser
 	user.DefaultNick = newUsername
 	user.DefaultFbNick = newUsername + "_"
 	user.DefaultUser = newUsername
 	user.DefaultReal = newUsername
-	user.Permissions = []string{"*"}
+	// New users get the permissions of their role
+	user.Permissions = []string{}
 	data.SetUserPassword(user, newPassword)
 
-	err := data.SaveUser(user)
+	err = manager.AddUser(user)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Could not create user info in database: %s", err.Error()))
+		listener.SendStatus("Could not save user " + newUsername + ": " + err.Error())
 		return
 	}
 
-	// TODO: This should really be done in DataStore.SaveUser
-	manager.Users[user.ID] = user
-
 	listener.SendStatus("User " + newUsername + " added")
 }
 
+func commandAddCertFP(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	// Default to the certificate this client is connected with
+	certfp := listener.CertFP
+	if len(params) >= 1 {
+		certfp = params[0]
+	}
+
+	if certfp == "" {
+		listener.SendStatus("Usage: addcertfp [fingerprint]")
+		listener.SendStatus("Without a fingerprint, the certificate you are currently connected with is added.")
+		return
+	}
+
+	err := listener.User.AddCertFP(certfp)
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+
+	err = listener.Manager.Ds.SaveUser(listener.User)
+	if err != nil {
+		listener.User.DelCertFP(certfp)
+		listener.SendStatus("Could not save the certificate fingerprint")
+		return
+	}
+
+	listener.SendStatus("Certificate fingerprint " + ircbnc.NormaliseCertFP(certfp) + " added")
+}
+
+func commandDelCertFP(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: delcertfp fingerprint")
+		return
+	}
+
+	certfp := params[0]
+	if !listener.User.DelCertFP(certfp) {
+		listener.SendStatus("Certificate fingerprint " + certfp + " not found")
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(listener.User)
+	if err != nil {
+		listener.SendStatus("Could not save the certificate fingerprints")
+		return
+	}
+
+	listener.SendStatus("Certificate fingerprint " + ircbnc.NormaliseCertFP(certfp) + " removed")
+}
+
+func commandListCertFPs(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(listener.User.CertFPs) == 0 {
+		listener.SendStatus("No certificate fingerprints have been added")
+		return
+	}
+
+	table := NewTable()
+	table.SetHeader([]string{"Fingerprint", "Current"})
+
+	for _, certfp := range listener.User.CertFPs {
+		current := ""
+		if certfp == listener.CertFP {
+			current = "Yes"
+		}
+		table.Append([]string{certfp, current})
+	}
+
+	table.RenderToListener(listener, control_source, "PRIVMSG")
+}
+
+func commandMultiNetwork(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		state := "off"
+		if listener.User.MultiNetwork {
+			state = "on"
+		}
+		listener.SendStatus("Multi-network mode is " + state)
+		listener.SendStatus("Usage: multinetwork [on|off]")
+		listener.SendStatus("When on, logging in without a network puts all of your networks on one connection")
+		return
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "on":
+		listener.User.MultiNetwork = true
+	case "off":
+		listener.User.MultiNetwork = false
+	default:
+		listener.SendStatus("Usage: multinetwork [on|off]")
+		return
+	}
+
+	err := listener.Manager.Ds.SaveUser(listener.User)
+	if err != nil {
+		listener.SendStatus("Could not save the multi-network setting")
+		return
+	}
+
+	listener.SendStatus("Multi-network mode is now " + strings.ToLower(params[0]) + ". Reconnect for it to take effect")
+}
+
+func commandRaw(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if !listener.User.HasPermission(ircbnc.PermRawSend) {
+		listener.SendStatus("You don't have permission to send raw lines")
+		return
+	}
+
+	if len(params) < 2 {
+		listener.SendStatus("Usage: raw network line")
+		return
+	}
+
+	net := listener.User.NetworkByName(params[0])
+	if net == nil {
+		listener.SendStatus("Network " + params[0] + " not found")
+		return
+	}
+
+	if !net.Foo.Connected {
+		listener.SendStatus("Not connected to " + net.Name)
+		return
+	}
+
+	net.Foo.WriteLine("%s", strings.Join(params[1:], " "))
+}
+
+func commandSearch(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if !listener.User.HasPermission(ircbnc.PermLogSearch) {
+		listener.SendStatus("You don't have permission to search messages")
+		return
+	}
+
+	if len(params) < 2 {
+		listener.SendStatus("Usage: search buffer words")
+		listener.SendStatus("Use * as the buffer to search every buffer on this network")
+		return
+	}
+
+	if listener.ServerConnection == nil {
+		listener.SendStatus("You are not connected to a network")
+		return
+	}
+
+	store := listener.Manager.Messages
+	if store == nil || !store.SupportsSearch() {
+		listener.SendStatus("Searching messages is not available")
+		return
+	}
+
+	buffer := params[0]
+	if buffer == "*" {
+		buffer = ""
+	}
+	query := strings.Join(params[1:], " ")
+
+	msgs := store.Search(listener.User.ID, listener.ServerConnection.Name, buffer, query, time.Time{}, time.Time{}, searchResults)
+	if len(msgs) == 0 {
+		listener.SendStatus("No messages found")
+		return
+	}
+
+	results := []*ircmsg.IrcMessage{}
+	for _, msg := range msgs {
+		nick, _, _ := ircbnc.SplitMask(msg.Prefix)
+		text := msg.Params[1]
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			text = "* " + nick + strings.TrimPrefix(text, "\x01ACTION")
+		} else {
+			text = "<" + nick + "> " + text
+		}
+
+		line := fmt.Sprintf("[%s] %s %s", msg.Tags["time"].Value, msg.Params[0], text)
+		result := ircmsg.MakeMessage(nil, control_source, "PRIVMSG", listener.ClientNick, line)
+		results = append(results, &result)
+	}
+
+	listener.SendStatus(fmt.Sprintf("Found %d messages", len(msgs)))
+	listener.SendBatch(ircbnc.BatchTypeSearch, []string{listener.ServerConnection.Name}, results)
+}
+
 func commandConnectNetwork(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
 	netName := listener.ServerConnection.Name
 	if len(params) >= 1 {
 		netName = params[0]
 	}
 
-	net, exists := listener.User.Networks[netName]
-	if !exists {
+	net := listener.User.Network(netName)
+	if net == nil {
 		listener.SendStatus("Network " + netName + " not found")
 		return
 	}
@@ -126,8 +355,8 @@ func commandDisconnectNetwork(listener *ircbnc.Listener, params []string, messag
 		netName = params[0]
 	}
 
-	net, exists := listener.User.Networks[netName]
-	if !exists {
+	net := listener.User.Network(netName)
+	if net == nil {
 		listener.SendStatus("Network " + netName + " not found")
 		return
 	}
@@ -135,11 +364,239 @@ func commandDisconnectNetwork(listener *ircbnc.Listener, params []string, messag
 	net.Disconnect()
 }
 
+func commandSetSasl(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 2 {
+		listener.SendStatus("Usage: setsasl network PLAIN account password")
+		listener.SendStatus("       setsasl network EXTERNAL")
+		listener.SendStatus("       setsasl network off")
+		return
+	}
+
+	netName := params[0]
+	net := listener.User.Network(netName)
+	if net == nil {
+		listener.SendStatus("Network " + netName + " not found")
+		return
+	}
+
+	mechanism := params[1]
+	if strings.ToLower(mechanism) == "off" {
+		mechanism = ""
+	}
+
+	var account, password string
+	if len(params) >= 3 {
+		account = params[2]
+	}
+	if len(params) >= 4 {
+		password = params[3]
+	}
+
+	err := net.SetSasl(mechanism, account, password)
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+
+	err = listener.Manager.Ds.SaveConnection(net)
+	if err != nil {
+		listener.SendStatus("Could not save the network")
+		return
+	}
+
+	if net.SaslMechanism == "" {
+		listener.SendStatus("SASL disabled for " + netName)
+	} else {
+		listener.SendStatus("SASL " + net.SaslMechanism + " set for " + netName + ", it will be used the next time you connect")
+	}
+}
+
+func commandSetBindHost(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 2 {
+		listener.SendStatus("Usage: setbindhost network address [ipv4|ipv6|prefer-ipv4|prefer-ipv6]")
+		listener.SendStatus("       setbindhost network off [ipv4|ipv6|prefer-ipv4|prefer-ipv6]")
+		return
+	}
+
+	netName := params[0]
+	net := listener.User.Network(netName)
+	if net == nil {
+		listener.SendStatus("Network " + netName + " not found")
+		return
+	}
+
+	bindHost := params[1]
+	if strings.ToLower(bindHost) == "off" {
+		bindHost = ""
+	}
+
+	var family string
+	if len(params) >= 3 && strings.ToLower(params[2]) != "any" {
+		family = params[2]
+	}
+
+	err := net.SetBindHost(bindHost, family)
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+
+	err = listener.Manager.Ds.SaveConnection(net)
+	if err != nil {
+		listener.SendStatus("Could not save the network")
+		return
+	}
+
+	if net.BindHost == "" {
+		listener.SendStatus(netName + " will connect from the default address the next time you connect")
+	} else {
+		listener.SendStatus(netName + " will connect from " + net.BindHost + " the next time you connect")
+	}
+}
+
+func commandGenClientCert(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: genclientcert network")
+		listener.SendStatus("Makes a certificate to connect to the network with, eg. for NickServ CertFP or SASL EXTERNAL")
+		return
+	}
+
+	netName := params[0]
+	net := listener.User.Network(netName)
+	if net == nil {
+		listener.SendStatus("Network " + netName + " not found")
+		return
+	}
+
+	cert, err := ircbnc.GenerateClientCert(listener.User.Name)
+	if err != nil {
+		listener.SendStatus("Could not generate a certificate: " + err.Error())
+		return
+	}
+
+	oldCert := net.ClientCert
+	net.SetClientCert(cert)
+	err = listener.Manager.Ds.SaveConnection(net)
+	if err != nil {
+		net.ClientCert = oldCert
+		listener.SendStatus("Could not save the network")
+		return
+	}
+
+	listener.SendStatus("Generated a certificate for " + netName + " with the fingerprint " + net.ClientCertFingerprint())
+	listener.SendStatus("It will be used the next time you connect. To log in with it, add the fingerprint to your account, eg. /msg NickServ CERT ADD " + net.ClientCertFingerprint())
+	listener.SendStatus("and then: /msg *status setsasl " + netName + " EXTERNAL")
+}
+
+func commandDelClientCert(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: delclientcert network")
+		return
+	}
+
+	netName := params[0]
+	net := listener.User.Network(netName)
+	if net == nil {
+		listener.SendStatus("Network " + netName + " not found")
+		return
+	}
+
+	if net.ClientCert == "" {
+		listener.SendStatus(netName + " doesn't have a client certificate")
+		return
+	}
+
+	oldCert := net.ClientCert
+	err := net.SetClientCert("")
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+	err = listener.Manager.Ds.SaveConnection(net)
+	if err != nil {
+		net.ClientCert = oldCert
+		listener.SendStatus("Could not save the network")
+		return
+	}
+
+	listener.SendStatus("Client certificate removed from " + netName)
+}
+
+func commandShowCert(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: showcert network")
+		return
+	}
+
+	netName := params[0]
+	net := listener.User.Network(netName)
+	if net == nil {
+		listener.SendStatus("Network " + netName + " not found")
+		return
+	}
+
+	table := NewTable()
+	table.SetHeader([]string{"Address", "Verify", "Pinned fingerprint"})
+	for _, address := range net.Addresses {
+		verify := "No"
+		if address.VerifyTLS {
+			verify = "Yes"
+		}
+		fingerprint := address.Fingerprint
+		if fingerprint == "" {
+			fingerprint = "-"
+		}
+		table.Append([]string{address.Host + ":" + strconv.Itoa(address.Port), verify, fingerprint})
+	}
+	table.RenderToListener(listener, control_source, "PRIVMSG")
+
+	if clientCert := net.ClientCertFingerprint(); clientCert != "" {
+		listener.SendStatus("Client certificate: " + clientCert)
+	}
+	if fingerprint, host, untrusted := net.UntrustedServerCert(); untrusted {
+		listener.SendStatus("Refused certificate from " + host + ": " + fingerprint + ". To trust it, use: acceptcert " + netName)
+	}
+}
+
+func commandAcceptCert(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: acceptcert network [fingerprint]")
+		listener.SendStatus("Without a fingerprint, the last certificate the network was refused for is trusted.")
+		return
+	}
+
+	netName := params[0]
+	net := listener.User.Network(netName)
+	if net == nil {
+		listener.SendStatus("Network " + netName + " not found")
+		return
+	}
+
+	var fingerprint string
+	if len(params) >= 2 {
+		fingerprint = params[1]
+	}
+
+	fingerprint, err := net.AcceptServerCert(fingerprint)
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+
+	err = listener.Manager.Ds.SaveConnection(net)
+	if err != nil {
+		listener.SendStatus("Could not save the network")
+		return
+	}
+
+	listener.SendStatus("Certificate " + fingerprint + " is now trusted for " + netName + ", it will be used the next time you connect")
+}
+
 func commandListNetworks(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
 	table := NewTable()
-	table.SetHeader([]string{"Name", "Nick", "Connected", "Address"})
+	table.SetHeader([]string{"Name", "Nick", "Connected", "Lag", "Address"})
 
-	for _, network := range listener.User.Networks {
+	for _, network := range listener.User.NetworkList() {
 		connected := "No"
 		network.Foo.RLock()
 		if network.Foo.HasRegistered {
@@ -147,6 +604,11 @@ func commandListNetworks(listener *ircbnc.Listener, params []string, message irc
 		}
 		network.Foo.RUnlock()
 
+		lag := "-"
+		if duration, known := network.Foo.Lag(); known && network.Foo.Connected {
+			lag = duration.Round(time.Millisecond).String()
+		}
+
 		address := network.Addresses[0].Host + ":"
 		if network.Addresses[0].UseTLS {
 			address += "+"
@@ -158,7 +620,7 @@ func commandListNetworks(listener *ircbnc.Listener, params []string, message irc
 			name = "*" + name
 		}
 
-		table.Append([]string{name, network.Nickname, connected, address})
+		table.Append([]string{name, network.Nickname, connected, lag, address})
 	}
 
 	table.RenderToListener(listener, control_source, "PRIVMSG")
@@ -168,6 +630,7 @@ func commandAddNetwork(listener *ircbnc.Listener, params []string, message ircms
 	sendUsage := func() {
 		listener.SendStatus("Usage: addnetwork name address [port] [password]")
 		listener.SendStatus("To use SSL/TLS, add + infront of the port number.")
+		listener.SendStatus("Certificates are verified, use acceptcert to trust a self-signed one.")
 	}
 
 	if len(params) < 2 {
@@ -199,6 +662,11 @@ func commandAddNetwork(listener *ircbnc.Listener, params []string, message ircms
 		return
 	}
 
+	if !listener.User.CanAddNetwork() {
+		listener.SendStatus("You don't have permission to add another network")
+		return
+	}
+
 	connection := ircbnc.NewServerConnection()
 	connection.User = listener.User
 	connection.Name = netName
@@ -208,12 +676,10 @@ func commandAddNetwork(listener *ircbnc.Listener, params []string, message ircms
 		Host:      netAddress,
 		Port:      netPort,
 		UseTLS:    netTls,
-		VerifyTLS: false,
+		VerifyTLS: true,
 	}
 	connection.Addresses = append(connection.Addresses, newAddress)
-	listener.User.Networks[connection.Name] = connection
-
-	err := listener.Manager.Ds.SaveConnection(connection)
+	err := listener.User.AddNetwork(connection)
 	if err != nil {
 		listener.SendStatus("Could not save the new network")
 	} else {
@@ -0,0 +1,344 @@
+package bncComponentControl
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// findUser returns the user with the given username, telling the listener if there isn't one
+func findUser(listener *ircbnc.Listener, username string) *ircbnc.User {
+	userId, err := ircbnc.BncName(username)
+	if err == nil {
+		user := listener.Manager.User(userId)
+		if user != nil {
+			return user
+		}
+	}
+
+	listener.SendStatus("User " + username + " does not exist")
+	return nil
+}
+
+func commandDelUser(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: deluser [username]")
+		return
+	}
+
+	user := findUser(listener, params[0])
+	if user == nil {
+		return
+	}
+
+	if user == listener.User {
+		listener.SendStatus("You can't delete yourself")
+		return
+	}
+
+	err := listener.Manager.DeleteUser(user, "Your account has been deleted")
+	if err != nil {
+		listener.SendStatus("Could not delete user " + user.Name + ": " + err.Error())
+		return
+	}
+
+	listener.SendStatus("User " + user.Name + " deleted")
+}
+
+func commandListUsers(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	table := NewTable()
+	table.SetHeader([]string{"Username", "Role", "Networks", "Clients", "Status"})
+
+	for _, user := range listener.Manager.UserList() {
+		status := "Enabled"
+		if user.Disabled {
+			status = "Disabled"
+		}
+
+		table.Append([]string{
+			user.Name,
+			user.Role,
+			strconv.Itoa(len(user.NetworkList())),
+			strconv.Itoa(len(user.Listeners())),
+			status,
+		})
+	}
+
+	table.RenderToListener(listener, control_source, "PRIVMSG")
+}
+
+func commandSetPassword(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	// Admins can set anyone's password, everyone else only their own
+	user := listener.User
+	var password string
+	if len(params) == 1 {
+		password = params[0]
+	} else if len(params) == 2 && listener.User.HasPermission(ircbnc.PermUserAdmin) {
+		user = findUser(listener, params[0])
+		if user == nil {
+			return
+		}
+		password = params[1]
+	} else {
+		listener.SendStatus("Usage: setpassword [password]")
+		if listener.User.HasPermission(ircbnc.PermUserAdmin) {
+			listener.SendStatus("Usage: setpassword [username] [password]")
+		}
+		return
+	}
+
+	salt, hash := user.Salt, user.HashedPassword
+	listener.Manager.Ds.SetUserPassword(user, password)
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.Salt, user.HashedPassword = salt, hash
+		listener.SendStatus("Could not save the new password")
+		return
+	}
+
+	listener.SendStatus("Password for " + user.Name + " changed")
+}
+
+func commandSetRole(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 2 {
+		listener.SendStatus("Usage: setrole [username] [" + ircbnc.RoleOwner + "|" + ircbnc.RoleUser + "]")
+		return
+	}
+
+	var role string
+	switch strings.ToLower(params[1]) {
+	case strings.ToLower(ircbnc.RoleOwner):
+		role = ircbnc.RoleOwner
+	case strings.ToLower(ircbnc.RoleUser):
+		role = ircbnc.RoleUser
+	default:
+		listener.SendStatus("The role must be " + ircbnc.RoleOwner + " or " + ircbnc.RoleUser)
+		return
+	}
+
+	user := findUser(listener, params[0])
+	if user == nil {
+		return
+	}
+
+	// Stop the bouncer being left without anyone to manage it
+	if user == listener.User && role != ircbnc.RoleOwner {
+		listener.SendStatus("You can't remove your own " + ircbnc.RoleOwner + " role")
+		return
+	}
+
+	oldRole := user.Role
+	user.Role = role
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.Role = oldRole
+		listener.SendStatus("Could not save the role of " + user.Name)
+		return
+	}
+
+	listener.SendStatus(user.Name + " is now a " + role)
+}
+
+func commandSetDefaultNick(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: setdefaultnick [nick] [fallback nick]")
+		listener.SendStatus("Networks without their own nick use these")
+		return
+	}
+
+	nick, err := ircbnc.IrcName(params[0], false)
+	if err != nil {
+		listener.SendStatus(err.Error())
+		return
+	}
+
+	fbNick := nick + "_"
+	if len(params) > 1 {
+		fbNick, err = ircbnc.IrcName(params[1], false)
+		if err != nil {
+			listener.SendStatus(err.Error())
+			return
+		}
+	}
+
+	user := listener.User
+	oldNick, oldFbNick := user.DefaultNick, user.DefaultFbNick
+	user.DefaultNick, user.DefaultFbNick = nick, fbNick
+	err = listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.DefaultNick, user.DefaultFbNick = oldNick, oldFbNick
+		listener.SendStatus("Could not save your default nick")
+		return
+	}
+
+	listener.SendStatus("Your default nick is now " + nick + ", falling back to " + fbNick)
+}
+
+func commandSetDefaultRealname(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	realname := strings.TrimSpace(strings.Join(params, " "))
+	if realname == "" {
+		listener.SendStatus("Usage: setdefaultrealname [realname]")
+		listener.SendStatus("Networks without their own realname use this")
+		return
+	}
+
+	user := listener.User
+	oldRealname := user.DefaultReal
+	user.DefaultReal = realname
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.DefaultReal = oldRealname
+		listener.SendStatus("Could not save your default realname")
+		return
+	}
+
+	listener.SendStatus("Your default realname is now " + realname)
+}
+
+func commandEnableUser(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: enableuser [username]")
+		return
+	}
+
+	user := findUser(listener, params[0])
+	if user == nil {
+		return
+	}
+
+	if !user.Disabled {
+		listener.SendStatus("User " + user.Name + " is already enabled")
+		return
+	}
+
+	err := user.Enable()
+	if err != nil {
+		listener.SendStatus("Could not enable user " + user.Name + ": " + err.Error())
+		return
+	}
+
+	listener.SendStatus("User " + user.Name + " enabled")
+}
+
+func commandDisableUser(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 1 {
+		listener.SendStatus("Usage: disableuser [username]")
+		return
+	}
+
+	user := findUser(listener, params[0])
+	if user == nil {
+		return
+	}
+
+	if user == listener.User {
+		listener.SendStatus("You can't disable yourself")
+		return
+	}
+
+	if user.Disabled {
+		listener.SendStatus("User " + user.Name + " is already disabled")
+		return
+	}
+
+	err := user.Disable("Your account has been disabled")
+	if err != nil {
+		listener.SendStatus("Could not disable user " + user.Name + ": " + err.Error())
+		return
+	}
+
+	listener.SendStatus("User " + user.Name + " disabled")
+}
+
+func commandListPermissions(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	// Admins can see anyone's permissions, everyone else only their own
+	user := listener.User
+	if len(params) >= 1 && listener.User.HasPermission(ircbnc.PermUserAdmin) {
+		user = findUser(listener, params[0])
+		if user == nil {
+			return
+		}
+	}
+
+	table := NewTable()
+	table.SetHeader([]string{"Permission", "From"})
+	for _, permission := range user.Permissions {
+		table.Append([]string{permission, user.Name})
+	}
+	for _, permission := range ircbnc.RolePermissions[user.Role] {
+		table.Append([]string{permission, "Role " + user.Role})
+	}
+
+	table.RenderToListener(listener, control_source, "PRIVMSG")
+}
+
+func commandAddPermission(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 2 {
+		listener.SendStatus("Usage: addpermission [username] [permission]")
+		listener.SendStatus("eg. network.add, network.max=5, user.admin, log.search, raw.send or network.*")
+		listener.SendStatus("Bind hosts can be limited to addresses or ranges, eg. network.bindhost=2001:db8::/64")
+		listener.SendStatus("Start a permission with - to take it away from the user's role, eg. -log.search")
+		return
+	}
+
+	user := findUser(listener, params[0])
+	if user == nil {
+		return
+	}
+
+	permission := strings.ToLower(params[1])
+	for _, existing := range user.Permissions {
+		if existing == permission {
+			listener.SendStatus(user.Name + " already has " + permission)
+			return
+		}
+	}
+
+	user.Permissions = append(user.Permissions, permission)
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.Permissions = user.Permissions[:len(user.Permissions)-1]
+		listener.SendStatus("Could not save the permissions of " + user.Name)
+		return
+	}
+
+	listener.SendStatus(user.Name + " now has " + permission)
+}
+
+func commandDelPermission(listener *ircbnc.Listener, params []string, message ircmsg.IrcMessage) {
+	if len(params) < 2 {
+		listener.SendStatus("Usage: delpermission [username] [permission]")
+		return
+	}
+
+	user := findUser(listener, params[0])
+	if user == nil {
+		return
+	}
+
+	permission := strings.ToLower(params[1])
+	permissions := []string{}
+	for _, existing := range user.Permissions {
+		if existing != permission {
+			permissions = append(permissions, existing)
+		}
+	}
+
+	if len(permissions) == len(user.Permissions) {
+		listener.SendStatus(user.Name + " hasn't been given " + permission)
+		return
+	}
+
+	oldPermissions := user.Permissions
+	user.Permissions = permissions
+	err := listener.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.Permissions = oldPermissions
+		listener.SendStatus("Could not save the permissions of " + user.Name)
+		return
+	}
+
+	listener.SendStatus(user.Name + " no longer has " + permission)
+}
@@ -0,0 +1,281 @@
+package bncComponentHttpApi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/logger"
+)
+
+var apiLog = bncLog.New("components.http")
+
+// apiPrefix is where every API endpoint lives
+const apiPrefix = "/api/v1/"
+
+// maxBodySize is the largest request body we'll read
+const maxBodySize = 64 * 1024
+
+func Run(manager *ircbnc.Manager) {
+	api := &HttpApi{
+		Manager: manager,
+	}
+	api.RegisterHooks()
+
+	err := api.start(manager.Config.Bouncer.HTTP)
+	if err != nil {
+		apiLog.Error("Could not start the HTTP API", "error", err)
+	}
+}
+
+// HttpApi serves a JSON API for managing users and their networks over HTTP.
+type HttpApi struct {
+	Manager *ircbnc.Manager
+
+	serverLock sync.Mutex
+	server     *http.Server
+}
+
+func (api *HttpApi) RegisterHooks() {
+	api.Manager.Bus.Register(ircbnc.HookRehashName, api.onRehash)
+}
+
+// Restart the API if its config has changed
+func (api *HttpApi) onRehash(hook interface{}) {
+	event := hook.(*ircbnc.HookRehash)
+	if reflect.DeepEqual(event.OldConfig.Bouncer.HTTP, event.NewConfig.Bouncer.HTTP) {
+		return
+	}
+
+	api.stop()
+	err := api.start(event.NewConfig.Bouncer.HTTP)
+	if err != nil {
+		apiLog.Error("Could not start the HTTP API", "error", err)
+	}
+}
+
+// start listens for API requests, if the API has been configured
+func (api *HttpApi) start(config ircbnc.HTTPConfig) error {
+	server, err := ircbnc.ListenHTTP("HTTP API", config, api)
+	if err != nil {
+		return err
+	}
+
+	api.serverLock.Lock()
+	api.server = server
+	api.serverLock.Unlock()
+	return nil
+}
+
+func (api *HttpApi) stop() {
+	api.serverLock.Lock()
+	defer api.serverLock.Unlock()
+
+	if api.server != nil {
+		api.server.Close()
+		api.server = nil
+	}
+}
+
+// ServeHTTP authenticates the request and routes it to the right endpoint
+func (api *HttpApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		sendError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	authedUser := api.authenticate(r)
+	if authedUser == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="GoshuBNC"`)
+		sendError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	req := &apiRequest{
+		w:    w,
+		r:    r,
+		api:  api,
+		user: authedUser,
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "me":
+		req.handleUser(authedUser)
+	case parts[0] == "users":
+		api.routeUsers(req, parts[1:])
+	default:
+		sendError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// routeUsers handles everything under /users/
+func (api *HttpApi) routeUsers(req *apiRequest, parts []string) {
+	if len(parts) == 0 || parts[0] == "" {
+		req.handleUsers()
+		return
+	}
+
+	user := req.targetUser(parts[0])
+	if user == nil {
+		return
+	}
+
+	if len(parts) == 1 {
+		req.handleUser(user)
+		return
+	}
+
+	switch parts[1] {
+	case "tokens":
+		if len(parts) == 2 {
+			req.handleTokens(user)
+		} else if len(parts) == 3 {
+			req.handleToken(user, parts[2])
+		} else {
+			sendError(req.w, http.StatusNotFound, "Not found")
+		}
+
+	case "networks":
+		if len(parts) == 2 {
+			req.handleNetworks(user)
+			return
+		}
+
+		net := networkByName(user, parts[2])
+		if net == nil {
+			sendError(req.w, http.StatusNotFound, "Network not found")
+			return
+		}
+
+		if len(parts) == 3 {
+			req.handleNetwork(user, net)
+			return
+		}
+
+		switch parts[3] {
+		case "connect":
+			req.handleConnect(net)
+		case "disconnect":
+			req.handleDisconnect(net)
+		case "buffers":
+			req.handleBuffers(net)
+		case "search":
+			req.handleSearch(user, net)
+		default:
+			sendError(req.w, http.StatusNotFound, "Not found")
+		}
+
+	default:
+		sendError(req.w, http.StatusNotFound, "Not found")
+	}
+}
+
+// authenticate returns the user logging in with either their password or an API token
+func (api *HttpApi) authenticate(r *http.Request) *ircbnc.User {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		for _, user := range api.Manager.UserList() {
+			if !user.Disabled && user.HasAPIToken(token) {
+				return user
+			}
+		}
+		api.Manager.Bus.Dispatch(ircbnc.HookAuthFailedName, &ircbnc.HookAuthFailed{
+			Method: "HTTP",
+		})
+		return nil
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+
+	authedUserId, authSuccess := api.Manager.Ds.AuthUser(username, password)
+	if !authSuccess {
+		api.Manager.Bus.Dispatch(ircbnc.HookAuthFailedName, &ircbnc.HookAuthFailed{
+			Method: "HTTP",
+		})
+		return nil
+	}
+
+	return api.Manager.User(authedUserId)
+}
+
+// apiRequest is a request from an authenticated user
+type apiRequest struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	api  *HttpApi
+	user *ircbnc.User
+}
+
+// isAdmin returns true if the user making the request can manage other users
+func (req *apiRequest) isAdmin() bool {
+	return req.user.HasPermission(ircbnc.PermUserAdmin)
+}
+
+// targetUser returns the user being managed. Users can manage themselves and admins
+// can manage anyone.
+func (req *apiRequest) targetUser(username string) *ircbnc.User {
+	userId, err := ircbnc.BncName(username)
+	if err != nil {
+		sendError(req.w, http.StatusNotFound, "User not found")
+		return nil
+	}
+
+	if userId != req.user.ID && !req.isAdmin() {
+		sendError(req.w, http.StatusForbidden, "You don't have permission to manage other users")
+		return nil
+	}
+
+	user := req.api.Manager.User(userId)
+	if user == nil {
+		sendError(req.w, http.StatusNotFound, "User not found")
+		return nil
+	}
+
+	return user
+}
+
+// allowMethods returns true if the request uses one of the methods, otherwise
+// responding with an error
+func (req *apiRequest) allowMethods(methods ...string) bool {
+	for _, method := range methods {
+		if req.r.Method == method {
+			return true
+		}
+	}
+
+	req.w.Header().Set("Allow", strings.Join(methods, ", "))
+	sendError(req.w, http.StatusMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+// readJSON decodes the request body, responding with an error if it's invalid
+func (req *apiRequest) readJSON(v interface{}) bool {
+	err := json.NewDecoder(req.r.Body).Decode(v)
+	if err != nil {
+		sendError(req.w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func sendJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func sendError(w http.ResponseWriter, status int, message string) {
+	sendJSON(w, status, map[string]string{"error": message})
+}
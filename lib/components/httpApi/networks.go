@@ -0,0 +1,543 @@
+package bncComponentHttpApi
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/ircclient"
+)
+
+// searchLimit is the most messages a search returns
+const searchLimit = 500
+
+// addressJSON is a server address. Proxy passwords are hidden when addresses are listed,
+// and VerifyTLS is on unless it's turned off, which pins the first certificate we see.
+type addressJSON struct {
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	TLS         bool   `json:"tls"`
+	VerifyTLS   *bool  `json:"verify_tls"`
+	Proxy       string `json:"proxy,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type networkJSON struct {
+	Name             string        `json:"name"`
+	Enabled          bool          `json:"enabled"`
+	State            string        `json:"state"`
+	Nickname         string        `json:"nickname"`
+	NicknameFallback string        `json:"nickname_fallback"`
+	Username         string        `json:"username"`
+	Realname         string        `json:"realname"`
+	CurrentNick      string        `json:"current_nick,omitempty"`
+	SaslMechanism    string        `json:"sasl_mechanism,omitempty"`
+	SaslAccount      string        `json:"sasl_account,omitempty"`
+	BindHost         string        `json:"bind_host,omitempty"`
+	AddressFamily    string        `json:"address_family,omitempty"`
+	ClientCertFP     string        `json:"client_cert_fingerprint,omitempty"`
+	Addresses        []addressJSON `json:"addresses"`
+	Clients          int           `json:"clients"`
+}
+
+func networkToJSON(net *ircbnc.ServerConnection) networkJSON {
+	netJSON := networkJSON{
+		Name:             net.Name,
+		Enabled:          net.Enabled,
+		State:            "disconnected",
+		Nickname:         net.Nickname,
+		NicknameFallback: net.FbNickname,
+		Username:         net.Username,
+		Realname:         net.Realname,
+		SaslMechanism:    net.SaslMechanism,
+		SaslAccount:      net.SaslAccount,
+		BindHost:         net.BindHost,
+		AddressFamily:    net.AddressFamily,
+		ClientCertFP:     net.ClientCertFingerprint(),
+		Addresses:        []addressJSON{},
+	}
+
+	for _, address := range net.Addresses {
+		verifyTLS := address.VerifyTLS
+		netJSON.Addresses = append(netJSON.Addresses, addressJSON{
+			Host:        address.Host,
+			Port:        address.Port,
+			TLS:         address.UseTLS,
+			VerifyTLS:   &verifyTLS,
+			Proxy:       ircclient.RedactProxy(address.Proxy),
+			Fingerprint: address.Fingerprint,
+		})
+	}
+
+	if net.Foo.Connected {
+		netJSON.State = "connected"
+		netJSON.CurrentNick = net.Foo.Nick
+	} else if net.Foo.Connecting {
+		netJSON.State = "connecting"
+	}
+
+	net.ListenersLock.Lock()
+	netJSON.Clients = len(net.Listeners)
+	net.ListenersLock.Unlock()
+
+	return netJSON
+}
+
+// networkChanges are the fields that can be set on a network. Missing fields are left alone.
+// ClientCert is a PEM encoded certificate and key, or "generate" to have one made.
+type networkChanges struct {
+	Name             string         `json:"name"`
+	Enabled          *bool          `json:"enabled"`
+	Password         *string        `json:"password"`
+	Nickname         *string        `json:"nickname"`
+	NicknameFallback *string        `json:"nickname_fallback"`
+	Username         *string        `json:"username"`
+	Realname         *string        `json:"realname"`
+	SaslMechanism    *string        `json:"sasl_mechanism"`
+	SaslAccount      string         `json:"sasl_account"`
+	SaslPassword     string         `json:"sasl_password"`
+	BindHost         *string        `json:"bind_host"`
+	AddressFamily    *string        `json:"address_family"`
+	ClientCert       *string        `json:"client_cert"`
+	Addresses        *[]addressJSON `json:"addresses"`
+}
+
+// apply sets the changes on the network, returning an error message if they aren't valid
+func (changes *networkChanges) apply(net *ircbnc.ServerConnection) string {
+	var err error
+	if changes.Nickname != nil {
+		net.Nickname, err = ircbnc.IrcName(*changes.Nickname, false)
+		if err != nil {
+			return err.Error()
+		}
+	}
+	if changes.NicknameFallback != nil {
+		net.FbNickname, err = ircbnc.IrcName(*changes.NicknameFallback, false)
+		if err != nil {
+			return err.Error()
+		}
+	}
+	if changes.Username != nil {
+		net.Username = *changes.Username
+	}
+	if changes.Realname != nil {
+		net.Realname = *changes.Realname
+	}
+	if changes.Password != nil {
+		net.Password = *changes.Password
+	}
+	if changes.Enabled != nil {
+		net.Enabled = *changes.Enabled
+	}
+
+	if changes.Addresses != nil {
+		if len(*changes.Addresses) == 0 {
+			return "Networks need at least one address"
+		}
+
+		addresses := []ircbnc.ServerConnectionAddress{}
+		for _, address := range *changes.Addresses {
+			if address.Host == "" || address.Port < 1 || address.Port > 65535 {
+				return "Addresses need a host and a port between 1 and 65535"
+			}
+			_, err = ircclient.ParseProxy(address.Proxy)
+			if err != nil {
+				return err.Error()
+			}
+			fingerprint := ircbnc.NormaliseCertFP(address.Fingerprint)
+			if fingerprint != "" && len(fingerprint) != 64 {
+				return "Fingerprints must be a SHA-256 hash (64 hex characters)"
+			}
+			addresses = append(addresses, ircbnc.ServerConnectionAddress{
+				Host:        address.Host,
+				Port:        address.Port,
+				UseTLS:      address.TLS,
+				VerifyTLS:   address.VerifyTLS == nil || *address.VerifyTLS,
+				Proxy:       address.Proxy,
+				Fingerprint: fingerprint,
+			})
+		}
+		net.Addresses = addresses
+	}
+
+	// SASL EXTERNAL needs a client certificate, so a new one has to be set before SASL
+	// and one being removed can only go after it
+	removingCert := changes.ClientCert != nil && *changes.ClientCert == ""
+	if !removingCert {
+		errMessage := changes.applyClientCert(net)
+		if errMessage != "" {
+			return errMessage
+		}
+	}
+	errMessage := changes.applySasl(net)
+	if errMessage != "" {
+		return errMessage
+	}
+	if removingCert {
+		errMessage = changes.applyClientCert(net)
+		if errMessage != "" {
+			return errMessage
+		}
+	}
+
+	if changes.BindHost != nil || changes.AddressFamily != nil {
+		bindHost, family := net.BindHost, net.AddressFamily
+		if changes.BindHost != nil {
+			bindHost = *changes.BindHost
+		}
+		if changes.AddressFamily != nil {
+			family = *changes.AddressFamily
+		}
+		err = net.SetBindHost(bindHost, family)
+		if err != nil {
+			return err.Error()
+		}
+	}
+
+	return ""
+}
+
+// applyClientCert sets the network's client certificate, generating one if asked to
+func (changes *networkChanges) applyClientCert(net *ircbnc.ServerConnection) string {
+	if changes.ClientCert == nil {
+		return ""
+	}
+
+	var err error
+	clientCert := *changes.ClientCert
+	if clientCert == "generate" {
+		clientCert, err = ircbnc.GenerateClientCert(net.User.Name)
+		if err != nil {
+			return "Could not generate a client certificate"
+		}
+	}
+	err = net.SetClientCert(clientCert)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// applySasl sets the SASL details of the network
+func (changes *networkChanges) applySasl(net *ircbnc.ServerConnection) string {
+	if changes.SaslMechanism == nil {
+		return ""
+	}
+
+	mechanism := *changes.SaslMechanism
+	if strings.ToLower(mechanism) == "off" {
+		mechanism = ""
+	}
+	err := net.SetSasl(mechanism, changes.SaslAccount, changes.SaslPassword)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// networkSettings are the settings of a network that can be changed through the API
+type networkSettings struct {
+	Enabled                                  bool
+	Password                                 string
+	Nickname, FbNickname, Username, Realname string
+	SaslMechanism, SaslAccount, SaslPassword string
+	BindHost, AddressFamily, ClientCert      string
+	Addresses                                []ircbnc.ServerConnectionAddress
+}
+
+func saveNetworkSettings(net *ircbnc.ServerConnection) networkSettings {
+	return networkSettings{
+		Enabled:       net.Enabled,
+		Password:      net.Password,
+		Nickname:      net.Nickname,
+		FbNickname:    net.FbNickname,
+		Username:      net.Username,
+		Realname:      net.Realname,
+		SaslMechanism: net.SaslMechanism,
+		SaslAccount:   net.SaslAccount,
+		SaslPassword:  net.SaslPassword,
+		BindHost:      net.BindHost,
+		AddressFamily: net.AddressFamily,
+		ClientCert:    net.ClientCert,
+		Addresses:     net.Addresses,
+	}
+}
+
+func (settings networkSettings) restore(net *ircbnc.ServerConnection) {
+	net.Enabled = settings.Enabled
+	net.Password = settings.Password
+	net.Nickname, net.FbNickname = settings.Nickname, settings.FbNickname
+	net.Username, net.Realname = settings.Username, settings.Realname
+	net.SaslMechanism, net.SaslAccount, net.SaslPassword = settings.SaslMechanism, settings.SaslAccount, settings.SaslPassword
+	net.BindHost, net.AddressFamily = settings.BindHost, settings.AddressFamily
+	net.ClientCert = settings.ClientCert
+	net.Addresses = settings.Addresses
+}
+
+// networkByName returns the user's network with the given name, ignoring case
+func networkByName(user *ircbnc.User, name string) *ircbnc.ServerConnection {
+	for _, network := range user.NetworkList() {
+		if strings.ToLower(network.Name) == strings.ToLower(name) {
+			return network
+		}
+	}
+
+	return nil
+}
+
+// GET, POST /users/{user}/networks
+func (req *apiRequest) handleNetworks(user *ircbnc.User) {
+	if !req.allowMethods("GET", "POST") {
+		return
+	}
+
+	if req.r.Method == "GET" {
+		networks := []networkJSON{}
+		for _, net := range user.NetworkList() {
+			networks = append(networks, networkToJSON(net))
+		}
+		sort.Slice(networks, func(i, j int) bool {
+			return networks[i].Name < networks[j].Name
+		})
+		sendJSON(req.w, http.StatusOK, networks)
+		return
+	}
+
+	// Admins can add networks for anyone
+	if !user.CanAddNetwork() && !req.isAdmin() {
+		sendError(req.w, http.StatusForbidden, "You don't have permission to add another network")
+		return
+	}
+
+	var changes networkChanges
+	if !req.readJSON(&changes) {
+		return
+	}
+
+	if changes.Addresses == nil || len(*changes.Addresses) == 0 {
+		sendError(req.w, http.StatusBadRequest, "Networks need at least one address")
+		return
+	}
+
+	name := changes.Name
+	if name == "" {
+		name = (*changes.Addresses)[0].Host
+	}
+	if networkByName(user, name) != nil {
+		sendError(req.w, http.StatusConflict, "Network name is already in use")
+		return
+	}
+
+	net := ircbnc.NewServerConnection()
+	net.User = user
+	net.Name = name
+	net.Nickname = user.DefaultNick
+	net.FbNickname = user.DefaultFbNick
+	net.Username = user.DefaultUser
+	net.Realname = user.DefaultReal
+	net.Enabled = true
+
+	errMessage := changes.apply(net)
+	if errMessage != "" {
+		sendError(req.w, http.StatusBadRequest, errMessage)
+		return
+	}
+
+	err := user.AddNetwork(net)
+	if err != nil {
+		sendError(req.w, http.StatusInternalServerError, "Could not save the network")
+		return
+	}
+
+	sendJSON(req.w, http.StatusCreated, networkToJSON(net))
+}
+
+// GET, PATCH and DELETE /users/{user}/networks/{network}
+func (req *apiRequest) handleNetwork(user *ircbnc.User, net *ircbnc.ServerConnection) {
+	if !req.allowMethods("GET", "PATCH", "DELETE") {
+		return
+	}
+
+	switch req.r.Method {
+	case "GET":
+		sendJSON(req.w, http.StatusOK, networkToJSON(net))
+
+	case "PATCH":
+		var changes networkChanges
+		if !req.readJSON(&changes) {
+			return
+		}
+		if changes.Name != "" && changes.Name != net.Name {
+			sendError(req.w, http.StatusBadRequest, "Networks can't be renamed")
+			return
+		}
+
+		// Keep the old settings so that nothing changes if the new ones aren't valid
+		old := saveNetworkSettings(net)
+		errMessage := changes.apply(net)
+		if errMessage != "" {
+			old.restore(net)
+			sendError(req.w, http.StatusBadRequest, errMessage)
+			return
+		}
+
+		err := req.api.Manager.Ds.SaveConnection(net)
+		if err != nil {
+			old.restore(net)
+			sendError(req.w, http.StatusInternalServerError, "Could not save the network")
+			return
+		}
+
+		sendJSON(req.w, http.StatusOK, networkToJSON(net))
+
+	case "DELETE":
+		err := user.DelNetwork(net)
+		if err != nil {
+			sendError(req.w, http.StatusInternalServerError, "Could not delete the network")
+			return
+		}
+		req.w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /users/{user}/networks/{network}/connect
+func (req *apiRequest) handleConnect(net *ircbnc.ServerConnection) {
+	if !req.allowMethods("POST") {
+		return
+	}
+
+	if net.User.Disabled {
+		sendError(req.w, http.StatusBadRequest, "The user is disabled")
+		return
+	}
+
+	if !net.Foo.Connected {
+		go net.Connect()
+	}
+	sendJSON(req.w, http.StatusAccepted, networkToJSON(net))
+}
+
+// POST /users/{user}/networks/{network}/disconnect
+func (req *apiRequest) handleDisconnect(net *ircbnc.ServerConnection) {
+	if !req.allowMethods("POST") {
+		return
+	}
+
+	net.Disconnect()
+	sendJSON(req.w, http.StatusOK, networkToJSON(net))
+}
+
+type bufferJSON struct {
+	Name     string    `json:"name"`
+	Channel  bool      `json:"channel"`
+	LastSeen time.Time `json:"last_seen"`
+	// Joined is true if we're currently in the channel
+	Joined bool `json:"joined"`
+}
+
+// GET /users/{user}/networks/{network}/buffers
+func (req *apiRequest) handleBuffers(net *ircbnc.ServerConnection) {
+	if !req.allowMethods("GET") {
+		return
+	}
+
+	buffers := []bufferJSON{}
+	for _, buffer := range net.Buffers {
+		buffers = append(buffers, bufferJSON{
+			Name:     buffer.Name,
+			Channel:  buffer.Channel,
+			LastSeen: buffer.LastSeen,
+			Joined:   buffer.Channel && net.Channel(buffer.Name) != nil,
+		})
+	}
+	sort.Slice(buffers, func(i, j int) bool {
+		return buffers[i].Name < buffers[j].Name
+	})
+
+	sendJSON(req.w, http.StatusOK, buffers)
+}
+
+type messageJSON struct {
+	Time    string `json:"time"`
+	Msgid   string `json:"msgid,omitempty"`
+	From    string `json:"from"`
+	Command string `json:"command"`
+	Target  string `json:"target"`
+	Text    string `json:"text"`
+}
+
+// GET /users/{user}/networks/{network}/search?q=words&buffer=#chan&from=&to=&limit=
+func (req *apiRequest) handleSearch(user *ircbnc.User, net *ircbnc.ServerConnection) {
+	if !req.allowMethods("GET") {
+		return
+	}
+
+	if !user.HasPermission(ircbnc.PermLogSearch) {
+		sendError(req.w, http.StatusForbidden, "You don't have permission to search messages")
+		return
+	}
+
+	store := req.api.Manager.Messages
+	if store == nil || !store.SupportsSearch() {
+		sendError(req.w, http.StatusNotImplemented, "Searching messages is not available")
+		return
+	}
+
+	params := req.r.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	if query == "" {
+		sendError(req.w, http.StatusBadRequest, "Missing the q parameter")
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if params.Get("from") != "" {
+		from, err = time.Parse(time.RFC3339, params.Get("from"))
+		if err != nil {
+			sendError(req.w, http.StatusBadRequest, "from must be an RFC 3339 time")
+			return
+		}
+	}
+	if params.Get("to") != "" {
+		to, err = time.Parse(time.RFC3339, params.Get("to"))
+		if err != nil {
+			sendError(req.w, http.StatusBadRequest, "to must be an RFC 3339 time")
+			return
+		}
+	}
+
+	limit := 100
+	if params.Get("limit") != "" {
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 {
+			sendError(req.w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		if limit > searchLimit {
+			limit = searchLimit
+		}
+	}
+
+	results := []messageJSON{}
+	for _, msg := range store.Search(user.ID, net.Name, params.Get("buffer"), query, from, to, limit) {
+		result := messageJSON{
+			Time:    msg.Tags["time"].Value,
+			Msgid:   msg.Tags["msgid"].Value,
+			From:    msg.Prefix,
+			Command: msg.Command,
+		}
+		if len(msg.Params) > 0 {
+			result.Target = msg.Params[0]
+		}
+		if len(msg.Params) > 1 {
+			result.Text = msg.Params[1]
+		}
+		results = append(results, result)
+	}
+
+	sendJSON(req.w, http.StatusOK, results)
+}
@@ -0,0 +1,365 @@
+package bncComponentHttpApi
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+)
+
+type userJSON struct {
+	Name                string   `json:"name"`
+	Role                string   `json:"role"`
+	Disabled            bool     `json:"disabled"`
+	Permissions         []string `json:"permissions"`
+	DefaultNick         string   `json:"default_nick"`
+	DefaultNickFallback string   `json:"default_nick_fallback"`
+	DefaultUsername     string   `json:"default_username"`
+	DefaultRealname     string   `json:"default_realname"`
+	MultiNetwork        bool     `json:"multi_network"`
+	Networks            []string `json:"networks"`
+	Clients             int      `json:"clients"`
+}
+
+func userToJSON(user *ircbnc.User) userJSON {
+	networks := []string{}
+	for _, net := range user.NetworkList() {
+		networks = append(networks, net.Name)
+	}
+	sort.Strings(networks)
+
+	permissions := user.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	return userJSON{
+		Name:                user.Name,
+		Role:                user.Role,
+		Disabled:            user.Disabled,
+		Permissions:         permissions,
+		DefaultNick:         user.DefaultNick,
+		DefaultNickFallback: user.DefaultFbNick,
+		DefaultUsername:     user.DefaultUser,
+		DefaultRealname:     user.DefaultReal,
+		MultiNetwork:        user.MultiNetwork,
+		Networks:            networks,
+		Clients:             len(user.Listeners()),
+	}
+}
+
+// userChanges are the fields that can be changed on a user. Missing fields are left alone.
+type userChanges struct {
+	Password            *string   `json:"password"`
+	Role                *string   `json:"role"`
+	Disabled            *bool     `json:"disabled"`
+	Permissions         *[]string `json:"permissions"`
+	DefaultNick         *string   `json:"default_nick"`
+	DefaultNickFallback *string   `json:"default_nick_fallback"`
+	DefaultUsername     *string   `json:"default_username"`
+	DefaultRealname     *string   `json:"default_realname"`
+	MultiNetwork        *bool     `json:"multi_network"`
+}
+
+// GET /users, POST /users
+func (req *apiRequest) handleUsers() {
+	if !req.isAdmin() {
+		sendError(req.w, http.StatusForbidden, "You don't have permission to manage users")
+		return
+	}
+
+	if !req.allowMethods("GET", "POST") {
+		return
+	}
+
+	if req.r.Method == "GET" {
+		users := []userJSON{}
+		for _, user := range req.api.Manager.UserList() {
+			users = append(users, userToJSON(user))
+		}
+		sort.Slice(users, func(i, j int) bool {
+			return users[i].Name < users[j].Name
+		})
+		sendJSON(req.w, http.StatusOK, users)
+		return
+	}
+
+	var newUser struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if !req.readJSON(&newUser) {
+		return
+	}
+
+	manager := req.api.Manager
+	username, err := ircbnc.BncName(newUser.Name)
+	if err != nil {
+		sendError(req.w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if newUser.Password == "" {
+		sendError(req.w, http.StatusBadRequest, "A password is needed")
+		return
+	}
+	if manager.User(username) != nil {
+		sendError(req.w, http.StatusConflict, "User "+username+" already exists")
+		return
+	}
+
+	role := ircbnc.RoleUser
+	if newUser.Role != "" {
+		var valid bool
+		role, valid = parseRole(newUser.Role)
+		if !valid {
+			sendError(req.w, http.StatusBadRequest, "The role must be "+ircbnc.RoleOwner+" or "+ircbnc.RoleUser)
+			return
+		}
+	}
+
+	user := ircbnc.NewUser(manager)
+	user.Name = username
+	user.Role = role
+	user.DefaultNick = username
+	user.DefaultFbNick = username + "_"
+	user.DefaultUser = username
+	user.DefaultReal = username
+	// New users get the permissions of their role
+	user.Permissions = []string{}
+	manager.Ds.SetUserPassword(user, newUser.Password)
+
+	err = manager.AddUser(user)
+	if err != nil {
+		sendError(req.w, http.StatusInternalServerError, "Could not save user "+username+": "+err.Error())
+		return
+	}
+
+	sendJSON(req.w, http.StatusCreated, userToJSON(user))
+}
+
+// GET, PATCH and DELETE /users/{user}
+func (req *apiRequest) handleUser(user *ircbnc.User) {
+	if !req.allowMethods("GET", "PATCH", "DELETE") {
+		return
+	}
+
+	switch req.r.Method {
+	case "GET":
+		sendJSON(req.w, http.StatusOK, userToJSON(user))
+
+	case "PATCH":
+		req.updateUser(user)
+
+	case "DELETE":
+		if !req.isAdmin() {
+			sendError(req.w, http.StatusForbidden, "You don't have permission to delete users")
+			return
+		}
+		if user == req.user {
+			sendError(req.w, http.StatusBadRequest, "You can't delete yourself")
+			return
+		}
+
+		err := req.api.Manager.DeleteUser(user, "Your account has been deleted")
+		if err != nil {
+			sendError(req.w, http.StatusInternalServerError, "Could not delete user "+user.Name+": "+err.Error())
+			return
+		}
+		req.w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// updateUser applies the changes in the request to the user and saves them
+func (req *apiRequest) updateUser(user *ircbnc.User) {
+	var changes userChanges
+	if !req.readJSON(&changes) {
+		return
+	}
+
+	// Only admins can change what users are allowed to do
+	if (changes.Role != nil || changes.Disabled != nil || changes.Permissions != nil) && !req.isAdmin() {
+		sendError(req.w, http.StatusForbidden, "You don't have permission to change roles, permissions or disable users")
+		return
+	}
+
+	role := user.Role
+	if changes.Role != nil {
+		var valid bool
+		role, valid = parseRole(*changes.Role)
+		if !valid {
+			sendError(req.w, http.StatusBadRequest, "The role must be "+ircbnc.RoleOwner+" or "+ircbnc.RoleUser)
+			return
+		}
+		// Stop the bouncer being left without anyone to manage it
+		if user == req.user && role != ircbnc.RoleOwner {
+			sendError(req.w, http.StatusBadRequest, "You can't remove your own "+ircbnc.RoleOwner+" role")
+			return
+		}
+	}
+
+	if changes.Disabled != nil && *changes.Disabled && user == req.user {
+		sendError(req.w, http.StatusBadRequest, "You can't disable yourself")
+		return
+	}
+
+	nick, fbNick := user.DefaultNick, user.DefaultFbNick
+	var err error
+	if changes.DefaultNick != nil {
+		nick, err = ircbnc.IrcName(*changes.DefaultNick, false)
+		if err != nil {
+			sendError(req.w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if changes.DefaultNickFallback != nil {
+		fbNick, err = ircbnc.IrcName(*changes.DefaultNickFallback, false)
+		if err != nil {
+			sendError(req.w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Keep a copy so that nothing changes if saving fails
+	oldUser := *user
+
+	user.Role = role
+	user.DefaultNick, user.DefaultFbNick = nick, fbNick
+	if changes.DefaultUsername != nil {
+		user.DefaultUser = *changes.DefaultUsername
+	}
+	if changes.DefaultRealname != nil {
+		user.DefaultReal = *changes.DefaultRealname
+	}
+	if changes.MultiNetwork != nil {
+		user.MultiNetwork = *changes.MultiNetwork
+	}
+	if changes.Permissions != nil {
+		permissions := []string{}
+		for _, permission := range *changes.Permissions {
+			permission = strings.ToLower(strings.TrimSpace(permission))
+			if permission != "" {
+				permissions = append(permissions, permission)
+			}
+		}
+		user.Permissions = permissions
+	}
+	if changes.Password != nil {
+		if *changes.Password == "" {
+			*user = oldUser
+			sendError(req.w, http.StatusBadRequest, "The password can't be empty")
+			return
+		}
+		req.api.Manager.Ds.SetUserPassword(user, *changes.Password)
+	}
+
+	err = req.api.Manager.Ds.SaveUser(user)
+	if err != nil {
+		*user = oldUser
+		sendError(req.w, http.StatusInternalServerError, "Could not save user "+user.Name+": "+err.Error())
+		return
+	}
+
+	// Enabling and disabling connects and disconnects the user, so it's done once the
+	// other changes have been saved
+	if changes.Disabled != nil && *changes.Disabled != user.Disabled {
+		if *changes.Disabled {
+			err = user.Disable("Your account has been disabled")
+		} else {
+			err = user.Enable()
+		}
+		if err != nil {
+			sendError(req.w, http.StatusInternalServerError, "Could not save user "+user.Name+": "+err.Error())
+			return
+		}
+	}
+
+	sendJSON(req.w, http.StatusOK, userToJSON(user))
+}
+
+// parseRole returns the role with the given name, ignoring case
+func parseRole(name string) (string, bool) {
+	for _, role := range []string{ircbnc.RoleOwner, ircbnc.RoleUser} {
+		if strings.ToLower(name) == strings.ToLower(role) {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+type tokenJSON struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Token is only given when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+// GET, POST /users/{user}/tokens
+func (req *apiRequest) handleTokens(user *ircbnc.User) {
+	if !req.allowMethods("GET", "POST") {
+		return
+	}
+
+	if req.r.Method == "GET" {
+		tokens := []tokenJSON{}
+		for _, apiToken := range user.APITokens {
+			tokens = append(tokens, tokenJSON{
+				Name:    apiToken.Name,
+				Created: apiToken.Created,
+			})
+		}
+		sendJSON(req.w, http.StatusOK, tokens)
+		return
+	}
+
+	var newToken struct {
+		Name string `json:"name"`
+	}
+	if !req.readJSON(&newToken) {
+		return
+	}
+
+	token, err := user.AddAPIToken(newToken.Name)
+	if err != nil {
+		sendError(req.w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = req.api.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.DelAPIToken(strings.TrimSpace(newToken.Name))
+		sendError(req.w, http.StatusInternalServerError, "Could not save the API token")
+		return
+	}
+
+	apiToken := user.APITokens[len(user.APITokens)-1]
+	sendJSON(req.w, http.StatusCreated, tokenJSON{
+		Name:    apiToken.Name,
+		Created: apiToken.Created,
+		Token:   token,
+	})
+}
+
+// DELETE /users/{user}/tokens/{name}
+func (req *apiRequest) handleToken(user *ircbnc.User, name string) {
+	if !req.allowMethods("DELETE") {
+		return
+	}
+
+	oldTokens := append([]ircbnc.APIToken{}, user.APITokens...)
+	if !user.DelAPIToken(name) {
+		sendError(req.w, http.StatusNotFound, "API token not found")
+		return
+	}
+
+	err := req.api.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.APITokens = oldTokens
+		sendError(req.w, http.StatusInternalServerError, "Could not save the API tokens")
+		return
+	}
+
+	req.w.WriteHeader(http.StatusNoContent)
+}
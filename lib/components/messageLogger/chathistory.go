@@ -0,0 +1,258 @@
+package bncComponentLogger
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// chatHistoryPoint is a point in a buffer's history given by a CHATHISTORY selector
+type chatHistoryPoint struct {
+	Time time.Time
+	// Latest is set for the * selector of LATEST, meaning no lower bound
+	Latest bool
+}
+
+// [c] CHATHISTORY BEFORE #chan timestamp=2019-01-04T14:33:26.123Z 50
+// [c] CHATHISTORY AFTER #chan msgid=0JRAWD28P0GYH4BR8A6E5ZCTWC 50
+// [c] CHATHISTORY LATEST #chan * 50
+// [c] CHATHISTORY AROUND #chan msgid=0JRAWD28P0GYH4BR8A6E5ZCTWC 50
+// [c] CHATHISTORY BETWEEN #chan timestamp=2019-01-04T14:33:26.123Z timestamp=2019-01-05T14:33:26.123Z 50
+// [c] CHATHISTORY TARGETS timestamp=2019-01-04T14:33:26.123Z timestamp=2019-01-05T14:33:26.123Z 50
+// [s] FAIL CHATHISTORY INVALID_PARAMS BEFORE :Invalid message reference
+func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.IrcMessage) {
+	if len(msg.Params) < 1 {
+		logger.chatHistoryFail(listener, "NEED_MORE_PARAMS", []string{"*"}, "Missing parameters")
+		return
+	}
+
+	subcommand := strings.ToUpper(msg.Params[0])
+
+	// Older clients send CHATHISTORY <target> timestamp=<ts> message_count=<n>
+	if len(msg.Params) == 3 && strings.HasPrefix(msg.Params[2], "message_count=") {
+		logger.handleLegacyChatHistory(listener, msg)
+		return
+	}
+
+	store := logger.Manager.Messages
+	if store == nil || !store.SupportsRetrieve() {
+		logger.chatHistoryFail(listener, "MESSAGE_ERROR", []string{subcommand, "*"}, "Message history is not available")
+		return
+	}
+
+	if !listener.IsCapEnabled("batch") {
+		logger.chatHistoryFail(listener, "MESSAGE_ERROR", []string{subcommand, "*"}, "The batch capability is required for message history")
+		return
+	}
+
+	if listener.ServerConnection == nil {
+		logger.chatHistoryFail(listener, "INVALID_TARGET", []string{subcommand, "*"}, "You are not connected to a network")
+		return
+	}
+
+	params := msg.Params[1:]
+	switch subcommand {
+	case "BEFORE", "AFTER", "LATEST", "AROUND":
+		if len(params) < 3 {
+			logger.chatHistoryFail(listener, "NEED_MORE_PARAMS", []string{subcommand}, "Missing parameters")
+			return
+		}
+	case "BETWEEN":
+		if len(params) < 4 {
+			logger.chatHistoryFail(listener, "NEED_MORE_PARAMS", []string{subcommand}, "Missing parameters")
+			return
+		}
+	case "TARGETS":
+		if len(params) < 3 {
+			logger.chatHistoryFail(listener, "NEED_MORE_PARAMS", []string{subcommand}, "Missing parameters")
+			return
+		}
+		logger.chatHistoryTargets(listener, params)
+		return
+	default:
+		logger.chatHistoryFail(listener, "UNKNOWN_COMMAND", []string{subcommand}, "Unknown command")
+		return
+	}
+
+	target := params[0]
+	limit, limitOk := parseChatHistoryLimit(params[len(params)-1])
+	if !limitOk {
+		logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{subcommand, params[len(params)-1]}, "Invalid limit")
+		return
+	}
+
+	point, pointOk := logger.parseChatHistorySelector(listener, params[1], subcommand == "LATEST")
+	if !pointOk {
+		logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{subcommand, params[1]}, "Invalid message reference")
+		return
+	}
+
+	userID := listener.User.ID
+	netName := listener.ServerConnection.Name
+
+	var msgs []*ircmsg.IrcMessage
+	switch subcommand {
+	case "BEFORE":
+		msgs = store.GetBeforeTime(userID, netName, target, point.Time, limit)
+	case "AFTER":
+		msgs = store.GetFromTime(userID, netName, target, point.Time, limit)
+	case "LATEST":
+		if point.Latest {
+			msgs = store.GetBeforeTime(userID, netName, target, time.Now().Add(time.Second), limit)
+		} else {
+			msgs = store.GetBetweenTime(userID, netName, target, time.Now().Add(time.Second), point.Time, limit)
+		}
+	case "AROUND":
+		// Include the message at the reference point in the later half
+		msgs = store.GetBeforeTime(userID, netName, target, point.Time, limit/2)
+		after := store.GetFromTime(userID, netName, target, point.Time.Add(-time.Millisecond), limit-len(msgs))
+		msgs = append(msgs, after...)
+	case "BETWEEN":
+		endPoint, endOk := logger.parseChatHistorySelector(listener, params[2], false)
+		if !endOk {
+			logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{subcommand, params[2]}, "Invalid message reference")
+			return
+		}
+		msgs = store.GetBetweenTime(userID, netName, target, point.Time, endPoint.Time, limit)
+	}
+
+	sendHistoryBatch(listener, target, msgs)
+}
+
+// chatHistoryTargets lists the buffers that have had messages between two points
+func (logger *Logger) chatHistoryTargets(listener *ircbnc.Listener, params []string) {
+	store := logger.Manager.Messages
+
+	start, startOk := logger.parseChatHistorySelector(listener, params[0], false)
+	if !startOk {
+		logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{"TARGETS", params[0]}, "Invalid message reference")
+		return
+	}
+	end, endOk := logger.parseChatHistorySelector(listener, params[1], false)
+	if !endOk {
+		logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{"TARGETS", params[1]}, "Invalid message reference")
+		return
+	}
+	limit, limitOk := parseChatHistoryLimit(params[2])
+	if !limitOk {
+		logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{"TARGETS", params[2]}, "Invalid limit")
+		return
+	}
+
+	targets := store.GetTargets(listener.User.ID, listener.ServerConnection.Name, start.Time, end.Time, limit)
+
+	batchId := ircbnc.MakeBatchID()
+	listener.Send(nil, "", "BATCH", "+"+batchId, "draft/chathistory-targets")
+	for _, target := range targets {
+		tags := map[string]ircmsg.TagValue{
+			"batch": ircmsg.MakeTagValue(batchId),
+		}
+		listener.Send(&tags, listener.Manager.Source, "CHATHISTORY", "TARGETS", target.Name, target.LatestTime.Format(ircbnc.TimestampFormat))
+	}
+	listener.Send(nil, "", "BATCH", "-"+batchId)
+}
+
+// handleLegacyChatHistory supports the original CHATHISTORY <target> timestamp=<ts> message_count=<n>
+// form, where a negative count fetches messages from before the timestamp
+func (logger *Logger) handleLegacyChatHistory(listener *ircbnc.Listener, msg *ircmsg.IrcMessage) {
+	if !listener.IsCapEnabled("batch") || listener.ServerConnection == nil {
+		return
+	}
+
+	store := logger.Manager.Messages
+	if store == nil || !store.SupportsRetrieve() {
+		return
+	}
+
+	target := msg.Params[0]
+
+	point, pointOk := logger.parseChatHistorySelector(listener, msg.Params[1], false)
+	if !pointOk {
+		logger.chatHistoryFail(listener, "INVALID_PARAMS", []string{"*", msg.Params[1]}, "Invalid message reference")
+		return
+	}
+
+	numMessages, _ := strconv.Atoi(strings.TrimPrefix(msg.Params[2], "message_count="))
+	if numMessages > MaxRetrieveSize {
+		numMessages = MaxRetrieveSize
+	}
+	if numMessages < -MaxRetrieveSize {
+		numMessages = -MaxRetrieveSize
+	}
+
+	for _, buffer := range listener.ServerConnection.Buffers {
+		// If target == * then send all available buffers
+		if target != "*" && strings.ToLower(target) != strings.ToLower(buffer.Name) {
+			continue
+		}
+
+		var msgs []*ircmsg.IrcMessage
+		if numMessages < 0 {
+			msgs = store.GetBeforeTime(listener.User.ID, listener.ServerConnection.Name, buffer.Name, point.Time, numMessages*-1)
+		} else {
+			msgs = store.GetFromTime(listener.User.ID, listener.ServerConnection.Name, buffer.Name, point.Time, numMessages)
+		}
+
+		sendHistoryBatch(listener, buffer.Name, msgs)
+	}
+}
+
+// parseChatHistorySelector parses a timestamp= or msgid= selector. allowLatest permits *
+func (logger *Logger) parseChatHistorySelector(listener *ircbnc.Listener, selector string, allowLatest bool) (chatHistoryPoint, bool) {
+	if selector == "*" {
+		return chatHistoryPoint{Latest: true}, allowLatest
+	}
+
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 {
+		return chatHistoryPoint{}, false
+	}
+
+	switch parts[0] {
+	case "timestamp":
+		ts, err := time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return chatHistoryPoint{}, false
+		}
+		return chatHistoryPoint{Time: ts}, true
+
+	case "msgid":
+		ts, found := logger.Manager.Messages.GetMsgidTime(listener.User.ID, listener.ServerConnection.Name, parts[1])
+		if !found {
+			return chatHistoryPoint{}, false
+		}
+		return chatHistoryPoint{Time: ts}, true
+	}
+
+	return chatHistoryPoint{}, false
+}
+
+// parseChatHistoryLimit parses the requested number of messages, capping it at what we
+// advertise in the CHATHISTORY ISUPPORT token
+func parseChatHistoryLimit(param string) (int, bool) {
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 0 {
+		return 0, false
+	}
+
+	if limit == 0 || limit > MaxRetrieveSize {
+		limit = MaxRetrieveSize
+	}
+
+	return limit, true
+}
+
+func (logger *Logger) chatHistoryFail(listener *ircbnc.Listener, code string, context []string, description string) {
+	params := []string{"CHATHISTORY", code}
+	params = append(params, context...)
+	params = append(params, description)
+	listener.Send(nil, logger.Manager.Source, "FAIL", params...)
+}
+
+// sendHistoryBatch sends the given messages to the listener in a chathistory batch
+func sendHistoryBatch(listener *ircbnc.Listener, target string, msgs []*ircmsg.IrcMessage) {
+	listener.SendBatch("chathistory", []string{target}, msgs)
+}
@@ -0,0 +1,90 @@
+package bncComponentLogger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+)
+
+// msgidStore is a message store that only knows the times of some msgids
+type msgidStore struct {
+	ircbnc.MessageDatastore
+	times map[string]time.Time
+}
+
+func (store *msgidStore) GetMsgidTime(userID string, networkID string, msgid string) (time.Time, bool) {
+	ts, found := store.times[userID+" "+networkID+" "+msgid]
+	return ts, found
+}
+
+func TestParseChatHistorySelector(t *testing.T) {
+	msgidTime := time.Date(2019, 1, 4, 14, 33, 26, 123000000, time.UTC)
+	logger := &Logger{
+		Manager: &ircbnc.Manager{
+			Messages: &msgidStore{
+				times: map[string]time.Time{
+					"dan freenode 0JRAWD28P0GYH4BR8A6E5ZCTWC": msgidTime,
+				},
+			},
+		},
+	}
+	listener := &ircbnc.Listener{
+		User:             &ircbnc.User{ID: "dan"},
+		ServerConnection: &ircbnc.ServerConnection{Name: "freenode"},
+	}
+
+	tests := []struct {
+		selector    string
+		allowLatest bool
+		want        chatHistoryPoint
+		ok          bool
+	}{
+		{"timestamp=2019-01-04T14:33:26.123Z", false, chatHistoryPoint{Time: msgidTime}, true},
+		{"timestamp=2019-01-04T15:33:26.123+01:00", false, chatHistoryPoint{Time: msgidTime}, true},
+		{"msgid=0JRAWD28P0GYH4BR8A6E5ZCTWC", false, chatHistoryPoint{Time: msgidTime}, true},
+		{"*", true, chatHistoryPoint{Latest: true}, true},
+		{"*", false, chatHistoryPoint{Latest: true}, false},
+		{"msgid=unknown", false, chatHistoryPoint{}, false},
+		{"timestamp=yesterday", false, chatHistoryPoint{}, false},
+		{"timestamp=", false, chatHistoryPoint{}, false},
+		{"2019-01-04T14:33:26.123Z", false, chatHistoryPoint{}, false},
+		{"time=2019-01-04T14:33:26.123Z", false, chatHistoryPoint{}, false},
+		{"", true, chatHistoryPoint{}, false},
+	}
+
+	for _, test := range tests {
+		point, ok := logger.parseChatHistorySelector(listener, test.selector, test.allowLatest)
+		if ok != test.ok {
+			t.Errorf("parseChatHistorySelector(%q, %v) returned %v, want %v", test.selector, test.allowLatest, ok, test.ok)
+			continue
+		}
+		if ok && (!point.Time.Equal(test.want.Time) || point.Latest != test.want.Latest) {
+			t.Errorf("parseChatHistorySelector(%q, %v) = %v, want %v", test.selector, test.allowLatest, point, test.want)
+		}
+	}
+}
+
+func TestParseChatHistoryLimit(t *testing.T) {
+	tests := []struct {
+		param string
+		limit int
+		ok    bool
+	}{
+		{"1", 1, true},
+		{"20", 20, true},
+		{"50", MaxRetrieveSize, true},
+		{"0", MaxRetrieveSize, true},
+		{"1000", MaxRetrieveSize, true},
+		{"-1", 0, false},
+		{"ten", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		limit, ok := parseChatHistoryLimit(test.param)
+		if limit != test.limit || ok != test.ok {
+			t.Errorf("parseChatHistoryLimit(%q) = %d, %v, want %d, %v", test.param, limit, ok, test.limit, test.ok)
+		}
+	}
+}
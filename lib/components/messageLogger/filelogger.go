@@ -36,6 +36,11 @@ func (ds *FileMessageDatastore) SupportsSearch() bool {
 	return false
 }
 
+func (ds *FileMessageDatastore) Close() error {
+	// Every line is written straight to disk, so there's nothing to flush
+	return nil
+}
+
 func (ds *FileMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
 	if ds.logPath == "" {
 		return
@@ -53,7 +58,7 @@ func (ds *FileMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
 
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		println(err.Error())
+		messagesLog.Error("Could not open log file", "file", filename, "error", err)
 		return
 	}
 
@@ -66,7 +71,22 @@ func (ds *FileMessageDatastore) GetFromTime(string, string, string, time.Time, i
 func (ds *FileMessageDatastore) GetBeforeTime(string, string, string, time.Time, int) []*ircmsg.IrcMessage {
 	return []*ircmsg.IrcMessage{}
 }
-func (ds *FileMessageDatastore) Search(string, string, string, time.Time, time.Time, int) []*ircmsg.IrcMessage {
+func (ds *FileMessageDatastore) GetBetweenTime(string, string, string, time.Time, time.Time, int) []*ircmsg.IrcMessage {
+	return []*ircmsg.IrcMessage{}
+}
+func (ds *FileMessageDatastore) CountBetweenTime(string, string, string, time.Time, time.Time) int {
+	return 0
+}
+func (ds *FileMessageDatastore) GetTargets(string, string, time.Time, time.Time, int) []ircbnc.HistoryTarget {
+	return []ircbnc.HistoryTarget{}
+}
+func (ds *FileMessageDatastore) GetMsgidTime(string, string, string) (time.Time, bool) {
+	return time.Time{}, false
+}
+func (ds *FileMessageDatastore) GetByMsgid(string, string, string) (*ircmsg.IrcMessage, bool) {
+	return nil, false
+}
+func (ds *FileMessageDatastore) Search(string, string, string, string, time.Time, time.Time, int) []*ircmsg.IrcMessage {
 	return []*ircmsg.IrcMessage{}
 }
 
@@ -105,14 +125,14 @@ func createLineFromMessage(event *ircbnc.HookIrcRaw) (string, string) {
 			)
 			destination = message.Params[0]
 		}
-	} else if event.FromClient && event.Listener.ServerConnection != nil {
+	} else if event.FromClient && event.Server != nil {
 		switch message.Command {
 		case "PRIVMSG":
-			currentNick := event.Listener.ServerConnection.Nickname
+			currentNick := event.Server.Nickname
 			line = fmt.Sprintf("<%s> %s", currentNick, message.Params[1])
 			destination = message.Params[0]
 		case "NOTICE":
-			currentNick := event.Listener.ServerConnection.Nickname
+			currentNick := event.Server.Nickname
 			// TODO: Whats the norm format for logging notices?
 			line = fmt.Sprintf("<%s> %s", currentNick, message.Params[1])
 			destination = message.Params[0]
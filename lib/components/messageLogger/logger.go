@@ -1,26 +1,26 @@
 package bncComponentLogger
 
 import (
-	"crypto/rand"
-	"fmt"
-	"log"
+	"reflect"
 	"strconv"
-	"strings"
-	"time"
 
 	"github.com/goshuirc/bnc/lib"
-	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/goshuirc/bnc/lib/logger"
 )
 
 const MaxRetrieveSize int = 50
 
+var messagesLog = bncLog.New("components.messages")
+
 func Run(manager *ircbnc.Manager) {
+	// The store may still be nil here, logging can be turned on later by rehashing
 	store, _ := getMessageDataStoreInstance(manager.Config)
-	if store == nil {
-		return
+	if store != nil {
+		manager.Messages = store
 	}
 
-	manager.Messages = store
+	ircbnc.Capabilities.Supported["draft/chathistory"] = ""
+
 	l := &Logger{
 		Manager: manager,
 	}
@@ -53,11 +53,38 @@ func (logger *Logger) RegisterHooks() {
 	logger.Manager.Bus.Register(ircbnc.HookIrcRawName, logger.onMessage)
 	logger.Manager.Bus.Register(ircbnc.HookStateSentName, logger.onStateSent)
 	logger.Manager.Bus.Register(ircbnc.HookNewListenerName, logger.onNewListener)
+	logger.Manager.Bus.Register(ircbnc.HookRehashName, logger.onRehash)
+}
+
+// Swap out the message store if the logging config has changed
+func (logger *Logger) onRehash(hook interface{}) {
+	event := hook.(*ircbnc.HookRehash)
+	if reflect.DeepEqual(event.OldConfig.Bouncer.Logging, event.NewConfig.Bouncer.Logging) {
+		return
+	}
+
+	oldStore := logger.Manager.Messages
+	newStore, storageType := getMessageDataStoreInstance(event.NewConfig)
+	logger.Manager.Messages = newStore
+
+	if oldStore != nil {
+		err := oldStore.Close()
+		if err != nil {
+			messagesLog.Error("Could not close the old message store", "error", err)
+		}
+	}
+
+	if newStore == nil {
+		messagesLog.Info("Message logging is now disabled")
+	} else {
+		messagesLog.Info("Message logging changed", "type", storageType)
+	}
 }
 
 func (logger *Logger) onNewListener(hook interface{}) {
 	event := hook.(*ircbnc.HookNewListener)
-	if logger.Manager.Messages.SupportsRetrieve() {
+	store := logger.Manager.Messages
+	if store != nil && store.SupportsRetrieve() {
 		event.Listener.ExtraISupports["CHATHISTORY"] = strconv.Itoa(MaxRetrieveSize)
 	}
 }
@@ -70,7 +97,12 @@ func (logger *Logger) onMessage(hook interface{}) {
 		return
 	}
 
-	logger.Manager.Messages.Store(event)
+	store := logger.Manager.Messages
+	if store == nil {
+		return
+	}
+
+	store.Store(event)
 
 	if event.Message.Command == "CHATHISTORY" {
 		event.Halt = true
@@ -87,8 +119,11 @@ func (logger *Logger) onStateSent(hook interface{}) {
 		return
 	}
 
-	store := logger.Manager.Messages
-	if !store.SupportsRetrieve() {
+	// Multi-network listeners get the history of every network
+	if event.Listener.MultiNetwork {
+		for _, network := range event.Listener.User.NetworkList() {
+			event.Listener.SendPlayback(network)
+		}
 		return
 	}
 
@@ -97,117 +132,5 @@ func (logger *Logger) onStateSent(hook interface{}) {
 		return
 	}
 
-	for _, buffer := range event.Server.Buffers {
-		msgs := store.GetBeforeTime(event.Listener.User.ID, event.Server.Name, buffer.Name, time.Now(), 50)
-		for _, message := range msgs {
-			line, err := message.Line()
-			if err != nil {
-				log.Println("Error building message from storage:", err.Error())
-				continue
-			}
-			event.Listener.SendLine(line)
-		}
-	}
-}
-
-func (logger *Logger) handleChatHistory(listener *ircbnc.Listener, msg *ircmsg.IrcMessage) {
-	if !listener.IsCapEnabled("batch") || listener.ServerConnection == nil {
-		return
-	}
-
-	if len(msg.Params) < 3 {
-		return
-	}
-
-	store := logger.Manager.Messages
-	if !store.SupportsRetrieve() {
-		return
-	}
-
-	target := msg.Params[0]
-	start := msg.Params[1]
-	end := msg.Params[2]
-
-	startParts := strings.SplitN(start, "=", 2)
-	if len(startParts) != 2 {
-		return
-	}
-	if startParts[0] != "timestamp" {
-		log.Println("Unsupported starting point for CHATHISTORY: " + startParts[0])
-		return
-	}
-
-	timeFrom, timeErr := time.Parse(time.RFC3339, startParts[1])
-	if timeErr != nil {
-		log.Println("Error parsing date for CHATHISTORY: " + timeErr.Error())
-		return
-	}
-
-	endParts := strings.SplitN(end, "=", 2)
-	if len(endParts) != 2 {
-		return
-	}
-	if endParts[0] != "message_count" {
-		log.Println("Only message_count ending point is supported for CHATHISTORY")
-		return
-	}
-
-	numMessages, _ := strconv.Atoi(endParts[1])
-	if numMessages > MaxRetrieveSize {
-		numMessages = MaxRetrieveSize
-	}
-	if numMessages < -MaxRetrieveSize {
-		numMessages = -MaxRetrieveSize
-	}
-
-	for _, buffer := range listener.ServerConnection.Buffers {
-		// If target == * then send all available buffers
-		if target != "*" && strings.ToLower(target) != strings.ToLower(buffer.Name) {
-			continue
-		}
-
-		var msgs []*ircmsg.IrcMessage
-		if numMessages < 0 {
-			msgs = store.GetBeforeTime(
-				listener.User.ID,
-				listener.ServerConnection.Name,
-				buffer.Name,
-				timeFrom,
-				numMessages*-1,
-			)
-		} else {
-			msgs = store.GetFromTime(
-				listener.User.ID,
-				listener.ServerConnection.Name,
-				buffer.Name,
-				timeFrom,
-				numMessages,
-			)
-		}
-
-		batchId := makeBatchId()
-		listener.Send(nil, "", "BATCH", "+"+batchId, "chathistory", buffer.Name)
-
-		for _, message := range msgs {
-			message.Tags["batch"] = ircmsg.MakeTagValue(batchId)
-			line, err := message.Line()
-			if err != nil {
-				log.Println("Error building message from storage:", err.Error())
-				continue
-			}
-			listener.SendLine(line)
-		}
-
-		listener.Send(nil, "", "BATCH", "-"+batchId)
-	}
-}
-
-func makeBatchId() string {
-	length := 8
-	b := make([]byte, length)
-	if _, err := rand.Read(b); err != nil {
-		panic(err)
-	}
-	id := fmt.Sprintf("%X", b)
-	return id
+	event.Listener.SendPlayback(event.Server)
 }
@@ -2,11 +2,13 @@ package bncComponentLogger
 
 import (
 	"database/sql"
-	"log"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/metrics"
 	"github.com/goshuirc/irc-go/ircmsg"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -16,20 +18,53 @@ const TYPE_MESSAGE = 1
 const TYPE_ACTION = 2
 const TYPE_NOTICE = 3
 
+// sqliteMigrations upgrade the messages database, each one taking it up a version.
+// The current version is stored in sqlite's user_version pragma.
+var sqliteMigrations = []string{
+	// 1: timestamps are stored in milliseconds, and looked up by buffer
+	`UPDATE messages SET ts = ts * 1000;
+	CREATE INDEX IF NOT EXISTS messages_buffer_ts ON messages (uid, netid, buffer, ts);`,
+	// 2: messages keep their msgid so they can be looked up by it
+	`ALTER TABLE messages ADD COLUMN msgid TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS messages_msgid ON messages (uid, netid, msgid);`,
+}
+
+// sqliteSearchSchema sets up the full-text search index. It's kept out of the migrations
+// because FTS5 is only available when go-sqlite3 is built with the sqlite_fts5 tag.
+// Without it, searches fall back to a slower LIKE query.
+var sqliteSearchSchema = []string{
+	`CREATE VIRTUAL TABLE messages_fts USING fts5(line, fromNick, buffer, content='messages', content_rowid='rowid')`,
+	`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, line, fromNick, buffer) VALUES (new.rowid, new.line, new.fromNick, new.buffer);
+	END`,
+	`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, line, fromNick, buffer) VALUES ('delete', old.rowid, old.line, old.fromNick, old.buffer);
+	END`,
+	// Index any messages stored before search was available
+	`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')`,
+}
+
 type SqliteMessage struct {
-	ts          int32
+	ts          int64
 	user        string
 	network     string
 	buffer      string
 	from        string
 	messageType int
 	line        string
+	msgid       string
 }
 
 type SqliteMessageDatastore struct {
 	dbPath       string
 	db           *sql.DB
 	messageQueue chan SqliteMessage
+	fullText     bool
+
+	// closedLock stops messages being queued while we're closing the queue
+	closedLock sync.RWMutex
+	closed     bool
+	writerDone chan bool
 }
 
 func (ds *SqliteMessageDatastore) SupportsStore() bool {
@@ -39,7 +74,7 @@ func (ds *SqliteMessageDatastore) SupportsRetrieve() bool {
 	return true
 }
 func (ds *SqliteMessageDatastore) SupportsSearch() bool {
-	return false
+	return true
 }
 func NewSqliteMessageDatastore(config map[string]string) *SqliteMessageDatastore {
 	ds := &SqliteMessageDatastore{}
@@ -47,7 +82,7 @@ func NewSqliteMessageDatastore(config map[string]string) *SqliteMessageDatastore
 	ds.dbPath = config["database"]
 	db, err := sql.Open("sqlite3", ds.dbPath)
 	if err != nil {
-		log.Fatal(err)
+		messagesLog.Fatal("Could not open messages database", "error", err)
 	}
 
 	ds.db = db
@@ -55,27 +90,104 @@ func NewSqliteMessageDatastore(config map[string]string) *SqliteMessageDatastore
 	// Create the tables if needed
 	_, err = db.Exec("CREATE TABLE IF NOT EXISTS messages (uid TEXT, netid TEXT, ts INT, buffer TEXT, fromNick TEXT, type INT, line TEXT)")
 	if err != nil {
-		log.Fatal("Error creates messages sqlite database:", err.Error())
+		messagesLog.Fatal("Could not create messages database", "error", err)
+	}
+
+	err = ds.migrate()
+	if err != nil {
+		messagesLog.Fatal("Could not upgrade messages database", "error", err)
+	}
+
+	err = ds.setupSearch()
+	if err != nil {
+		messagesLog.Warn("Sqlite full-text search is not available, message search will be slower", "error", err)
+	} else {
+		ds.fullText = true
 	}
 
 	// Start the queue to insert messages
 	ds.messageQueue = make(chan SqliteMessage)
+	ds.writerDone = make(chan bool)
 	go ds.messageWriter()
 
 	return ds
 }
 
+// migrate runs any migrations the database hasn't had yet
+func (ds *SqliteMessageDatastore) migrate() error {
+	var version int
+	err := ds.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := ds.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqliteMigrations[version])
+		if err == nil {
+			// PRAGMA doesn't accept bound parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", version+1, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupSearch creates the full-text search index if it doesn't exist yet
+func (ds *SqliteMessageDatastore) setupSearch() error {
+	var count int
+	err := ds.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'").Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range sqliteSearchSchema {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (ds *SqliteMessageDatastore) messageWriter() {
-	storeStmt, err := ds.db.Prepare("INSERT INTO messages (uid, netid, ts, buffer, fromNick, type, line) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	storeStmt, err := ds.db.Prepare("INSERT INTO messages (uid, netid, ts, buffer, fromNick, type, line, msgid) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
-		log.Fatal(err.Error())
+		messagesLog.Fatal("Could not prepare to store messages", "error", err)
 	}
+	defer close(ds.writerDone)
+	defer storeStmt.Close()
+
 	for {
 		message, isOK := <-ds.messageQueue
 		if !isOK {
 			break
 		}
 
+		start := time.Now()
 		storeStmt.Exec(
 			message.user,
 			message.network,
@@ -84,7 +196,10 @@ func (ds *SqliteMessageDatastore) messageWriter() {
 			message.from,
 			message.messageType,
 			message.line,
+			message.msgid,
 		)
+		bncMetrics.StoreWriteSeconds.ObserveSince(start)
+		bncMetrics.StoreQueueDepth.Dec()
 	}
 }
 
@@ -94,77 +209,229 @@ func (ds *SqliteMessageDatastore) Store(event *ircbnc.HookIrcRaw) {
 		return
 	}
 
+	ds.closedLock.RLock()
+	defer ds.closedLock.RUnlock()
+	if ds.closed {
+		return
+	}
+
+	bncMetrics.StoreQueueDepth.Inc()
 	ds.messageQueue <- SqliteMessage{
-		ts:          int32(time.Now().UTC().Unix()),
+		ts:          toMillis(time.Now()),
 		user:        event.User.ID,
 		network:     event.Server.Name,
 		buffer:      buffer,
 		from:        from,
 		messageType: messageType,
 		line:        line,
+		msgid:       event.Message.Tags["msgid"].Value,
+	}
+}
+
+// Close writes out any messages still in the queue and then closes the database.
+func (ds *SqliteMessageDatastore) Close() error {
+	ds.closedLock.Lock()
+	if ds.closed {
+		ds.closedLock.Unlock()
+		return nil
 	}
+	ds.closed = true
+	close(ds.messageQueue)
+	ds.closedLock.Unlock()
+
+	<-ds.writerDone
+	return ds.db.Close()
 }
+
 func (ds *SqliteMessageDatastore) GetFromTime(userID string, networkID string, buffer string, from time.Time, num int) []*ircmsg.IrcMessage {
-	messages := []*ircmsg.IrcMessage{}
+	sql := "SELECT ts, fromNick, type, line, buffer, msgid FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts > ? ORDER BY ts ASC LIMIT ?"
+	return ds.queryMessages("GetFromTime", false, sql, userID, networkID, strings.ToLower(buffer), toMillis(from), num)
+}
+func (ds *SqliteMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, from time.Time, num int) []*ircmsg.IrcMessage {
+	sql := "SELECT ts, fromNick, type, line, buffer, msgid FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts < ? ORDER BY ts DESC LIMIT ?"
+	return ds.queryMessages("GetBeforeTime", true, sql, userID, networkID, strings.ToLower(buffer), toMillis(from), num)
+}
+func (ds *SqliteMessageDatastore) GetBetweenTime(userID string, networkID string, buffer string, from time.Time, to time.Time, num int) []*ircmsg.IrcMessage {
+	if from.After(to) {
+		sql := "SELECT ts, fromNick, type, line, buffer, msgid FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts < ? AND ts > ? ORDER BY ts DESC LIMIT ?"
+		return ds.queryMessages("GetBetweenTime", true, sql, userID, networkID, strings.ToLower(buffer), toMillis(from), toMillis(to), num)
+	}
+
+	sql := "SELECT ts, fromNick, type, line, buffer, msgid FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts > ? AND ts < ? ORDER BY ts ASC LIMIT ?"
+	return ds.queryMessages("GetBetweenTime", false, sql, userID, networkID, strings.ToLower(buffer), toMillis(from), toMillis(to), num)
+}
+func (ds *SqliteMessageDatastore) CountBetweenTime(userID string, networkID string, buffer string, from time.Time, to time.Time) int {
+	start, end := toMillis(from), toMillis(to)
+	if start > end {
+		start, end = end, start
+	}
 
-	sql := "SELECT ts, fromNick, type, line, buffer FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts > ? ORDER BY ts DESC LIMIT ?"
-	rows, err := ds.db.Query(sql, userID, networkID, strings.ToLower(buffer), int32(from.UTC().Unix()), num)
+	var count int
+	sql := "SELECT COUNT(*) FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts > ? AND ts < ?"
+	err := ds.db.QueryRow(sql, userID, networkID, strings.ToLower(buffer), start, end).Scan(&count)
 	if err != nil {
-		log.Println("GetBeforeTime() error: " + err.Error())
-		return messages
+		messagesLog.Error("Query failed", "query", "CountBetweenTime", "error", err)
+		return 0
+	}
+
+	return count
+}
+func (ds *SqliteMessageDatastore) GetTargets(userID string, networkID string, from time.Time, to time.Time, num int) []ircbnc.HistoryTarget {
+	targets := []ircbnc.HistoryTarget{}
+
+	start, end := toMillis(from), toMillis(to)
+	if start > end {
+		start, end = end, start
+	}
+
+	sql := "SELECT buffer, MAX(ts) AS latest FROM messages WHERE uid = ? AND netid = ? AND ts > ? AND ts < ? GROUP BY buffer ORDER BY latest ASC LIMIT ?"
+	rows, err := ds.db.Query(sql, userID, networkID, start, end, num)
+	if err != nil {
+		messagesLog.Error("Query failed", "query", "GetTargets", "error", err)
+		return targets
 	}
+	defer rows.Close()
+
 	for rows.Next() {
-		m := rowToIrcMessage(rows)
-		messages = append(messages, m)
+		var buffer string
+		var latest int64
+		rows.Scan(&buffer, &latest)
+		targets = append(targets, ircbnc.HistoryTarget{
+			Name:       buffer,
+			LatestTime: fromMillis(latest),
+		})
 	}
 
-	// Reverse the messages so they're in order
-	for i := 0; i < len(messages)/2; i++ {
-		j := len(messages) - i - 1
-		messages[i], messages[j] = messages[j], messages[i]
+	return targets
+}
+func (ds *SqliteMessageDatastore) GetMsgidTime(userID string, networkID string, msgid string) (time.Time, bool) {
+	if msgid == "" {
+		return time.Time{}, false
 	}
 
-	return messages
+	var ts int64
+	sql := "SELECT ts FROM messages WHERE uid = ? AND netid = ? AND msgid = ? LIMIT 1"
+	err := ds.db.QueryRow(sql, userID, networkID, msgid).Scan(&ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return fromMillis(ts), true
 }
-func (ds *SqliteMessageDatastore) GetBeforeTime(userID string, networkID string, buffer string, from time.Time, num int) []*ircmsg.IrcMessage {
+func (ds *SqliteMessageDatastore) GetByMsgid(userID string, networkID string, msgid string) (*ircmsg.IrcMessage, bool) {
+	if msgid == "" {
+		return nil, false
+	}
+
+	sql := "SELECT ts, fromNick, type, line, buffer, msgid FROM messages WHERE uid = ? AND netid = ? AND msgid = ? LIMIT 1"
+	messages := ds.queryMessages("GetByMsgid", false, sql, userID, networkID, msgid)
+	if len(messages) == 0 {
+		return nil, false
+	}
+
+	return messages[0], true
+}
+func (ds *SqliteMessageDatastore) Search(userID string, networkID string, buffer string, query string, from time.Time, to time.Time, num int) []*ircmsg.IrcMessage {
+	if strings.TrimSpace(query) == "" {
+		return []*ircmsg.IrcMessage{}
+	}
+
+	if to.IsZero() {
+		to = time.Now().Add(time.Second)
+	}
+
+	var sql string
+	var args []interface{}
+	if ds.fullText {
+		sql = "SELECT m.ts, m.fromNick, m.type, m.line, m.buffer, m.msgid FROM messages_fts JOIN messages m ON m.rowid = messages_fts.rowid WHERE messages_fts MATCH ?"
+		args = append(args, ftsQuery(query))
+	} else {
+		// Every word has to be in the line or the nick it came from
+		sql = "SELECT m.ts, m.fromNick, m.type, m.line, m.buffer, m.msgid FROM messages m WHERE 1 = 1"
+		for _, word := range strings.Fields(query) {
+			sql += ` AND (m.line LIKE ? ESCAPE '\' OR m.fromNick LIKE ? ESCAPE '\')`
+			pattern := "%" + likeEscaper.Replace(word) + "%"
+			args = append(args, pattern, pattern)
+		}
+	}
+	sql += " AND m.uid = ? AND m.netid = ? AND m.ts > ? AND m.ts < ?"
+	args = append(args, userID, networkID, toMillis(from), toMillis(to))
+	if buffer != "" {
+		sql += " AND m.buffer = ?"
+		args = append(args, strings.ToLower(buffer))
+	}
+	sql += " ORDER BY m.ts DESC LIMIT ?"
+	args = append(args, num)
+
+	return ds.queryMessages("Search", true, sql, args...)
+}
+
+// ftsQuery turns a users search into an FTS5 query matching all of its words. Each word
+// is quoted so that FTS5 syntax in the search is treated as plain text.
+func ftsQuery(query string) string {
+	words := strings.Fields(query)
+	for idx, word := range words {
+		words[idx] = `"` + strings.Replace(word, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// likeEscaper stops LIKE treating anything in a search as a wildcard
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// queryMessages runs the given messages query. Queries that select the latest messages
+// first should set reverse so that the messages are returned in order.
+func (ds *SqliteMessageDatastore) queryMessages(caller string, reverse bool, sql string, args ...interface{}) []*ircmsg.IrcMessage {
 	messages := []*ircmsg.IrcMessage{}
 
-	sql := "SELECT ts, fromNick, type, line, buffer FROM messages WHERE uid = ? AND netid = ? AND buffer = ? AND ts < ? ORDER BY ts DESC LIMIT ?"
-	rows, err := ds.db.Query(sql, userID, networkID, strings.ToLower(buffer), int32(from.UTC().Unix()), num)
+	rows, err := ds.db.Query(sql, args...)
 	if err != nil {
-		log.Println("GetBeforeTime() error: " + err.Error())
+		messagesLog.Error("Query failed", "query", caller, "error", err)
 		return messages
 	}
+	defer rows.Close()
+
 	for rows.Next() {
 		m := rowToIrcMessage(rows)
 		messages = append(messages, m)
 	}
 
 	// Reverse the messages so they're in order
-	for i := 0; i < len(messages)/2; i++ {
-		j := len(messages) - i - 1
-		messages[i], messages[j] = messages[j], messages[i]
+	if reverse {
+		for i := 0; i < len(messages)/2; i++ {
+			j := len(messages) - i - 1
+			messages[i], messages[j] = messages[j], messages[i]
+		}
 	}
 
 	return messages
 }
-func (ds *SqliteMessageDatastore) Search(string, string, string, time.Time, time.Time, int) []*ircmsg.IrcMessage {
-	return []*ircmsg.IrcMessage{}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
 }
 
 func rowToIrcMessage(rows *sql.Rows) *ircmsg.IrcMessage {
-	var ts int32
+	var ts int64
 	var from string
 	var messageType int
 	var line string
 	var buffer string
-	rows.Scan(&ts, &from, &messageType, &line, &buffer)
+	var msgid string
+	rows.Scan(&ts, &from, &messageType, &line, &buffer, &msgid)
 
 	v := ircmsg.TagValue{}
-	v.Value = time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+	v.Value = fromMillis(ts).Format(ircbnc.TimestampFormat)
 	v.HasValue = true
 	mTags := make(map[string]ircmsg.TagValue)
 	mTags["time"] = v
+	if msgid != "" {
+		mTags["msgid"] = ircmsg.MakeTagValue(msgid)
+	}
 
 	mPrefix := from
 	mCommand := "PRIVMSG"
@@ -231,7 +498,7 @@ func extractMessageParts(event *ircbnc.HookIrcRaw) (string, string, int, string)
 				from = prefixNick
 			}
 		}
-	} else if event.FromClient && event.Listener.ServerConnection != nil {
+	} else if event.FromClient && event.Server != nil {
 		switch message.Command {
 		case "PRIVMSG":
 			line = message.Params[1]
@@ -245,7 +512,7 @@ func extractMessageParts(event *ircbnc.HookIrcRaw) (string, string, int, string)
 			}
 
 			buffer = message.Params[0]
-			from = event.Listener.ServerConnection.Nickname
+			from = event.Server.Nickname
 
 		case "NOTICE":
 			line = message.Params[1]
@@ -256,7 +523,7 @@ func extractMessageParts(event *ircbnc.HookIrcRaw) (string, string, int, string)
 			}
 
 			buffer = message.Params[0]
-			from = event.Listener.ServerConnection.Nickname
+			from = event.Server.Nickname
 		}
 	}
 
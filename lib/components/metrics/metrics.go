@@ -0,0 +1,203 @@
+package bncComponentMetrics
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/logger"
+	"github.com/goshuirc/bnc/lib/metrics"
+)
+
+var metricsLog = bncLog.New("components.metrics")
+
+func Run(manager *ircbnc.Manager) {
+	metrics := &Metrics{
+		Manager:       manager,
+		authFailures:  make(map[string]*bncMetrics.Counter),
+		reconnects:    make(map[string]*bncMetrics.Counter),
+		networkStates: make(map[string]*bncMetrics.Counter),
+	}
+	metrics.RegisterHooks()
+
+	err := metrics.start(manager.Config.Bouncer.Metrics)
+	if err != nil {
+		metricsLog.Error("Could not start the metrics endpoint", "error", err)
+	}
+}
+
+// Metrics serves the health of the bouncer in the Prometheus text format on /metrics.
+type Metrics struct {
+	Manager *ircbnc.Manager
+
+	serverLock sync.Mutex
+	server     *http.Server
+
+	// counters collected from hooks, by method, user and state
+	countersLock  sync.Mutex
+	authFailures  map[string]*bncMetrics.Counter
+	reconnects    map[string]*bncMetrics.Counter
+	networkStates map[string]*bncMetrics.Counter
+}
+
+func (metrics *Metrics) RegisterHooks() {
+	metrics.Manager.Bus.Register(ircbnc.HookRehashName, metrics.onRehash)
+	metrics.Manager.Bus.Register(ircbnc.HookAuthFailedName, metrics.onAuthFailed)
+	metrics.Manager.Bus.Register(ircbnc.HookReconnectName, metrics.onReconnect)
+	metrics.Manager.Bus.Register(ircbnc.HookNetworkStateName, metrics.onNetworkState)
+}
+
+// Restart the endpoint if its config has changed
+func (metrics *Metrics) onRehash(hook interface{}) {
+	event := hook.(*ircbnc.HookRehash)
+	if reflect.DeepEqual(event.OldConfig.Bouncer.Metrics, event.NewConfig.Bouncer.Metrics) {
+		return
+	}
+
+	metrics.stop()
+	err := metrics.start(event.NewConfig.Bouncer.Metrics)
+	if err != nil {
+		metricsLog.Error("Could not start the metrics endpoint", "error", err)
+	}
+}
+
+func (metrics *Metrics) onAuthFailed(hook interface{}) {
+	event := hook.(*ircbnc.HookAuthFailed)
+	metrics.counter(metrics.authFailures, event.Method).Inc()
+}
+
+func (metrics *Metrics) onReconnect(hook interface{}) {
+	event := hook.(*ircbnc.HookReconnect)
+	metrics.counter(metrics.reconnects, event.Server.User.ID).Inc()
+}
+
+func (metrics *Metrics) onNetworkState(hook interface{}) {
+	event := hook.(*ircbnc.HookNetworkState)
+	metrics.counter(metrics.networkStates, event.State).Inc()
+}
+
+// counter returns the counter for the given label value, creating it if needed
+func (metrics *Metrics) counter(counters map[string]*bncMetrics.Counter, label string) *bncMetrics.Counter {
+	metrics.countersLock.Lock()
+	defer metrics.countersLock.Unlock()
+
+	counter, exists := counters[label]
+	if !exists {
+		counter = &bncMetrics.Counter{}
+		counters[label] = counter
+	}
+	return counter
+}
+
+func (metrics *Metrics) start(config ircbnc.HTTPConfig) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	server, err := ircbnc.ListenHTTP("Metrics", config, mux)
+	if err != nil {
+		return err
+	}
+
+	metrics.serverLock.Lock()
+	metrics.server = server
+	metrics.serverLock.Unlock()
+	return nil
+}
+
+func (metrics *Metrics) stop() {
+	metrics.serverLock.Lock()
+	defer metrics.serverLock.Unlock()
+
+	if metrics.server != nil {
+		metrics.server.Close()
+		metrics.server = nil
+	}
+}
+
+// ServeHTTP writes out every metric
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bncMetrics.NewWriter(w)
+
+	// Upstream connections, worked out from what each user is connected to right now
+	out.Header("bnc_upstreams", "gauge", "Networks each user is connected or disconnected from.")
+	users := metrics.Manager.UserList()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	for _, user := range users {
+		var connected, disconnected int
+		for _, net := range user.NetworkList() {
+			if net.Foo.Connected {
+				connected++
+			} else {
+				disconnected++
+			}
+		}
+		out.Value("bnc_upstreams", bncMetrics.Labels{"user": user.ID, "state": "connected"}, float64(connected))
+		out.Value("bnc_upstreams", bncMetrics.Labels{"user": user.ID, "state": "disconnected"}, float64(disconnected))
+	}
+
+	// Clients attached to us. Ones that haven't logged in yet have an empty user
+	out.Header("bnc_listeners", "gauge", "Clients connected to the bouncer.")
+	listeners := make(map[string]*bncMetrics.Counter)
+	for _, listener := range metrics.Manager.Clients() {
+		userID := ""
+		if listener.User != nil {
+			userID = listener.User.ID
+		}
+		if listeners[userID] == nil {
+			listeners[userID] = &bncMetrics.Counter{}
+		}
+		listeners[userID].Inc()
+	}
+	for _, userID := range sortedKeys(listeners) {
+		out.Value("bnc_listeners", bncMetrics.Labels{"user": userID}, float64(listeners[userID].Value()))
+	}
+
+	out.Header("bnc_lines_total", "counter", "IRC lines read and written.")
+	out.Value("bnc_lines_total", bncMetrics.Labels{"side": "client", "direction": "in"}, float64(bncMetrics.ClientLinesIn.Value()))
+	out.Value("bnc_lines_total", bncMetrics.Labels{"side": "client", "direction": "out"}, float64(bncMetrics.ClientLinesOut.Value()))
+	out.Value("bnc_lines_total", bncMetrics.Labels{"side": "server", "direction": "in"}, float64(bncMetrics.ServerLinesIn.Value()))
+	out.Value("bnc_lines_total", bncMetrics.Labels{"side": "server", "direction": "out"}, float64(bncMetrics.ServerLinesOut.Value()))
+
+	out.Header("bnc_sendq_drops_total", "counter", "Clients disconnected for exceeding their sendq.")
+	out.Value("bnc_sendq_drops_total", nil, float64(bncMetrics.SendQDrops.Value()))
+
+	out.Header("bnc_message_store_queue_depth", "gauge", "Messages waiting to be written to the message store.")
+	out.Value("bnc_message_store_queue_depth", nil, float64(bncMetrics.StoreQueueDepth.Value()))
+
+	out.Header("bnc_message_store_write_seconds", "histogram", "How long writing a message to the message store takes.")
+	out.Histogram("bnc_message_store_write_seconds", nil, bncMetrics.StoreWriteSeconds)
+
+	metrics.countersLock.Lock()
+	defer metrics.countersLock.Unlock()
+
+	out.Header("bnc_reconnect_attempts_total", "counter", "Attempts to reconnect to networks we lost our connection to.")
+	for _, userID := range sortedKeys(metrics.reconnects) {
+		out.Value("bnc_reconnect_attempts_total", bncMetrics.Labels{"user": userID}, float64(metrics.reconnects[userID].Value()))
+	}
+
+	out.Header("bnc_network_state_changes_total", "counter", "Networks starting to connect, registering and disconnecting.")
+	for _, state := range sortedKeys(metrics.networkStates) {
+		out.Value("bnc_network_state_changes_total", bncMetrics.Labels{"state": state}, float64(metrics.networkStates[state].Value()))
+	}
+
+	out.Header("bnc_auth_failures_total", "counter", "Failed logins, by how they were attempted.")
+	for _, method := range sortedKeys(metrics.authFailures) {
+		out.Value("bnc_auth_failures_total", bncMetrics.Labels{"method": method}, float64(metrics.authFailures[method].Value()))
+	}
+}
+
+// sortedKeys returns the keys of a map in order, so that metrics are always written in
+// the same order
+func sortedKeys(counters map[string]*bncMetrics.Counter) []string {
+	keys := make([]string, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -9,8 +9,9 @@ import (
 	"crypto/tls"
 	"errors"
 	"io/ioutil"
-	"log"
+	"time"
 
+	"github.com/goshuirc/bnc/lib/logger"
 	"gopkg.in/yaml.v2"
 )
 
@@ -22,23 +23,109 @@ type TLSListenConfig struct {
 
 // Config returns the TLS certificate assicated with this TLSListenConfig
 func (conf *TLSListenConfig) Config() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	cert, err := conf.Certificate()
 	if err != nil {
-		return nil, errors.New("tls cert+key: invalid pair")
+		return nil, err
 	}
 
 	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		Certificates: []tls.Certificate{*cert},
+		ClientAuth:   tls.RequestClientCert,
 	}, err
 }
 
+// Certificate loads the certificate+key pair of this TLSListenConfig from disk
+func (conf *TLSListenConfig) Certificate() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, errors.New("tls cert+key: invalid pair")
+	}
+
+	return &cert, nil
+}
+
+// ReconnectConfig defines how we retry server connections after they drop
+type ReconnectConfig struct {
+	MinDelay    time.Duration `yaml:"min-delay"`
+	MaxDelay    time.Duration `yaml:"max-delay"`
+	Multiplier  float64
+	Jitter      float64
+	StableAfter time.Duration `yaml:"stable-after"`
+}
+
+// setDefaults fills in any reconnect options that were left out of the config
+func (conf *ReconnectConfig) setDefaults() {
+	if conf.MinDelay <= 0 {
+		conf.MinDelay = 10 * time.Second
+	}
+	if conf.MaxDelay <= 0 {
+		conf.MaxDelay = 10 * time.Minute
+	}
+	if conf.MaxDelay < conf.MinDelay {
+		conf.MaxDelay = conf.MinDelay
+	}
+	if conf.Multiplier < 1 {
+		conf.Multiplier = 2
+	}
+	if conf.Jitter < 0 || conf.Jitter > 1 {
+		conf.Jitter = 0.2
+	}
+	if conf.StableAfter <= 0 {
+		conf.StableAfter = 5 * time.Minute
+	}
+}
+
+// UpstreamConfig defines how long we wait on the networks we connect to
+type UpstreamConfig struct {
+	// DialTimeout is how long connecting, including the TLS handshake, may take
+	DialTimeout time.Duration `yaml:"dial-timeout"`
+	// PingInterval is how often we PING networks to check they're there and measure lag
+	PingInterval time.Duration `yaml:"ping-interval"`
+	// PingTimeout is how long after a PING we give up on a network that's gone quiet
+	PingTimeout time.Duration `yaml:"ping-timeout"`
+}
+
+// setDefaults fills in any upstream options that were left out of the config
+func (conf *UpstreamConfig) setDefaults() {
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = 30 * time.Second
+	}
+	if conf.PingInterval <= 0 {
+		conf.PingInterval = time.Minute
+	}
+	if conf.PingTimeout <= 0 {
+		conf.PingTimeout = 2 * time.Minute
+	}
+}
+
+// HTTPConfig sets up an HTTP server, such as the API or metrics
+type HTTPConfig struct {
+	// Listen is the address to listen on. The server is turned off if it's empty
+	Listen string
+	TLS    *TLSListenConfig
+}
+
 // Config defines a configuration file for GoshuBNC
 type Config struct {
+	// Filename is the file this config was loaded from, so that it can be rehashed
+	Filename string `yaml:"-"`
+
 	Bouncer struct {
 		Storage      map[string]string
 		Listeners    []string
 		TLSListeners map[string]*TLSListenConfig `yaml:"tls-listeners"`
-		Logging      map[string]string
+		// WebSocketListeners are for browser clients, using TLS if they're in TLSListeners
+		WebSocketListeners []string `yaml:"websocket-listeners"`
+		Logging            map[string]string
+		Reconnect          ReconnectConfig
+		Upstream           UpstreamConfig
+		QuitMessage        string `yaml:"quit-message"`
+		// PlaybackLines is the most lines played back per buffer when a client attaches
+		PlaybackLines int `yaml:"playback-lines"`
+		HTTP          HTTPConfig
+		Metrics       HTTPConfig
+		// Log is where the bouncer's own log goes, unlike Logging which is for chat logs
+		Log bncLog.Config
 	}
 }
 
@@ -48,7 +135,7 @@ func (conf *Config) TLSListeners() map[string]*tls.Config {
 	for s, tlsListenersConf := range conf.Bouncer.TLSListeners {
 		config, err := tlsListenersConf.Config()
 		if err != nil {
-			log.Fatal(err)
+			coreLog.Fatal("Could not load TLS config", "address", s, "error", err)
 		}
 		tlsListeners[s] = config
 	}
@@ -70,5 +157,16 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if len(config.Bouncer.Listeners) == 0 {
 		return nil, errors.New("No listeners are defined")
 	}
+
+	config.Filename = filename
+	config.Bouncer.Reconnect.setDefaults()
+	config.Bouncer.Upstream.setDefaults()
+	if config.Bouncer.QuitMessage == "" {
+		config.Bouncer.QuitMessage = "GoshuBNC is shutting down"
+	}
+	if config.Bouncer.PlaybackLines <= 0 {
+		config.Bouncer.PlaybackLines = 50
+	}
+
 	return config, nil
 }
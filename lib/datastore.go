@@ -1,5 +1,11 @@
 package ircbnc
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 type DataStoreInterface interface {
 	Init(manager *Manager) error
 	Setup() error
@@ -7,9 +13,62 @@ type DataStoreInterface interface {
 	GetUserById(id string) *User
 	GetUserByUsername(username string) *User
 	SaveUser(*User) error
+	// DelUser removes the user and all of their networks
+	DelUser(*User) error
 	SetUserPassword(user *User, newPassword string)
 	AuthUser(username string, password string) (authedUserId string, authSuccess bool)
+	AuthUserByCertFP(certfp string) (authedUserId string, authSuccess bool)
 	GetUserNetworks(userId string)
 	SaveConnection(connection *ServerConnection) error
 	DelConnection(connection *ServerConnection) error
+	// GetClientPosition returns when the named client last detached from a network
+	GetClientPosition(userID string, networkID string, clientID string) (time.Time, bool)
+	SaveClientPosition(userID string, networkID string, clientID string, seen time.Time) error
+	// GetClientPositions returns when each client last detached from a network
+	GetClientPositions(userID string, networkID string) map[string]time.Time
+	// GetSalt and SetSalt get and replace the bouncer-wide salt that passwords are hashed with
+	GetSalt() []byte
+	SetSalt(salt []byte) error
+	Close() error
+}
+
+// CopyDataStore copies every user, their networks and the bouncer's salt from one datastore
+// into another so that existing passwords keep working. The destination must be empty.
+func CopyDataStore(from DataStoreInterface, to DataStoreInterface) error {
+	if len(to.GetAllUsers()) > 0 {
+		return errors.New("The destination storage already has users in it")
+	}
+
+	salt := from.GetSalt()
+	if len(salt) == 0 {
+		return errors.New("The source storage has not been set up")
+	}
+
+	err := to.SetSalt(salt)
+	if err != nil {
+		return fmt.Errorf("Could not copy the salt: %s", err.Error())
+	}
+
+	for _, user := range from.GetAllUsers() {
+		err = to.SaveUser(user)
+		if err != nil {
+			return fmt.Errorf("Could not copy user %s: %s", user.ID, err.Error())
+		}
+
+		for _, network := range user.Networks {
+			err = to.SaveConnection(network)
+			if err != nil {
+				return fmt.Errorf("Could not copy network %s of user %s: %s", network.Name, user.ID, err.Error())
+			}
+
+			for clientID, seen := range from.GetClientPositions(user.ID, network.Name) {
+				err = to.SaveClientPosition(user.ID, network.Name, clientID, seen)
+				if err != nil {
+					return fmt.Errorf("Could not copy client %s of user %s: %s", clientID, user.ID, err.Error())
+				}
+			}
+		}
+	}
+
+	return nil
 }
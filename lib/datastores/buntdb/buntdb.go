@@ -5,14 +5,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/logger"
 	"github.com/tidwall/buntdb"
 )
 
+var dsLog = bncLog.New("datastore")
+
 type DataStore struct {
 	ircbnc.DataStoreInterface
 	Db      *buntdb.DB
@@ -37,6 +40,11 @@ func (ds *DataStore) Init(manager *ircbnc.Manager) error {
 
 	ds.Db = db
 
+	err = checkSchema(db, dbPath)
+	if err != nil {
+		return err
+	}
+
 	err = ds.LoadSalt()
 	if err != nil {
 		return errors.New("Could not initialize database: " + err.Error())
@@ -44,9 +52,17 @@ func (ds *DataStore) Init(manager *ircbnc.Manager) error {
 	return nil
 }
 
+// Close closes the database, making sure everything has been written to disk.
+func (ds *DataStore) Close() error {
+	if ds.Db == nil {
+		return nil
+	}
+	return ds.Db.Close()
+}
+
 func (ds *DataStore) Setup() error {
 	// generate bouncer salt
-	bncSalt := NewSalt()
+	bncSalt := ircbnc.NewSalt()
 	encodedBncSalt := base64.StdEncoding.EncodeToString(bncSalt)
 	err := ds.Db.Update(func(tx *buntdb.Tx) error {
 		tx.Set(KeySalt, encodedBncSalt, nil)
@@ -58,6 +74,24 @@ func (ds *DataStore) Setup() error {
 	return err
 }
 
+func (ds *DataStore) GetSalt() []byte {
+	return ds.salt
+}
+
+func (ds *DataStore) SetSalt(salt []byte) error {
+	encodedSalt := base64.StdEncoding.EncodeToString(salt)
+	err := ds.Db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(KeySalt, encodedSalt, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ds.salt = salt
+	return nil
+}
+
 func (ds *DataStore) LoadSalt() error {
 	err := ds.Db.View(func(tx *buntdb.Tx) error {
 		saltString, err := tx.Get(KeySalt)
@@ -92,7 +126,7 @@ func (ds *DataStore) GetAllUsers() []*ircbnc.User {
 		for _, userId := range userIds {
 			user, err := ds.loadUser(tx, userId)
 			if err != nil {
-				log.Println("Error loading user " + userId)
+				dsLog.Error("Could not load user", "user", userId)
 				continue
 			}
 			users = append(users, user)
@@ -127,6 +161,16 @@ func (ds *DataStore) SaveUser(user *ircbnc.User) error {
 	ui.Role = user.Role
 	ui.EncodedSalt = base64.StdEncoding.EncodeToString(user.Salt)
 	ui.EncodedPasswordHash = base64.StdEncoding.EncodeToString(user.HashedPassword)
+	ui.CertFPs = user.CertFPs
+	ui.MultiNetwork = user.MultiNetwork
+	ui.Disabled = user.Disabled
+	for _, apiToken := range user.APITokens {
+		ui.APITokens = append(ui.APITokens, APITokenMapping{
+			Name:    apiToken.Name,
+			Hash:    apiToken.Hash,
+			Created: apiToken.Created.Unix(),
+		})
+	}
 	ui.DefaultNick = user.DefaultNick
 	ui.DefaultNickFallback = user.DefaultFbNick
 	ui.DefaultUsername = user.DefaultUser
@@ -135,6 +179,8 @@ func (ds *DataStore) SaveUser(user *ircbnc.User) error {
 	// Just use the username as the ID
 	if user.ID == "" {
 		ui.ID = strings.ToLower(user.Name)
+	} else {
+		ui.ID = user.ID
 	}
 
 	uiBytes, err := json.Marshal(ui)
@@ -169,13 +215,46 @@ func (ds *DataStore) SaveUser(user *ircbnc.User) error {
 	return updateErr
 }
 
+func (ds *DataStore) DelUser(user *ircbnc.User) error {
+	return ds.Db.Update(func(tx *buntdb.Tx) error {
+		keys := []string{
+			fmt.Sprintf(KeyUserInfo, user.ID),
+			fmt.Sprintf(KeyUserPermissions, user.ID),
+		}
+
+		// Along with everything stored for each of their networks
+		for _, keyFormat := range []string{KeyServerConnectionInfo, KeyServerConnectionAddresses, KeyServerConnectionBuffers} {
+			tx.AscendKeys(fmt.Sprintf(keyFormat, user.ID, "*"), func(key, value string) bool {
+				keys = append(keys, key)
+				return true
+			})
+		}
+		tx.AscendKeys(fmt.Sprintf(KeyClientPosition, user.ID, "*", "*"), func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+
+		for _, key := range keys {
+			_, err := tx.Delete(key)
+			if err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (ds *DataStore) AuthUser(username string, password string) (string, bool) {
 	user := ds.GetUserByUsername(username)
 	if user == nil {
 		return "", false
 	}
 
-	passMatches := CompareHashAndPassword(user.HashedPassword, ds.salt, user.Salt, password)
+	if user.Disabled {
+		return "", false
+	}
+
+	passMatches := ircbnc.CompareHashAndPassword(user.HashedPassword, ds.salt, user.Salt, password)
 	if !passMatches {
 		return "", false
 	}
@@ -183,9 +262,38 @@ func (ds *DataStore) AuthUser(username string, password string) (string, bool) {
 	return user.ID, true
 }
 
+func (ds *DataStore) AuthUserByCertFP(certfp string) (string, bool) {
+	certfp = ircbnc.NormaliseCertFP(certfp)
+	if certfp == "" {
+		return "", false
+	}
+
+	authedUserId := ""
+	ds.Db.View(func(tx *buntdb.Tx) error {
+		tx.AscendKeys("user.info *", func(key, value string) bool {
+			ui := &UserInfo{}
+			err := json.Unmarshal([]byte(value), ui)
+			if err != nil || ui.Disabled {
+				return true
+			}
+
+			for _, userCertfp := range ui.CertFPs {
+				if userCertfp == certfp {
+					authedUserId = ui.ID
+					return false
+				}
+			}
+			return true
+		})
+		return nil
+	})
+
+	return authedUserId, authedUserId != ""
+}
+
 func (ds *DataStore) SetUserPassword(user *ircbnc.User, newPassword string) {
-	userSalt := NewSalt()
-	passHash, _ := GenerateFromPassword(ds.salt, userSalt, newPassword)
+	userSalt := ircbnc.NewSalt()
+	passHash, _ := ircbnc.GenerateFromPassword(ds.salt, userSalt, newPassword)
 
 	user.Salt = userSalt
 	user.HashedPassword = passHash
@@ -196,11 +304,77 @@ func (ds *DataStore) GetUserNetworks(userId string) {
 }
 
 func (ds *DataStore) DelConnection(connection *ircbnc.ServerConnection) error {
-	ds.Db.Update(func(tx *buntdb.Tx) error {
-		tx.Delete(fmt.Sprintf(KeyServerConnectionInfo, connection.User.ID, connection.Name))
+	return ds.Db.Update(func(tx *buntdb.Tx) error {
+		keys := []string{
+			fmt.Sprintf(KeyServerConnectionInfo, connection.User.ID, connection.Name),
+			fmt.Sprintf(KeyServerConnectionAddresses, connection.User.ID, connection.Name),
+			fmt.Sprintf(KeyServerConnectionBuffers, connection.User.ID, connection.Name),
+		}
+
+		// Forget where each client was up to on this network
+		tx.AscendKeys(fmt.Sprintf(KeyClientPosition, connection.User.ID, connection.Name, "*"), func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+
+		for _, key := range keys {
+			_, err := tx.Delete(key)
+			if err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+
 		return nil
 	})
-	return nil
+}
+
+func (ds *DataStore) GetClientPosition(userID string, networkID string, clientID string) (time.Time, bool) {
+	var seen time.Time
+	found := false
+
+	ds.Db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf(KeyClientPosition, userID, networkID, clientID))
+		if err != nil {
+			return err
+		}
+
+		millis, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		seen = time.Unix(0, millis*int64(time.Millisecond)).UTC()
+		found = true
+		return nil
+	})
+
+	return seen, found
+}
+
+func (ds *DataStore) GetClientPositions(userID string, networkID string) map[string]time.Time {
+	positions := make(map[string]time.Time)
+	prefix := fmt.Sprintf(KeyClientPosition, userID, networkID, "")
+
+	ds.Db.View(func(tx *buntdb.Tx) error {
+		tx.AscendKeys(prefix+"*", func(key, value string) bool {
+			millis, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				positions[strings.TrimPrefix(key, prefix)] = time.Unix(0, millis*int64(time.Millisecond)).UTC()
+			}
+			return true
+		})
+		return nil
+	})
+
+	return positions
+}
+
+func (ds *DataStore) SaveClientPosition(userID string, networkID string, clientID string, seen time.Time) error {
+	millis := seen.UnixNano() / int64(time.Millisecond)
+	return ds.Db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(KeyClientPosition, userID, networkID, clientID), strconv.FormatInt(millis, 10), nil)
+		return err
+	})
 }
 
 func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
@@ -213,6 +387,12 @@ func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
 		NicknameFallback: connection.FbNickname,
 		Username:         connection.Username,
 		Realname:         connection.Realname,
+		SaslMechanism:    connection.SaslMechanism,
+		SaslAccount:      connection.SaslAccount,
+		SaslPassword:     connection.SaslPassword,
+		BindHost:         connection.BindHost,
+		AddressFamily:    connection.AddressFamily,
+		ClientCert:       connection.ClientCert,
 	}
 	scBytes, err := json.Marshal(sc)
 	if err != nil {
@@ -227,6 +407,8 @@ func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
 		addresses[idx].Port = addr.Port
 		addresses[idx].UseTLS = addr.UseTLS
 		addresses[idx].VerifyTLS = addr.VerifyTLS
+		addresses[idx].Proxy = addr.Proxy
+		addresses[idx].Fingerprint = addr.Fingerprint
 	}
 
 	saBytes, err := json.Marshal(addresses)
@@ -238,13 +420,17 @@ func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
 	// Store server channels (Convert the string map to a slice)
 	scChannels := []*ServerConnectionBufferMapping{}
 	for _, channel := range connection.Buffers {
-		scChannels = append(scChannels, &ServerConnectionBufferMapping{
-			Name:     channel.Name,
-			Channel:  channel.Channel,
-			Key:      channel.Key,
-			UseKey:   channel.UseKey,
-			LastSeen: channel.LastSeen.Unix(),
-		})
+		mapping := &ServerConnectionBufferMapping{
+			Name:    channel.Name,
+			Channel: channel.Channel,
+			Key:     channel.Key,
+			UseKey:  channel.UseKey,
+		}
+		if !channel.LastSeen.IsZero() {
+			mapping.LastSeen = channel.LastSeen.Unix()
+			mapping.LastSeenMillis = channel.LastSeen.UnixNano() / int64(time.Millisecond)
+		}
+		scChannels = append(scChannels, mapping)
 	}
 	scChanBytes, err := json.Marshal(scChannels)
 	if err != nil {
@@ -296,8 +482,27 @@ func (ds *DataStore) loadUser(tx *buntdb.Tx, userId string) (*ircbnc.User, error
 		return nil, fmt.Errorf("Could not load user (decoding password): %s", err.Error())
 	}
 
+	// Users saved before permissions were checked may not have any
+	permissionsString, err := tx.Get(fmt.Sprintf(KeyUserPermissions, userId))
+	if err == nil {
+		err = json.Unmarshal([]byte(permissionsString), &user.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load user (unmarshalling permissions from db): %s", err.Error())
+		}
+	}
+
 	user.ID = ui.ID
 	user.Name = ui.Name
+	user.CertFPs = ui.CertFPs
+	user.MultiNetwork = ui.MultiNetwork
+	user.Disabled = ui.Disabled
+	for _, apiToken := range ui.APITokens {
+		user.APITokens = append(user.APITokens, ircbnc.APIToken{
+			Name:    apiToken.Name,
+			Hash:    apiToken.Hash,
+			Created: time.Unix(apiToken.Created, 0).UTC(),
+		})
+	}
 	user.Role = ui.Role
 	user.DefaultNick = ui.DefaultNick
 	user.DefaultFbNick = ui.DefaultNickFallback
@@ -316,7 +521,7 @@ func (ds *DataStore) loadUserConnections(user *ircbnc.User) {
 
 			sc, err := loadServerConnection(name, user, tx)
 			if err != nil {
-				log.Printf("Could not load user network: %s", err.Error())
+				dsLog.Error("Could not load user network", "user", user.ID, "error", err)
 				return false
 			}
 
@@ -353,6 +558,12 @@ func loadServerConnection(name string, user *ircbnc.User, tx *buntdb.Tx) (*ircbn
 	sc.Username = scInfo.Username
 	sc.Realname = scInfo.Realname
 	sc.Password = scInfo.ConnectPassword
+	sc.SaslMechanism = scInfo.SaslMechanism
+	sc.SaslAccount = scInfo.SaslAccount
+	sc.SaslPassword = scInfo.SaslPassword
+	sc.BindHost = scInfo.BindHost
+	sc.AddressFamily = scInfo.AddressFamily
+	sc.ClientCert = scInfo.ClientCert
 
 	// set default values
 	if sc.Nickname == "" {
@@ -381,12 +592,20 @@ func loadServerConnection(name string, user *ircbnc.User, tx *buntdb.Tx) (*ircbn
 	}
 
 	for _, channel := range *scChans {
+		// Buffers that have never been read shouldn't be marked as read in 1970
+		var lastSeen time.Time
+		if channel.LastSeenMillis != 0 {
+			lastSeen = time.Unix(0, channel.LastSeenMillis*int64(time.Millisecond))
+		} else if channel.LastSeen > 0 {
+			lastSeen = time.Unix(channel.LastSeen, 0)
+		}
+
 		sc.Buffers.Add(&ircbnc.ServerConnectionBuffer{
 			Channel:  channel.Channel,
 			Name:     channel.Name,
 			Key:      channel.Key,
 			UseKey:   channel.UseKey,
-			LastSeen: time.Unix(channel.LastSeen, 0),
+			LastSeen: lastSeen.UTC(),
 		})
 	}
 
@@ -6,10 +6,15 @@ package bncDataStoreBuntdb
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/goshuirc/bnc/lib"
 	"github.com/tidwall/buntdb"
 )
 
@@ -17,7 +22,7 @@ const (
 	// 'version' of the database schema
 	keySchemaVersion = "db.version"
 	// latest schema of the db
-	latestDbSchema = "1"
+	latestDbSchema = 4
 	// key for the primary salt used by the ircd
 	KeySalt = "crypto.salt"
 
@@ -29,6 +34,8 @@ const (
 	KeyServerConnectionInfo      = "user.server.info %s %s"
 	KeyServerConnectionAddresses = "user.server.addresses %s %s"
 	KeyServerConnectionBuffers   = "user.server.channels %s %s"
+	// KeyClientPosition stores when a user's client last detached from a network
+	KeyClientPosition = "user.server.client %s %s %s"
 )
 
 // these are types used to store information in / retrieve information from the database
@@ -38,12 +45,23 @@ type UserInfo struct {
 	ID                  string
 	Name                string `json:"username"`
 	Role                string
-	EncodedSalt         string `json:"salt"`
-	EncodedPasswordHash string `json:"hash"`
-	DefaultNick         string `json:"default-nick"`
-	DefaultNickFallback string `json:"default-nick-fallback"`
-	DefaultUsername     string `json:"default-username"`
-	DefaultRealname     string `json:"default-realname"`
+	EncodedSalt         string            `json:"salt"`
+	EncodedPasswordHash string            `json:"hash"`
+	CertFPs             []string          `json:"certfps"`
+	DefaultNick         string            `json:"default-nick"`
+	DefaultNickFallback string            `json:"default-nick-fallback"`
+	DefaultUsername     string            `json:"default-username"`
+	DefaultRealname     string            `json:"default-realname"`
+	MultiNetwork        bool              `json:"multi-network,omitempty"`
+	Disabled            bool              `json:"disabled,omitempty"`
+	APITokens           []APITokenMapping `json:"api-tokens,omitempty"`
+}
+
+// APITokenMapping maps APIToken to its JSON structure
+type APITokenMapping struct {
+	Name    string
+	Hash    string
+	Created int64
 }
 
 // UserPermissions is a list of permissions the user has access to
@@ -58,14 +76,22 @@ type ServerConnectionMapping struct {
 	NicknameFallback string
 	Username         string
 	Realname         string
+	SaslMechanism    string `json:"sasl-mechanism"`
+	SaslAccount      string `json:"sasl-account"`
+	SaslPassword     string `json:"sasl-password"`
+	BindHost         string `json:"bind-host,omitempty"`
+	AddressFamily    string `json:"address-family,omitempty"`
+	ClientCert       string `json:"client-cert,omitempty"`
 }
 
 // ServerConnectionAddressMapping maps ServerConnectionAddress to its JSON structure
 type ServerConnectionAddressMapping struct {
-	Host      string
-	Port      int
-	UseTLS    bool `json:"use-tls"`
-	VerifyTLS bool `json:"verify-tls"`
+	Host        string
+	Port        int
+	UseTLS      bool   `json:"use-tls"`
+	VerifyTLS   bool   `json:"verify-tls"`
+	Proxy       string `json:"proxy,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
 }
 
 // ServerConnectionBufferMapping maps ServerConnectionBuffer to its JSON structure
@@ -75,6 +101,16 @@ type ServerConnectionBufferMapping struct {
 	Key      string
 	UseKey   bool  `json:"use_key"`
 	LastSeen int64 `json:"last_seen"`
+	// LastSeenMillis keeps read markers accurate to the millisecond like message timestamps
+	LastSeenMillis int64 `json:"last_seen_ms,omitempty"`
+}
+
+// dbUpgrades take the database schema up one version at a time, dbUpgrades[0] upgrading
+// version 1 to version 2. Each one runs in its own transaction.
+var dbUpgrades = []func(tx *buntdb.Tx) error{
+	upgradeBufferLastSeenMillis,
+	upgradeStripUserWildcard,
+	upgradeVerifyTLS,
 }
 
 // InitDB creates the database.
@@ -84,48 +120,263 @@ func InitDB(path string) {
 	os.Remove(path)
 	store, err := buntdb.Open(path)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Failed to open datastore: %s", err.Error()))
+		dsLog.Fatal("Could not open datastore", "error", err)
 	}
 	defer store.Close()
 
 	err = store.Update(func(tx *buntdb.Tx) error {
 		// set base db salt
-		salt := NewSalt()
+		salt := ircbnc.NewSalt()
 		encodedSalt := base64.StdEncoding.EncodeToString(salt)
-		if err != nil {
-			log.Fatal("Could not generate cryptographically-secure salt for the database:", err.Error())
-		}
 		tx.Set(KeySalt, encodedSalt, nil)
 
 		// set schema version
-		tx.Set(keySchemaVersion, latestDbSchema, nil)
-		return nil
+		return setSchemaVersion(tx, latestDbSchema)
 	})
 
 	if err != nil {
-		log.Fatal("Could not save datastore:", err.Error())
+		dsLog.Fatal("Could not save datastore", "error", err)
+	}
+}
+
+// schemaVersion returns the schema version of the database. Databases from before the
+// version was stored are version 1, and empty databases are the latest version.
+func schemaVersion(tx *buntdb.Tx) (int, error) {
+	version, err := tx.Get(keySchemaVersion)
+	if err == buntdb.ErrNotFound {
+		_, saltErr := tx.Get(KeySalt)
+		if saltErr == buntdb.ErrNotFound {
+			return latestDbSchema, nil
+		}
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(version)
+}
+
+func setSchemaVersion(tx *buntdb.Tx, version int) error {
+	_, _, err := tx.Set(keySchemaVersion, strconv.Itoa(version), nil)
+	return err
+}
+
+// checkSchema makes sure the database is on the latest schema, backing it up and
+// upgrading it if it's older. Databases from a newer version of GoshuBNC are refused.
+func checkSchema(db *buntdb.DB, path string) error {
+	var version int
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not read the database schema version: %s", err.Error())
+	}
+
+	if version > latestDbSchema {
+		return fmt.Errorf("The database schema is version %d but this version of GoshuBNC only knows up to %d, please upgrade GoshuBNC", version, latestDbSchema)
+	}
+
+	if version < latestDbSchema {
+		backupPath, err := backupDB(db, path, version)
+		if err != nil {
+			return fmt.Errorf("Could not back up the database before upgrading it: %s", err.Error())
+		}
+		dsLog.Info("Backed up the database before upgrading it", "backup", backupPath)
+	}
+
+	// Stores that have never had a version are given one even if nothing needs to change
+	return upgradeDB(db, version)
+}
+
+// backupDB writes a copy of the database next to it, named after its schema version
+func backupDB(db *buntdb.DB, path string, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102-150405"))
+	file, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
 	}
+
+	err = db.Save(file)
+	if err != nil {
+		file.Close()
+		os.Remove(backupPath)
+		return "", err
+	}
+
+	return backupPath, file.Close()
 }
 
-// UpgradeDB upgrades the datastore to the latest schema.
-func UpgradeDB(path string) {
+// upgradeDB runs each of the upgrades the database needs, in order
+func upgradeDB(db *buntdb.DB, version int) error {
+	for ; version < latestDbSchema; version++ {
+		err := db.Update(func(tx *buntdb.Tx) error {
+			err := dbUpgrades[version-1](tx)
+			if err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, version+1)
+		})
+		if err != nil {
+			return fmt.Errorf("Could not upgrade the database to version %d: %s", version+1, err.Error())
+		}
+		dsLog.Info("Upgraded the database", "version", version+1)
+	}
+
+	// Databases from before the version was stored don't have one yet
+	return db.Update(func(tx *buntdb.Tx) error {
+		return setSchemaVersion(tx, version)
+	})
+}
+
+// UpgradeDB backs up the datastore and upgrades it to the latest schema.
+func UpgradeDB(path string) error {
+	if path == "" {
+		return errors.New("No database file has been configured")
+	}
+
 	store, err := buntdb.Open(path)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Failed to open datastore: %s", err.Error()))
+		return fmt.Errorf("Failed to open datastore: %s", err.Error())
 	}
 	defer store.Close()
 
-	err = store.Update(func(tx *buntdb.Tx) error {
-		version, _ := tx.Get(keySchemaVersion)
+	return checkSchema(store, path)
+}
 
-		// datastore upgrading code here
-		fmt.Println("db version is", version, "but no upgrading code is written yet")
+// upgradeBufferLastSeenMillis stores each buffer's read marker in milliseconds, which
+// older versions only stored in seconds.
+func upgradeBufferLastSeenMillis(tx *buntdb.Tx) error {
+	updated := make(map[string]string)
+
+	err := tx.AscendKeys("user.server.channels *", func(key, value string) bool {
+		buffers := []ServerConnectionBufferMapping{}
+		if json.Unmarshal([]byte(value), &buffers) != nil {
+			return true
+		}
 
-		return nil
+		for idx, buffer := range buffers {
+			if buffer.LastSeenMillis == 0 && buffer.LastSeen > 0 {
+				buffers[idx].LastSeenMillis = buffer.LastSeen * 1000
+			}
+		}
+
+		buffersBytes, err := json.Marshal(buffers)
+		if err == nil {
+			updated[key] = string(buffersBytes)
+		}
+		return true
 	})
 	if err != nil {
-		log.Fatal("Could not update datastore:", err.Error())
+		return err
+	}
+
+	// Keys can't be changed while iterating over them
+	for key, value := range updated {
+		_, _, err = tx.Set(key, value, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upgradeStripUserWildcard takes the "*" permission away from users who aren't owners.
+// Older versions gave it to every user they created, but permissions weren't checked
+// then, and keeping it would make them all admins.
+func upgradeStripUserWildcard(tx *buntdb.Tx) error {
+	updated := make(map[string]string)
+
+	err := tx.AscendKeys("user.info *", func(key, value string) bool {
+		var info UserInfo
+		if json.Unmarshal([]byte(value), &info) != nil || info.Role == ircbnc.RoleOwner {
+			return true
+		}
+
+		// The key holds the ID even for users saved before it was stored in the info
+		permissionsKey := fmt.Sprintf(KeyUserPermissions, strings.TrimPrefix(key, "user.info "))
+		permissionsString, err := tx.Get(permissionsKey)
+		if err != nil {
+			return true
+		}
+		var permissions UserPermissions
+		if json.Unmarshal([]byte(permissionsString), &permissions) != nil {
+			return true
+		}
+
+		kept := UserPermissions{}
+		for _, permission := range permissions {
+			if permission != "*" {
+				kept = append(kept, permission)
+			}
+		}
+		if len(kept) == len(permissions) {
+			return true
+		}
+
+		keptBytes, err := json.Marshal(kept)
+		if err == nil {
+			updated[permissionsKey] = string(keptBytes)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keys can't be changed while iterating over them
+	for key, value := range updated {
+		_, _, err = tx.Set(key, value, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upgradeVerifyTLS turns certificate verification on for every TLS address. Older
+// versions didn't verify certificates by default, and without verification the first
+// certificate we see would now be trusted without asking.
+func upgradeVerifyTLS(tx *buntdb.Tx) error {
+	updated := make(map[string]string)
+
+	err := tx.AscendKeys("user.server.addresses *", func(key, value string) bool {
+		var addresses []ServerConnectionAddressMapping
+		if json.Unmarshal([]byte(value), &addresses) != nil {
+			return true
+		}
+
+		changed := false
+		for i := range addresses {
+			if addresses[i].UseTLS && !addresses[i].VerifyTLS {
+				addresses[i].VerifyTLS = true
+				changed = true
+			}
+		}
+		if !changed {
+			return true
+		}
+
+		addressesBytes, err := json.Marshal(addresses)
+		if err == nil {
+			updated[key] = string(addressesBytes)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keys can't be changed while iterating over them
+	for key, value := range updated {
+		_, _, err = tx.Set(key, value, nil)
+		if err != nil {
+			return err
+		}
 	}
 
-	return
+	return nil
 }
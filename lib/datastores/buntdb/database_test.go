@@ -0,0 +1,196 @@
+package bncDataStoreBuntdb
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+// openTestDB opens an in-memory database holding the given keys
+func openTestDB(t *testing.T, keys map[string]string) *buntdb.DB {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatalf("Could not open the database: %s", err.Error())
+	}
+
+	err = db.Update(func(tx *buntdb.Tx) error {
+		for key, value := range keys {
+			_, _, err := tx.Set(key, value, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not fill the database: %s", err.Error())
+	}
+
+	return db
+}
+
+// checkKeys checks that the database holds the given JSON values
+func checkKeys(t *testing.T, db *buntdb.DB, name string, keys map[string]string) {
+	db.View(func(tx *buntdb.Tx) error {
+		for key, want := range keys {
+			value, err := tx.Get(key)
+			if err != nil {
+				t.Errorf("%s: could not get %s: %s", name, key, err.Error())
+				continue
+			}
+
+			var got, wanted interface{}
+			json.Unmarshal([]byte(value), &got)
+			json.Unmarshal([]byte(want), &wanted)
+			if !reflect.DeepEqual(got, wanted) {
+				t.Errorf("%s: %s is %s, want %s", name, key, value, want)
+			}
+		}
+		return nil
+	})
+}
+
+func TestDbUpgrades(t *testing.T) {
+	tests := []struct {
+		name    string
+		upgrade func(tx *buntdb.Tx) error
+		before  map[string]string
+		after   map[string]string
+	}{
+		{
+			name:    "upgradeBufferLastSeenMillis",
+			upgrade: upgradeBufferLastSeenMillis,
+			before: map[string]string{
+				"user.server.channels dan freenode": `[{"Channel":true,"Name":"#chan","Key":"","use_key":false,"last_seen":1546612406},{"Channel":false,"Name":"ed","Key":"","use_key":false,"last_seen":0}]`,
+				"user.server.channels dan oftc":     `[{"Channel":true,"Name":"#new","Key":"","use_key":false,"last_seen":1546612406,"last_seen_ms":1546612406123}]`,
+			},
+			after: map[string]string{
+				"user.server.channels dan freenode": `[{"Channel":true,"Name":"#chan","Key":"","use_key":false,"last_seen":1546612406,"last_seen_ms":1546612406000},{"Channel":false,"Name":"ed","Key":"","use_key":false,"last_seen":0}]`,
+				"user.server.channels dan oftc":     `[{"Channel":true,"Name":"#new","Key":"","use_key":false,"last_seen":1546612406,"last_seen_ms":1546612406123}]`,
+			},
+		},
+		{
+			name:    "upgradeStripUserWildcard",
+			upgrade: upgradeStripUserWildcard,
+			before: map[string]string{
+				"user.info dan":        `{"ID":"dan","username":"dan","Role":"Owner"}`,
+				"user.permissions dan": `["*"]`,
+				"user.info ed":         `{"ID":"ed","username":"ed","Role":"User"}`,
+				"user.permissions ed":  `["*","raw.send"]`,
+				"user.info old":        `{"username":"old"}`,
+				"user.permissions old": `["*"]`,
+			},
+			after: map[string]string{
+				"user.permissions dan": `["*"]`,
+				"user.permissions ed":  `["raw.send"]`,
+				"user.permissions old": `[]`,
+			},
+		},
+		{
+			name:    "upgradeVerifyTLS",
+			upgrade: upgradeVerifyTLS,
+			before: map[string]string{
+				"user.server.addresses dan freenode": `[{"Host":"irc.freenode.net","Port":6697,"use-tls":true,"verify-tls":false},{"Host":"irc.freenode.net","Port":6667,"use-tls":false,"verify-tls":false}]`,
+				"user.server.addresses dan oftc":     `[{"Host":"irc.oftc.net","Port":6697,"use-tls":true,"verify-tls":true}]`,
+			},
+			after: map[string]string{
+				"user.server.addresses dan freenode": `[{"Host":"irc.freenode.net","Port":6697,"use-tls":true,"verify-tls":true},{"Host":"irc.freenode.net","Port":6667,"use-tls":false,"verify-tls":false}]`,
+				"user.server.addresses dan oftc":     `[{"Host":"irc.oftc.net","Port":6697,"use-tls":true,"verify-tls":true}]`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		db := openTestDB(t, test.before)
+		err := db.Update(test.upgrade)
+		if err != nil {
+			t.Errorf("%s returned an error: %s", test.name, err.Error())
+		}
+		checkKeys(t, db, test.name, test.after)
+		db.Close()
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	tests := []struct {
+		keys    map[string]string
+		version int
+	}{
+		{map[string]string{}, latestDbSchema},
+		{map[string]string{KeySalt: "c2FsdA=="}, 1},
+		{map[string]string{KeySalt: "c2FsdA==", keySchemaVersion: "2"}, 2},
+		{map[string]string{keySchemaVersion: strconv.Itoa(latestDbSchema + 1)}, latestDbSchema + 1},
+	}
+
+	for _, test := range tests {
+		db := openTestDB(t, test.keys)
+		var version int
+		db.View(func(tx *buntdb.Tx) error {
+			var err error
+			version, err = schemaVersion(tx)
+			if err != nil {
+				t.Errorf("schemaVersion of %v returned an error: %s", test.keys, err.Error())
+			}
+			return nil
+		})
+		if version != test.version {
+			t.Errorf("schemaVersion of %v = %d, want %d", test.keys, version, test.version)
+		}
+		db.Close()
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	dir := t.TempDir()
+
+	// Databases from before the version was stored are upgraded all the way and backed up
+	path := filepath.Join(dir, "old.db")
+	db := openTestDB(t, map[string]string{
+		KeySalt:                              "c2FsdA==",
+		"user.server.addresses dan freenode": `[{"Host":"irc.freenode.net","Port":6697,"use-tls":true,"verify-tls":false}]`,
+	})
+	err := checkSchema(db, path)
+	if err != nil {
+		t.Fatalf("checkSchema returned an error: %s", err.Error())
+	}
+	checkKeys(t, db, "checkSchema", map[string]string{
+		keySchemaVersion:                     strconv.Itoa(latestDbSchema),
+		"user.server.addresses dan freenode": `[{"Host":"irc.freenode.net","Port":6697,"use-tls":true,"verify-tls":true}]`,
+	})
+	db.Close()
+
+	backups, _ := filepath.Glob(path + ".v1-*.bak")
+	if len(backups) != 1 {
+		t.Errorf("checkSchema made %d backups, want 1", len(backups))
+	}
+
+	// Up to date databases are left alone
+	path = filepath.Join(dir, "latest.db")
+	db = openTestDB(t, map[string]string{
+		KeySalt:          "c2FsdA==",
+		keySchemaVersion: strconv.Itoa(latestDbSchema),
+	})
+	err = checkSchema(db, path)
+	if err != nil {
+		t.Errorf("checkSchema of an up to date database returned an error: %s", err.Error())
+	}
+	db.Close()
+	if backups, _ := filepath.Glob(path + ".*.bak"); len(backups) != 0 {
+		t.Errorf("checkSchema backed up an up to date database")
+	}
+
+	// Databases from newer versions are refused
+	db = openTestDB(t, map[string]string{
+		KeySalt:          "c2FsdA==",
+		keySchemaVersion: strconv.Itoa(latestDbSchema + 1),
+	})
+	err = checkSchema(db, filepath.Join(dir, "newer.db"))
+	if err == nil {
+		t.Errorf("checkSchema accepted a database from a newer version")
+	}
+	db.Close()
+}
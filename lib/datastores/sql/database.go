@@ -0,0 +1,191 @@
+package bncDataStoreSql
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sqlMigrations upgrade the database, each one taking it up a version. The current
+// version is kept in the schema_version table so the same migrations work for both
+// SQLite and PostgreSQL.
+var sqlMigrations = [][]string{
+	// 1: users, their networks and the buffers on them
+	{
+		`CREATE TABLE settings (
+			name TEXT NOT NULL PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
+		`CREATE TABLE users (
+			id TEXT NOT NULL PRIMARY KEY,
+			username TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT '',
+			salt TEXT NOT NULL,
+			password_hash TEXT NOT NULL,
+			default_nick TEXT NOT NULL DEFAULT '',
+			default_nick_fallback TEXT NOT NULL DEFAULT '',
+			default_username TEXT NOT NULL DEFAULT '',
+			default_realname TEXT NOT NULL DEFAULT '',
+			multi_network BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE TABLE user_permissions (
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			permission TEXT NOT NULL,
+			PRIMARY KEY (user_id, permission)
+		)`,
+		`CREATE TABLE user_certfps (
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			certfp TEXT NOT NULL,
+			PRIMARY KEY (user_id, certfp)
+		)`,
+		`CREATE INDEX user_certfps_certfp ON user_certfps (certfp)`,
+		`CREATE TABLE networks (
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			connect_password TEXT NOT NULL DEFAULT '',
+			nickname TEXT NOT NULL DEFAULT '',
+			nickname_fallback TEXT NOT NULL DEFAULT '',
+			username TEXT NOT NULL DEFAULT '',
+			realname TEXT NOT NULL DEFAULT '',
+			sasl_mechanism TEXT NOT NULL DEFAULT '',
+			sasl_account TEXT NOT NULL DEFAULT '',
+			sasl_password TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (user_id, name)
+		)`,
+		`CREATE TABLE network_addresses (
+			user_id TEXT NOT NULL,
+			network TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			host TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			use_tls BOOLEAN NOT NULL DEFAULT FALSE,
+			verify_tls BOOLEAN NOT NULL DEFAULT FALSE,
+			PRIMARY KEY (user_id, network, position),
+			FOREIGN KEY (user_id, network) REFERENCES networks (user_id, name) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE network_buffers (
+			user_id TEXT NOT NULL,
+			network TEXT NOT NULL,
+			name TEXT NOT NULL,
+			channel BOOLEAN NOT NULL DEFAULT FALSE,
+			channel_key TEXT NOT NULL DEFAULT '',
+			use_key BOOLEAN NOT NULL DEFAULT FALSE,
+			last_seen BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, network, name),
+			FOREIGN KEY (user_id, network) REFERENCES networks (user_id, name) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE client_positions (
+			user_id TEXT NOT NULL,
+			network TEXT NOT NULL,
+			client TEXT NOT NULL,
+			last_seen BIGINT NOT NULL,
+			PRIMARY KEY (user_id, network, client),
+			FOREIGN KEY (user_id, network) REFERENCES networks (user_id, name) ON DELETE CASCADE
+		)`,
+	},
+	// 2: users can be disabled
+	{
+		`ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 3: older versions gave every user "*", which would make them all admins now that
+	// permissions are checked
+	{
+		`DELETE FROM user_permissions WHERE permission = '*'
+			AND user_id IN (SELECT id FROM users WHERE role <> 'Owner')`,
+	},
+	// 4: tokens for the HTTP API
+	{
+		`CREATE TABLE user_api_tokens (
+			user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			PRIMARY KEY (user_id, name)
+		)`,
+	},
+	// 5: connecting to networks through proxies
+	{
+		`ALTER TABLE network_addresses ADD COLUMN proxy TEXT NOT NULL DEFAULT ''`,
+	},
+	// 6: the local address networks are connected to from
+	{
+		`ALTER TABLE networks ADD COLUMN bind_host TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE networks ADD COLUMN address_family TEXT NOT NULL DEFAULT ''`,
+	},
+	// 7: client certificates and pinned server certificates
+	{
+		`ALTER TABLE networks ADD COLUMN client_cert TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE network_addresses ADD COLUMN fingerprint TEXT NOT NULL DEFAULT ''`,
+	},
+	// 8: certificates used not to be verified by default, which would now mean trusting
+	// the first one we see without asking
+	{
+		`UPDATE network_addresses SET verify_tls = TRUE WHERE use_tls = TRUE`,
+	},
+}
+
+// migrate runs any migrations the database hasn't had yet
+func (ds *DataStore) migrate() error {
+	_, err := ds.Db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = ds.Db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = ds.Db.Exec("INSERT INTO schema_version (version) VALUES (0)")
+	}
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := ds.Db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range sqlMigrations[version] {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec(ds.rebind("UPDATE schema_version SET version = ?"), version+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", version+1, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebind changes the ? placeholders in a query into the $1 style that PostgreSQL uses
+func (ds *DataStore) rebind(query string) string {
+	if ds.driver != "postgres" {
+		return query
+	}
+
+	var rebound strings.Builder
+	param := 0
+	for _, char := range query {
+		if char == '?' {
+			param++
+			rebound.WriteString("$" + strconv.Itoa(param))
+		} else {
+			rebound.WriteRune(char)
+		}
+	}
+	return rebound.String()
+}
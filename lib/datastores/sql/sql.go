@@ -0,0 +1,698 @@
+package bncDataStoreSql
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/bnc/lib"
+	"github.com/goshuirc/bnc/lib/logger"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const keySalt = "crypto.salt"
+
+var dsLog = bncLog.New("datastore")
+
+// drivers maps the storage types we handle to their database/sql driver
+var drivers = map[string]string{
+	"sqlite":   "sqlite3",
+	"postgres": "postgres",
+}
+
+// DataStore keeps users and their networks in an SQLite or PostgreSQL database.
+type DataStore struct {
+	ircbnc.DataStoreInterface
+	Db      *sql.DB
+	Manager *ircbnc.Manager
+	driver  string
+	salt    []byte
+}
+
+// IsStorageType returns true if the given storage type is handled by this datastore
+func IsStorageType(storageType string) bool {
+	_, exists := drivers[storageType]
+	return exists
+}
+
+func (ds *DataStore) Init(manager *ircbnc.Manager) error {
+	ds.Manager = manager
+
+	storageType, _ := manager.Config.Bouncer.Storage["type"]
+	ds.driver = drivers[storageType]
+	if ds.driver == "" {
+		return fmt.Errorf("Unknown SQL storage type %s", storageType)
+	}
+
+	// The sqlite database is a file path, the postgres one is a connection string
+	dbSource, _ := manager.Config.Bouncer.Storage["database"]
+	if dbSource == "" {
+		return errors.New("No database has been configured")
+	}
+
+	db, err := sql.Open(ds.driver, dbSource)
+	if err != nil {
+		return errors.New("Could not open database: " + err.Error())
+	}
+
+	// sqlite only allows one writer at a time. With a single connection, rows must be
+	// closed before running another query
+	if ds.driver == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+
+	ds.Db = db
+
+	err = ds.migrate()
+	if err != nil {
+		return errors.New("Could not upgrade database: " + err.Error())
+	}
+
+	err = ds.LoadSalt()
+	if err != nil {
+		return errors.New("Could not initialize database: " + err.Error())
+	}
+	return nil
+}
+
+// Close closes the database, making sure everything has been written.
+func (ds *DataStore) Close() error {
+	if ds.Db == nil {
+		return nil
+	}
+	return ds.Db.Close()
+}
+
+func (ds *DataStore) Setup() error {
+	return ds.SetSalt(ircbnc.NewSalt())
+}
+
+func (ds *DataStore) GetSalt() []byte {
+	return ds.salt
+}
+
+func (ds *DataStore) SetSalt(salt []byte) error {
+	encodedSalt := base64.StdEncoding.EncodeToString(salt)
+	_, err := ds.Db.Exec(ds.rebind(`INSERT INTO settings (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value`), keySalt, encodedSalt)
+	if err != nil {
+		return err
+	}
+
+	ds.salt = salt
+	return nil
+}
+
+func (ds *DataStore) LoadSalt() error {
+	var saltString string
+	err := ds.Db.QueryRow(ds.rebind("SELECT value FROM settings WHERE name = ?"), keySalt).Scan(&saltString)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Could not get salt string: %s", err.Error())
+	}
+
+	ds.salt, err = base64.StdEncoding.DecodeString(saltString)
+	if err != nil {
+		return fmt.Errorf("Could not decode b64'd salt: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (ds *DataStore) GetAllUsers() []*ircbnc.User {
+	users := []*ircbnc.User{}
+
+	rows, err := ds.Db.Query("SELECT id FROM users ORDER BY id")
+	if err != nil {
+		dsLog.Error("Could not load users", "error", err)
+		return users
+	}
+
+	userIds := []string{}
+	for rows.Next() {
+		var userId string
+		if rows.Scan(&userId) == nil {
+			userIds = append(userIds, userId)
+		}
+	}
+	rows.Close()
+
+	// Iterate through the user IDs and generate our user objects
+	for _, userId := range userIds {
+		user, err := ds.loadUser(userId)
+		if err != nil {
+			dsLog.Error("Could not load user", "user", userId)
+			continue
+		}
+		users = append(users, user)
+	}
+
+	return users
+}
+
+func (ds *DataStore) GetUserById(id string) *ircbnc.User {
+	user, _ := ds.loadUser(id)
+	return user
+}
+
+func (ds *DataStore) GetUserByUsername(username string) *ircbnc.User {
+	// Since the IDs are just the usernames we can simply forward this on
+	return ds.GetUserById(strings.ToLower(username))
+}
+
+func (ds *DataStore) SaveUser(user *ircbnc.User) error {
+	// Just use the username as the ID
+	id := user.ID
+	if id == "" {
+		id = strings.ToLower(user.Name)
+	}
+
+	tx, err := ds.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ds.rebind(`INSERT INTO users (id, username, role, salt, password_hash, default_nick,
+			default_nick_fallback, default_username, default_realname, multi_network, disabled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET username = excluded.username, role = excluded.role,
+			salt = excluded.salt, password_hash = excluded.password_hash,
+			default_nick = excluded.default_nick, default_nick_fallback = excluded.default_nick_fallback,
+			default_username = excluded.default_username, default_realname = excluded.default_realname,
+			multi_network = excluded.multi_network, disabled = excluded.disabled`),
+		id,
+		user.Name,
+		user.Role,
+		base64.StdEncoding.EncodeToString(user.Salt),
+		base64.StdEncoding.EncodeToString(user.HashedPassword),
+		user.DefaultNick,
+		user.DefaultFbNick,
+		user.DefaultUser,
+		user.DefaultReal,
+		user.MultiNetwork,
+		user.Disabled,
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving user info: %s", err.Error())
+	}
+
+	// Permissions and certificate fingerprints are replaced as a whole
+	err = replaceRows(tx, ds.rebind("DELETE FROM user_permissions WHERE user_id = ?"), []interface{}{id},
+		ds.rebind("INSERT INTO user_permissions (user_id, permission) VALUES (?, ?)"), user.Permissions)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving user permissions: %s", err.Error())
+	}
+
+	err = replaceRows(tx, ds.rebind("DELETE FROM user_certfps WHERE user_id = ?"), []interface{}{id},
+		ds.rebind("INSERT INTO user_certfps (user_id, certfp) VALUES (?, ?)"), user.CertFPs)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving user certificate fingerprints: %s", err.Error())
+	}
+
+	err = ds.saveAPITokens(tx, id, user.APITokens)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving user API tokens: %s", err.Error())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// Make sure the User instance has the uptodate ID
+	user.ID = id
+	return nil
+}
+
+// saveAPITokens replaces the user's API tokens with the given ones
+func (ds *DataStore) saveAPITokens(tx *sql.Tx, userId string, apiTokens []ircbnc.APIToken) error {
+	_, err := tx.Exec(ds.rebind("DELETE FROM user_api_tokens WHERE user_id = ?"), userId)
+	if err != nil {
+		return err
+	}
+
+	for _, apiToken := range apiTokens {
+		_, err = tx.Exec(ds.rebind("INSERT INTO user_api_tokens (user_id, name, hash, created) VALUES (?, ?, ?, ?)"),
+			userId, apiToken.Name, apiToken.Hash, toMillis(apiToken.Created))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceRows deletes a user's rows and inserts one for each of the given values
+func replaceRows(tx *sql.Tx, deleteQuery string, keys []interface{}, insertQuery string, values []string) error {
+	_, err := tx.Exec(deleteQuery, keys...)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		_, err = tx.Exec(insertQuery, append(keys, value)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ds *DataStore) DelUser(user *ircbnc.User) error {
+	tx, err := ds.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// sqlite doesn't enforce foreign keys by default, so clear everything up ourselves
+	tables := []string{"client_positions", "network_buffers", "network_addresses", "networks", "user_api_tokens", "user_certfps", "user_permissions"}
+	for _, table := range tables {
+		_, err = tx.Exec(ds.rebind("DELETE FROM "+table+" WHERE user_id = ?"), user.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ds.rebind("DELETE FROM users WHERE id = ?"), user.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ds *DataStore) AuthUser(username string, password string) (string, bool) {
+	user := ds.GetUserByUsername(username)
+	if user == nil {
+		return "", false
+	}
+
+	if user.Disabled {
+		return "", false
+	}
+
+	passMatches := ircbnc.CompareHashAndPassword(user.HashedPassword, ds.salt, user.Salt, password)
+	if !passMatches {
+		return "", false
+	}
+
+	return user.ID, true
+}
+
+func (ds *DataStore) AuthUserByCertFP(certfp string) (string, bool) {
+	certfp = ircbnc.NormaliseCertFP(certfp)
+	if certfp == "" {
+		return "", false
+	}
+
+	var authedUserId string
+	err := ds.Db.QueryRow(ds.rebind(`SELECT user_certfps.user_id FROM user_certfps
+		JOIN users ON users.id = user_certfps.user_id
+		WHERE user_certfps.certfp = ? AND NOT users.disabled`), certfp).Scan(&authedUserId)
+	if err != nil {
+		return "", false
+	}
+
+	return authedUserId, true
+}
+
+func (ds *DataStore) SetUserPassword(user *ircbnc.User, newPassword string) {
+	userSalt := ircbnc.NewSalt()
+	passHash, _ := ircbnc.GenerateFromPassword(ds.salt, userSalt, newPassword)
+
+	user.Salt = userSalt
+	user.HashedPassword = passHash
+}
+
+func (ds *DataStore) GetUserNetworks(userId string) {
+	// TODO: Return a slice of network objects of some kind
+}
+
+func (ds *DataStore) DelConnection(connection *ircbnc.ServerConnection) error {
+	tx, err := ds.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// sqlite doesn't enforce foreign keys by default, so clear everything up ourselves
+	for _, table := range []string{"client_positions", "network_buffers", "network_addresses"} {
+		_, err = tx.Exec(ds.rebind("DELETE FROM "+table+" WHERE user_id = ? AND network = ?"), connection.User.ID, connection.Name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ds.rebind("DELETE FROM networks WHERE user_id = ? AND name = ?"), connection.User.ID, connection.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ds *DataStore) GetClientPosition(userID string, networkID string, clientID string) (time.Time, bool) {
+	var millis int64
+	err := ds.Db.QueryRow(ds.rebind("SELECT last_seen FROM client_positions WHERE user_id = ? AND network = ? AND client = ?"),
+		userID, networkID, clientID).Scan(&millis)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return fromMillis(millis), true
+}
+
+func (ds *DataStore) GetClientPositions(userID string, networkID string) map[string]time.Time {
+	positions := make(map[string]time.Time)
+
+	rows, err := ds.Db.Query(ds.rebind("SELECT client, last_seen FROM client_positions WHERE user_id = ? AND network = ?"),
+		userID, networkID)
+	if err != nil {
+		return positions
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var clientID string
+		var millis int64
+		if rows.Scan(&clientID, &millis) == nil {
+			positions[clientID] = fromMillis(millis)
+		}
+	}
+
+	return positions
+}
+
+func (ds *DataStore) SaveClientPosition(userID string, networkID string, clientID string, seen time.Time) error {
+	_, err := ds.Db.Exec(ds.rebind(`INSERT INTO client_positions (user_id, network, client, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, network, client) DO UPDATE SET last_seen = excluded.last_seen`),
+		userID, networkID, clientID, toMillis(seen))
+	return err
+}
+
+func (ds *DataStore) SaveConnection(connection *ircbnc.ServerConnection) error {
+	tx, err := ds.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Store server info
+	_, err = tx.Exec(ds.rebind(`INSERT INTO networks (user_id, name, enabled, connect_password, nickname,
+			nickname_fallback, username, realname, sasl_mechanism, sasl_account, sasl_password,
+			bind_host, address_family, client_cert)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET enabled = excluded.enabled,
+			connect_password = excluded.connect_password, nickname = excluded.nickname,
+			nickname_fallback = excluded.nickname_fallback, username = excluded.username,
+			realname = excluded.realname, sasl_mechanism = excluded.sasl_mechanism,
+			sasl_account = excluded.sasl_account, sasl_password = excluded.sasl_password,
+			bind_host = excluded.bind_host, address_family = excluded.address_family,
+			client_cert = excluded.client_cert`),
+		connection.User.ID,
+		connection.Name,
+		connection.Enabled,
+		connection.Password,
+		connection.Nickname,
+		connection.FbNickname,
+		connection.Username,
+		connection.Realname,
+		connection.SaslMechanism,
+		connection.SaslAccount,
+		connection.SaslPassword,
+		connection.BindHost,
+		connection.AddressFamily,
+		connection.ClientCert,
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving network info: %s", err.Error())
+	}
+
+	// Store server addresses, keeping them in order
+	_, err = tx.Exec(ds.rebind("DELETE FROM network_addresses WHERE user_id = ? AND network = ?"), connection.User.ID, connection.Name)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving network addresses: %s", err.Error())
+	}
+
+	for idx, addr := range connection.Addresses {
+		_, err = tx.Exec(ds.rebind(`INSERT INTO network_addresses (user_id, network, position, host, port, use_tls, verify_tls, proxy, fingerprint)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			connection.User.ID, connection.Name, idx, addr.Host, addr.Port, addr.UseTLS, addr.VerifyTLS, addr.Proxy, addr.Fingerprint)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error saving network addresses: %s", err.Error())
+		}
+	}
+
+	// Store server channels
+	_, err = tx.Exec(ds.rebind("DELETE FROM network_buffers WHERE user_id = ? AND network = ?"), connection.User.ID, connection.Name)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Error saving network buffers: %s", err.Error())
+	}
+
+	for _, buffer := range connection.Buffers {
+		var lastSeen int64
+		if !buffer.LastSeen.IsZero() {
+			lastSeen = toMillis(buffer.LastSeen)
+		}
+
+		_, err = tx.Exec(ds.rebind(`INSERT INTO network_buffers (user_id, network, name, channel, channel_key, use_key, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			connection.User.ID, connection.Name, buffer.Name, buffer.Channel, buffer.Key, buffer.UseKey, lastSeen)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error saving network buffers: %s", err.Error())
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (ds *DataStore) loadUser(userId string) (*ircbnc.User, error) {
+	user := ircbnc.NewUser(ds.Manager)
+
+	var encodedSalt, encodedPasswordHash string
+	err := ds.Db.QueryRow(ds.rebind(`SELECT id, username, role, salt, password_hash, default_nick,
+			default_nick_fallback, default_username, default_realname, multi_network, disabled
+		FROM users WHERE id = ?`), userId).Scan(
+		&user.ID,
+		&user.Name,
+		&user.Role,
+		&encodedSalt,
+		&encodedPasswordHash,
+		&user.DefaultNick,
+		&user.DefaultFbNick,
+		&user.DefaultUser,
+		&user.DefaultReal,
+		&user.MultiNetwork,
+		&user.Disabled,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (loading user info from db): %s", err.Error())
+	}
+
+	user.Salt, err = base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (decoding salt): %s", err.Error())
+	}
+
+	user.HashedPassword, err = base64.StdEncoding.DecodeString(encodedPasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (decoding password): %s", err.Error())
+	}
+
+	user.Permissions, err = ds.loadStrings("SELECT permission FROM user_permissions WHERE user_id = ? ORDER BY permission", user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (loading permissions): %s", err.Error())
+	}
+
+	user.CertFPs, err = ds.loadStrings("SELECT certfp FROM user_certfps WHERE user_id = ? ORDER BY certfp", user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (loading certificate fingerprints): %s", err.Error())
+	}
+
+	err = ds.loadAPITokens(user)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load user (loading API tokens): %s", err.Error())
+	}
+
+	ds.loadUserConnections(user)
+
+	return user, nil
+}
+
+func (ds *DataStore) loadAPITokens(user *ircbnc.User) error {
+	rows, err := ds.Db.Query(ds.rebind("SELECT name, hash, created FROM user_api_tokens WHERE user_id = ? ORDER BY name"), user.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var apiToken ircbnc.APIToken
+		var created int64
+		err = rows.Scan(&apiToken.Name, &apiToken.Hash, &created)
+		if err != nil {
+			return err
+		}
+		apiToken.Created = fromMillis(created)
+		user.APITokens = append(user.APITokens, apiToken)
+	}
+
+	return rows.Err()
+}
+
+// loadStrings returns the single column of strings the query selects
+func (ds *DataStore) loadStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := ds.Db.Query(ds.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+func (ds *DataStore) loadUserConnections(user *ircbnc.User) {
+	names, err := ds.loadStrings("SELECT name FROM networks WHERE user_id = ? ORDER BY name", user.ID)
+	if err != nil {
+		dsLog.Error("Could not load user networks", "user", user.ID, "error", err)
+		return
+	}
+
+	for _, name := range names {
+		sc, err := ds.loadServerConnection(name, user)
+		if err != nil {
+			dsLog.Error("Could not load user network", "user", user.ID, "error", err)
+			continue
+		}
+
+		user.Networks[name] = sc
+	}
+}
+
+// loadServerConnection loads the given server connection from our database.
+func (ds *DataStore) loadServerConnection(name string, user *ircbnc.User) (*ircbnc.ServerConnection, error) {
+	sc := ircbnc.NewServerConnection()
+	sc.Name = name
+	sc.User = user
+
+	// load general info
+	err := ds.Db.QueryRow(ds.rebind(`SELECT enabled, connect_password, nickname, nickname_fallback, username,
+			realname, sasl_mechanism, sasl_account, sasl_password, bind_host, address_family,
+			client_cert
+		FROM networks WHERE user_id = ? AND name = ?`), user.ID, name).Scan(
+		&sc.Enabled,
+		&sc.Password,
+		&sc.Nickname,
+		&sc.FbNickname,
+		&sc.Username,
+		&sc.Realname,
+		&sc.SaslMechanism,
+		&sc.SaslAccount,
+		&sc.SaslPassword,
+		&sc.BindHost,
+		&sc.AddressFamily,
+		&sc.ClientCert,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create new ServerConnection (getting sc details from db): %s", err.Error())
+	}
+
+	// set default values
+	if sc.Nickname == "" {
+		sc.Nickname = user.DefaultNick
+	}
+	if sc.FbNickname == "" {
+		sc.FbNickname = user.DefaultFbNick
+	}
+	if sc.Username == "" {
+		sc.Username = user.DefaultUser
+	}
+	if sc.Realname == "" {
+		sc.Realname = user.DefaultReal
+	}
+
+	// load channels
+	bufferRows, err := ds.Db.Query(ds.rebind(`SELECT name, channel, channel_key, use_key, last_seen
+		FROM network_buffers WHERE user_id = ? AND network = ?`), user.ID, name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create new ServerConnection (getting sc channels from db): %s", err.Error())
+	}
+
+	for bufferRows.Next() {
+		buffer := &ircbnc.ServerConnectionBuffer{}
+		var lastSeen int64
+		err = bufferRows.Scan(&buffer.Name, &buffer.Channel, &buffer.Key, &buffer.UseKey, &lastSeen)
+		if err != nil {
+			bufferRows.Close()
+			return nil, fmt.Errorf("Could not create new ServerConnection (reading sc channels): %s", err.Error())
+		}
+
+		// Buffers that have never been read shouldn't be marked as read in 1970
+		if lastSeen != 0 {
+			buffer.LastSeen = fromMillis(lastSeen)
+		}
+		sc.Buffers.Add(buffer)
+	}
+	bufferRows.Close()
+
+	// load addresses
+	addressRows, err := ds.Db.Query(ds.rebind(`SELECT host, port, use_tls, verify_tls, proxy, fingerprint
+		FROM network_addresses WHERE user_id = ? AND network = ? ORDER BY position`), user.ID, name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create new ServerConnection (getting sc addresses from db): %s", err.Error())
+	}
+	defer addressRows.Close()
+
+	for addressRows.Next() {
+		address := ircbnc.ServerConnectionAddress{}
+		err = addressRows.Scan(&address.Host, &address.Port, &address.UseTLS, &address.VerifyTLS, &address.Proxy, &address.Fingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create new ServerConnection (reading sc addresses): %s", err.Error())
+		}
+
+		// check port number and add addresses
+		if address.Port < 1 || address.Port > 65535 {
+			return nil, fmt.Errorf("Could not create new ServerConnection (port %d is not valid)", address.Port)
+		}
+
+		sc.Addresses = append(sc.Addresses, address)
+	}
+
+	return sc, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC()
+}
@@ -68,3 +68,40 @@ type HookStateSent struct {
 	Listener *Listener
 	Server   *ServerConnection
 }
+
+var HookRehashName = "manager.rehash"
+
+type HookRehash struct {
+	OldConfig *Config
+	NewConfig *Config
+}
+
+var HookAuthFailedName = "listener.authfailed"
+
+// HookAuthFailed is dispatched when a client tries to log in and fails
+type HookAuthFailed struct {
+	// Listener is nil for logins to the HTTP API
+	Listener *Listener
+	// Method is how they tried to log in, eg. PASS or SASL
+	Method string
+}
+
+var HookNetworkStateName = "server.state"
+
+// HookNetworkState is dispatched when a network starts connecting, finishes
+// registering or loses its connection
+type HookNetworkState struct {
+	Server *ServerConnection
+	// State is one of connecting, connected or disconnected
+	State string
+	// Error describes why we disconnected, if we know
+	Error string
+}
+
+var HookReconnectName = "server.reconnect"
+
+// HookReconnect is dispatched each time we try to reconnect to a network that we lost
+// our connection to
+type HookReconnect struct {
+	Server *ServerConnection
+}
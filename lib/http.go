@@ -0,0 +1,45 @@
+package ircbnc
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// ListenHTTP starts serving handler on the configured address, returning nil if no
+// address has been set. name says what's being served, for logging.
+func ListenHTTP(name string, config HTTPConfig, handler http.Handler) (*http.Server, error) {
+	if config.Listen == "" {
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TLS != nil {
+		cert, err := config.TLS.Certificate()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+		})
+	}
+
+	server := &http.Server{
+		Handler: handler,
+	}
+
+	coreLog.Info("Listening", "server", name, "address", config.Listen)
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			coreLog.Error("Stopped", "server", name, "error", err)
+		}
+	}()
+
+	return server, nil
+}
@@ -46,11 +46,17 @@ type Client struct {
 	Username         string
 	Realname         string
 	Password         string
-	BindHost         string
+	SaslMechanism    string
+	SaslAccount      string
+	SaslPassword     string
+	SaslError        string
 	Caps             *ClientCaps
 	Supported        map[string]string
 	HasRegistered    bool
 	CommandListeners map[string][]func(*ircmsg.IrcMessage)
+
+	// counts our connections, so that one closing down can tell if another has started
+	connection int
 }
 
 func NewClient() *Client {
@@ -71,11 +77,12 @@ func NewClient() *Client {
 		"away-notify",
 		"extended-join",
 		// "multi-prefix",
-		// "sasl",
+		"sasl",
 		"account-tag",
 		// "cap-notify",
 		// "chghost",
 		"invite-notify",
+		"message-tags",
 		"server-time",
 		"userhost-in-names",
 	)
@@ -84,12 +91,23 @@ func NewClient() *Client {
 }
 
 func (client *Client) Connect() error {
+	// Forget anything we learned about the last server we were connected to
+	client.Lock()
+	client.Caps.Enabled = make(map[string]string)
+	client.Caps.Available = make(map[string]string)
+	client.Supported = make(map[string]string)
+	client.HasRegistered = false
+	client.SaslError = ""
+	client.connection++
+	connection := client.connection
+	client.Unlock()
+
 	err := client.Socket.Connect()
 	if err != nil {
 		return err
 	}
 
-	go client.messageDispatcher()
+	go client.messageDispatcher(client.MessagesIn, connection)
 
 	if client.Password != "" {
 		client.WriteLine("PASS " + client.Password)
@@ -101,6 +119,41 @@ func (client *Client) Connect() error {
 	return nil
 }
 
+// wantedCaps returns the caps we should request from what the server has available
+func (client *Client) wantedCaps() []string {
+	var wanted []string
+
+	for _, cap := range client.Caps.CommonCaps() {
+		if cap == "sasl" && !client.canUseSasl() {
+			continue
+		}
+		wanted = append(wanted, cap)
+	}
+
+	return wanted
+}
+
+// canUseSasl checks if we have SASL details and the server supports our mechanism
+func (client *Client) canUseSasl() bool {
+	if client.SaslMechanism == "" {
+		return false
+	}
+
+	// CAP 302 servers may list the mechanisms they support
+	mechanisms := client.Caps.Available["sasl"]
+	if mechanisms == "" {
+		return true
+	}
+
+	for _, mechanism := range strings.Split(mechanisms, ",") {
+		if strings.ToUpper(mechanism) == client.SaslMechanism {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (client *Client) HandleCommand(command string, fn func(*ircmsg.IrcMessage)) {
 	client.Lock()
 	defer client.Unlock()
@@ -116,11 +169,13 @@ func (client *Client) HandleCommand(command string, fn func(*ircmsg.IrcMessage))
 	client.CommandListeners[command] = append(client.CommandListeners[command], fn)
 }
 
-func (client *Client) messageDispatcher() {
+// messageDispatcher handles the messages from one connection until it's closed. It's
+// given that connection's channel so that it never reads from the next one.
+func (client *Client) messageDispatcher(messagesIn chan ircmsg.IrcMessage, connection int) {
 	var handlers []func(*ircmsg.IrcMessage)
 
 	for {
-		message, isOK := <-client.MessagesIn
+		message, isOK := <-messagesIn
 		if !isOK {
 			break
 		}
@@ -158,8 +213,11 @@ func (client *Client) messageDispatcher() {
 		}
 	}
 
+	// A new connection may have started already, and it has its own registration
 	client.Lock()
-	client.HasRegistered = false
+	if client.connection == connection {
+		client.HasRegistered = false
+	}
 	client.Unlock()
 }
 
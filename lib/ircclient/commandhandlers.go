@@ -1,6 +1,7 @@
 package ircclient
 
 import (
+	"encoding/base64"
 	"strings"
 
 	"github.com/goshuirc/irc-go/ircmsg"
@@ -81,6 +82,14 @@ func loadServerCommands() {
 		},
 	}
 
+	// Replies to our own keepalive PINGs are only for us, so don't pass them on
+	ServerCommands["PONG"] = ServerCommand{
+		minParams: 1,
+		handler: func(client *Client, msg *ircmsg.IrcMessage) bool {
+			return client.gotPong(msg.Params[len(msg.Params)-1])
+		},
+	}
+
 	ServerCommands["CAP"] = ServerCommand{
 		minParams: 2,
 		handler: func(client *Client, msg *ircmsg.IrcMessage) bool {
@@ -112,7 +121,7 @@ func loadServerCommands() {
 				}
 
 				if isLastCapsLine {
-					common := client.Caps.CommonCaps()
+					common := client.wantedCaps()
 					if len(common) > 0 {
 						client.WriteLine("CAP REQ :%s", strings.Join(common, " "))
 					} else {
@@ -138,16 +147,95 @@ func loadServerCommands() {
 					client.Unlock()
 				}
 
+				// Registration carries on once SASL has finished
+				if client.Caps.IsEnabled("sasl") && !client.HasRegistered {
+					client.WriteLine("AUTHENTICATE %s", client.SaslMechanism)
+				} else {
+					client.WriteLine("CAP END")
+				}
+			}
+
+			if command == "NAK" && !client.HasRegistered {
+				// None of the requested caps were enabled so just carry on without them
 				client.WriteLine("CAP END")
 			}
 
-			if command == "NAK" {
-				// TODO: This
+			return true
+		},
+	}
+
+	ServerCommands["AUTHENTICATE"] = ServerCommand{
+		minParams: 1,
+		handler: func(client *Client, msg *ircmsg.IrcMessage) bool {
+			if msg.Params[0] != "+" {
+				return true
+			}
+
+			var response string
+			switch client.SaslMechanism {
+			case "PLAIN":
+				payload := client.SaslAccount + "\x00" + client.SaslAccount + "\x00" + client.SaslPassword
+				response = base64.StdEncoding.EncodeToString([]byte(payload))
+			case "EXTERNAL":
+				// The server identifies us by the client certificate we connected with
+				response = ""
+			default:
+				client.WriteLine("AUTHENTICATE *")
+				return true
+			}
+
+			for _, chunk := range saslChunks(response) {
+				client.WriteLine("AUTHENTICATE %s", chunk)
 			}
 
 			return true
 		},
 	}
+
+	saslDone := ServerCommand{
+		minParams: 0,
+		handler: func(client *Client, msg *ircmsg.IrcMessage) bool {
+			if msg.Command != RPL_SASLSUCCESS {
+				client.Lock()
+				client.SaslError = getParam(msg, len(msg.Params)-1)
+				client.Unlock()
+			}
+
+			if !client.HasRegistered {
+				client.WriteLine("CAP END")
+			}
+
+			// Let anything else watching know how SASL went
+			return false
+		},
+	}
+	ServerCommands[RPL_SASLSUCCESS] = saslDone
+	ServerCommands[ERR_SASLFAIL] = saslDone
+	ServerCommands[ERR_SASLTOOLONG] = saslDone
+	ServerCommands[ERR_SASLABORTED] = saslDone
+	ServerCommands[ERR_SASLALREADY] = saslDone
+	ServerCommands[ERR_NICKLOCKED] = saslDone
+}
+
+// saslChunks splits an encoded SASL response into the 400 byte pieces AUTHENTICATE allows
+func saslChunks(response string) []string {
+	if response == "" {
+		return []string{"+"}
+	}
+
+	var chunks []string
+	for len(response) >= 400 {
+		chunks = append(chunks, response[:400])
+		response = response[400:]
+	}
+
+	// A final chunk of exactly 400 bytes has to be followed by an empty one
+	if response == "" {
+		response = "+"
+	}
+	chunks = append(chunks, response)
+
+	return chunks
 }
 
 func getParam(msg *ircmsg.IrcMessage, idx int) string {
@@ -1,8 +1,7 @@
 package ircclient
 
 import (
-	"log"
-
+	"github.com/goshuirc/bnc/lib/logger"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
@@ -23,7 +22,7 @@ type ServerCommand struct {
 // Run runs this command with the given listener/message.
 func (cmd *ServerCommand) Run(client *Client, msg *ircmsg.IrcMessage) bool {
 	if len(msg.Params) < cmd.minParams {
-		log.Println("Not enough parameters sent from the server: " + msg.SourceLine)
+		clientLog.Warn("Not enough parameters sent from the server", "line", bncLog.RedactLine(msg.SourceLine))
 		return false
 	}
 	return cmd.handler(client, msg)
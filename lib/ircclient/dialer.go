@@ -0,0 +1,78 @@
+package ircclient
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// familyDialer makes TCP connections from our bind host, using the address family we've
+// been told to. It's also used to reach proxies.
+type familyDialer struct {
+	dialer *net.Dialer
+	family string
+}
+
+// newDialer returns a dialer for the socket's bind host and address family
+func (socket *Socket) newDialer() (*familyDialer, error) {
+	if !AddressFamilies[socket.AddressFamily] {
+		return nil, errors.New("Address family must be ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+	}
+
+	dialer := &familyDialer{
+		dialer: &net.Dialer{},
+		family: socket.AddressFamily,
+	}
+
+	if socket.BindHost != "" {
+		ip := net.ParseIP(socket.BindHost)
+		if ip == nil {
+			return nil, errors.New("Bind host must be an IP address")
+		}
+		dialer.dialer.LocalAddr = &net.TCPAddr{IP: ip}
+
+		// We can only reach servers using the same family as the address we're binding to
+		if ip.To4() != nil {
+			dialer.family = "ipv4"
+		} else {
+			dialer.family = "ipv6"
+		}
+	}
+
+	return dialer, nil
+}
+
+func (dialer *familyDialer) Dial(network string, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address. The network is always TCP, it's only here so that
+// proxies can use us.
+func (dialer *familyDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch dialer.family {
+	case "ipv4":
+		return dialer.dialer.DialContext(ctx, "tcp4", address)
+	case "ipv6":
+		return dialer.dialer.DialContext(ctx, "tcp6", address)
+	case "prefer-ipv4":
+		return dialer.dialPreferring(ctx, "tcp4", "tcp6", address)
+	case "prefer-ipv6":
+		return dialer.dialPreferring(ctx, "tcp6", "tcp4", address)
+	}
+	return dialer.dialer.DialContext(ctx, "tcp", address)
+}
+
+// dialPreferring tries to connect using one address family, falling back to the other
+func (dialer *familyDialer) dialPreferring(ctx context.Context, preferred string, fallback string, address string) (net.Conn, error) {
+	conn, err := dialer.dialer.DialContext(ctx, preferred, address)
+	if err == nil {
+		return conn, nil
+	}
+
+	conn, fallbackErr := dialer.dialer.DialContext(ctx, fallback, address)
+	if fallbackErr != nil {
+		// The error from the family we wanted is usually the more useful one
+		return nil, err
+	}
+	return conn, nil
+}
@@ -2,16 +2,46 @@ package ircclient
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/goshuirc/bnc/lib/logger"
+	"github.com/goshuirc/bnc/lib/metrics"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+var (
+	clientLog = bncLog.New("upstream")
+	// rawLog logs every line sent and received, at debug level
+	rawLog = bncLog.New("upstream.raw")
+)
+
+// pingTokenPrefix marks the PINGs we send ourselves, so that their PONGs aren't passed on
+const pingTokenPrefix = "bnc-lag-"
+
+// AddressFamilies are the ways we can choose between IPv4 and IPv6 when connecting. An
+// empty family uses whichever the system prefers.
+var AddressFamilies = map[string]bool{
+	"":            true,
+	"ipv4":        true,
+	"ipv6":        true,
+	"prefer-ipv4": true,
+	"prefer-ipv6": true,
+}
+
+// Defaults for the timeouts, if they aren't set
+const (
+	defaultDialTimeout  = 30 * time.Second
+	defaultPingInterval = 60 * time.Second
+	defaultPingTimeout  = 120 * time.Second
+)
+
 type Socket struct {
 	Host       string
 	Port       int
@@ -22,6 +52,30 @@ type Socket struct {
 	Connected  bool
 	Connecting bool
 	MessagesIn chan ircmsg.IrcMessage
+	// Proxy is the URL of a SOCKS5 or HTTP CONNECT proxy to connect through, if any
+	Proxy string
+	// BindHost is the local IP address to connect from, if any
+	BindHost string
+	// AddressFamily is one of the AddressFamilies, saying whether to use IPv4 or IPv6
+	AddressFamily string
+
+	// DialTimeout is how long connecting, including the TLS handshake, may take
+	DialTimeout time.Duration
+	// PingInterval is how often we PING the server to check the connection and measure lag
+	PingInterval time.Duration
+	// PingTimeout is how long the server can go without sending us anything after we
+	// PING it before we decide the connection is dead
+	PingTimeout time.Duration
+
+	// cancels the connection we're making, if any. Guarded by ConnLock
+	cancelDial context.CancelFunc
+
+	pingLock sync.Mutex
+	// the PING we're waiting on a reply to, and when we sent it
+	pingToken string
+	pingSent  time.Time
+	lag       time.Duration
+	lagKnown  bool
 }
 
 func NewSocket() *Socket {
@@ -34,13 +88,23 @@ func (socket *Socket) Connect() error {
 
 	destination := net.JoinHostPort(socket.Host, strconv.Itoa(socket.Port))
 
-	// TODO: Timeouts
-	var conn net.Conn
-	var err error
-	if socket.TLS {
-		conn, err = tls.Dial("tcp", destination, socket.TLSConfig)
-	} else {
-		conn, err = net.Dial("tcp", destination)
+	// The timeout covers the proxy and TLS handshakes as well as connecting
+	ctx, cancel := context.WithTimeout(context.Background(), durationOr(socket.DialTimeout, defaultDialTimeout))
+	defer cancel()
+
+	// Closing the socket while we're connecting stops the attempt
+	socket.ConnLock.Lock()
+	socket.cancelDial = cancel
+	socket.ConnLock.Unlock()
+	defer func() {
+		socket.ConnLock.Lock()
+		socket.cancelDial = nil
+		socket.ConnLock.Unlock()
+	}()
+
+	conn, err := socket.dial(ctx, destination)
+	if err == nil && socket.TLS {
+		conn, err = socket.startTLS(ctx, conn)
 	}
 
 	socket.Connecting = false
@@ -52,13 +116,118 @@ func (socket *Socket) Connect() error {
 	socket.Connected = true
 	socket.Conn = conn
 
+	socket.pingLock.Lock()
+	socket.pingToken = ""
+	socket.lagKnown = false
+	socket.pingLock.Unlock()
+
+	// Each connection gets its own channels, so that one closing down can't touch the
+	// channels of the next
+	stopPinger := make(chan bool)
 	socket.MessagesIn = make(chan ircmsg.IrcMessage)
-	go socket.readInput()
+	go socket.readInput(conn, socket.MessagesIn, stopPinger)
+	go socket.pinger(stopPinger)
 
 	return nil
 }
 
+// startTLS does the TLS handshake over a connection we've just made
+func (socket *Socket) startTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	config := &tls.Config{}
+	if socket.TLSConfig != nil {
+		config = socket.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = socket.Host
+	}
+
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// durationOr returns the duration, or the fallback if it hasn't been set
+func durationOr(duration time.Duration, fallback time.Duration) time.Duration {
+	if duration <= 0 {
+		return fallback
+	}
+	return duration
+}
+
+// pinger PINGs the server every PingInterval until stop is closed, measuring our lag
+func (socket *Socket) pinger(stop chan bool) {
+	ticker := time.NewTicker(durationOr(socket.PingInterval, defaultPingInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			socket.pingLock.Lock()
+			// Don't pile up PINGs if the last one hasn't been answered yet
+			if socket.pingToken != "" {
+				socket.pingLock.Unlock()
+				continue
+			}
+			socket.pingToken = pingTokenPrefix + strconv.FormatInt(now.UnixNano(), 10)
+			socket.pingSent = now
+			token := socket.pingToken
+			socket.pingLock.Unlock()
+
+			socket.WriteLine("PING :%s", token)
+		}
+	}
+}
+
+// gotPong records the lag if the PONG is for one of our PINGs, returning true if it was
+func (socket *Socket) gotPong(token string) bool {
+	if !strings.HasPrefix(token, pingTokenPrefix) {
+		return false
+	}
+
+	socket.pingLock.Lock()
+	defer socket.pingLock.Unlock()
+
+	if token == socket.pingToken {
+		socket.lag = time.Since(socket.pingSent)
+		socket.lagKnown = true
+		socket.pingToken = ""
+	}
+	return true
+}
+
+// Lag returns how long the server took to answer our last PING. It returns false if
+// we don't know yet.
+func (socket *Socket) Lag() (time.Duration, bool) {
+	socket.pingLock.Lock()
+	defer socket.pingLock.Unlock()
+
+	// A PING that's taking longer than the last one did means we're at least that lagged
+	if socket.pingToken != "" && time.Since(socket.pingSent) > socket.lag {
+		return time.Since(socket.pingSent), true
+	}
+	return socket.lag, socket.lagKnown
+}
+
+// Close closes the connection, or stops the connection we're still making.
 func (socket *Socket) Close() error {
+	socket.ConnLock.Lock()
+	if socket.cancelDial != nil {
+		socket.cancelDial()
+	}
+	socket.ConnLock.Unlock()
+
 	if socket.Connected {
 		return socket.Conn.Close()
 	}
@@ -66,24 +235,38 @@ func (socket *Socket) Close() error {
 	return nil
 }
 
-func (socket *Socket) readInput() {
-	reader := bufio.NewReader(socket.Conn)
+func (socket *Socket) readInput(conn net.Conn, messagesIn chan ircmsg.IrcMessage, stopPinger chan bool) {
+	// The server has to send us something, even if it's just a PONG, within this long of
+	// us PINGing it. Otherwise a connection that silently dropped would look connected
+	// forever
+	timeout := durationOr(socket.PingInterval, defaultPingInterval) + durationOr(socket.PingTimeout, defaultPingTimeout)
+
+	reader := bufio.NewReader(conn)
 	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
 		line, err := reader.ReadString('\n')
+		if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+			clientLog.Warn("Ping timeout", "host", socket.Host, "timeout", timeout)
+			conn.Close()
+		}
 		if err != nil {
 			break
 		}
 
 		line = strings.Trim(line, "\r\n")
-		println("[S " + socket.Host + "] " + line)
+		bncMetrics.ServerLinesIn.Inc()
+		if rawLog.Enabled(bncLog.LevelDebug) {
+			rawLog.Debug("Line in", "host", socket.Host, "line", bncLog.RedactLine(line))
+		}
 		message, parseErr := ircmsg.ParseLine(line)
 		if parseErr == nil {
-			socket.MessagesIn <- message
+			messagesIn <- message
 		}
 	}
 
 	socket.Connected = false
-	close(socket.MessagesIn)
+	close(stopPinger)
+	close(messagesIn)
 }
 
 // WriteLine writes a raw IRC line to the server. Auto appends \n
@@ -107,7 +290,10 @@ func (socket *Socket) WriteLine(format string, args ...interface{}) (int, error)
 		}
 	}
 
-	println("[C " + socket.Host + "] " + strings.Trim(line, "\n"))
+	if rawLog.Enabled(bncLog.LevelDebug) {
+		rawLog.Debug("Line out", "host", socket.Host, "line", bncLog.RedactLine(strings.TrimRight(line, "\r\n")))
+	}
+	bncMetrics.ServerLinesOut.Inc()
 	return socket.Write([]byte(line))
 }
 
@@ -4,6 +4,7 @@
 package ircbnc
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net"
 	"runtime/debug"
@@ -13,8 +14,6 @@ import (
 
 	"code.cloudfoundry.org/bytefmt"
 
-	"log"
-
 	"github.com/goshuirc/bnc/lib/ircclient"
 	"github.com/goshuirc/irc-go/ircmsg"
 )
@@ -44,6 +43,14 @@ func (locks *RegistrationLocks) Set(lockName string, val bool) {
 	locks.Lock.Unlock()
 }
 
+// Negotiating returns true while the client is in the middle of CAP negotiation
+func (locks *RegistrationLocks) Negotiating() bool {
+	locks.Lock.Lock()
+	negotiating := !locks.Cap
+	locks.Lock.Unlock()
+	return negotiating
+}
+
 func (locks *RegistrationLocks) Completed() bool {
 	locks.Lock.Lock()
 	completed := locks.Cap && locks.Pass && locks.Nick && locks.User
@@ -61,11 +68,22 @@ type Listener struct {
 	ExtraISupports   map[string]string
 	TagsEnabled      bool
 	ClientNick       string
+	CertFP           string
+	ClientID         string
+	MultiNetwork     bool
 	Source           string
 	Registered       bool
 	regLocks         *RegistrationLocks
+	saslMechanism    string
+	saslResponse     string
+	saslFailures     int
 	User             *User
 	ServerConnection *ServerConnection
+
+	// certLogin is the username given with USER, used to log in with the client's
+	// certificate once CAP negotiation is over if it hasn't logged in another way
+	certLogin        string
+	certLoginPending bool
 }
 
 // NewListener creates a new Listener.
@@ -89,6 +107,12 @@ func NewListener(m *Manager, conn net.Conn) {
 	maxSendQBytes, _ := bytefmt.ToBytes("32k")
 	listener.Socket = NewSocket(conn, maxSendQBytes)
 
+	// Clients on TLS listeners may log in with a certificate instead of a password
+	certfp, certErr := listener.Socket.CertFP()
+	if certErr == nil {
+		listener.CertFP = certfp
+	}
+
 	hook := &HookNewListener{
 		Listener: listener,
 	}
@@ -98,6 +122,8 @@ func NewListener(m *Manager, conn net.Conn) {
 		return
 	}
 
+	m.addClient(listener)
+
 	go listener.Socket.RunSocketWriter()
 	listener.RunSocketReader()
 }
@@ -107,6 +133,61 @@ func (listener *Listener) IsCapEnabled(cap string) bool {
 	return enabled
 }
 
+// LogIn marks this listener as logged in as the given user and attaches it to the given
+// network, if the user has one by that name. clientID may be empty.
+func (listener *Listener) LogIn(user *User, clientID string, networkID string) {
+	// We may already be logged in, eg. with a certificate before the client sent PASS
+	if listener.ServerConnection != nil {
+		listener.ServerConnection.RemoveListener(listener)
+	}
+
+	listener.User = user
+	listener.ClientID = strings.ToLower(clientID)
+
+	// Users can choose to have all of their networks on one connection
+	if networkID == MultiNetworkLogin || (networkID == "" && user.MultiNetwork) {
+		listener.attachMultiNetwork()
+		listener.regLocks.Set("pass", true)
+		return
+	}
+
+	// An empty network ID may be a user logging in just to control his account or networks
+	if networkID != "" {
+		network := user.Network(networkID)
+		if network != nil {
+			network.AddListener(listener)
+			listener.ExtraISupports["BOUNCER_NETID"] = network.Name
+
+			if !network.Foo.Connected {
+				go network.Connect()
+			}
+		} else {
+			listenerLog.Warn("Network doesn't exist", "user", user.ID, "network", networkID)
+		}
+	}
+
+	listener.regLocks.Set("pass", true)
+}
+
+// tryCertLogin logs in a client with a known certificate that didn't send PASS. Clients
+// still negotiating caps may yet log in another way, so they're left until they finish.
+func (listener *Listener) tryCertLogin() {
+	if !listener.certLoginPending || listener.regLocks.Negotiating() {
+		return
+	}
+	listener.certLoginPending = false
+
+	if listener.Registered || listener.User != nil {
+		return
+	}
+
+	authedUserId, authSuccess := listener.Manager.Ds.AuthUserByCertFP(listener.CertFP)
+	if authSuccess {
+		_, clientID, networkID := splitLogin(listener.certLogin)
+		listener.LogIn(listener.Manager.User(authedUserId), clientID, networkID)
+	}
+}
+
 // tryRegistration dumps the registration blob and all if it hasn't been sent already.
 func (listener *Listener) tryRegistration() {
 	if listener.Registered {
@@ -114,7 +195,11 @@ func (listener *Listener) tryRegistration() {
 	}
 
 	if listener.regLocks.Completed() {
-		listener.DumpRegistration()
+		if listener.MultiNetwork {
+			listener.sendMultiNetworkRegistration()
+		} else {
+			listener.DumpRegistration()
+		}
 		listener.Registered = true
 		listener.DumpChannels()
 
@@ -158,11 +243,16 @@ func (listener *Listener) SendNilConnect() {
 	listener.Send(nil, listener.Source, "422", listener.ClientNick, "MOTD File is missing")
 	listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, "You are not connected to any specific network")
 	listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, fmt.Sprintf("If you want to connect to a network, connect with the server password %s/<network>:<password>", "<username>"))
+	listener.Send(nil, listener.Manager.StatusSource, "NOTICE", listener.ClientNick, fmt.Sprintf("To have all of your networks on one connection, use the server password %s/%s:<password>", "<username>", MultiNetworkLogin))
 }
 
 // DumpChannels dumps the active channels to the listener.
 func (listener *Listener) DumpChannels() {
-	if listener.ServerConnection != nil {
+	if listener.MultiNetwork {
+		for _, network := range listener.User.NetworkList() {
+			network.DumpChannels(listener)
+		}
+	} else if listener.ServerConnection != nil {
 		listener.ServerConnection.DumpChannels(listener)
 	}
 }
@@ -178,10 +268,15 @@ func (listener *Listener) RunSocketReader() {
 		listener.processIncomingLine(line)
 	}
 
+	listener.Manager.removeClient(listener)
 	listener.Manager.Bus.Dispatch(HookListenerCloseName, &HookListenerClose{
 		Listener: listener,
 	})
-	if listener.ServerConnection != nil {
+	if listener.MultiNetwork {
+		listener.savePlaybackPosition()
+		listener.detachMultiNetwork()
+	} else if listener.ServerConnection != nil {
+		listener.savePlaybackPosition()
 		listener.ServerConnection.RemoveListener(listener)
 	}
 }
@@ -192,21 +287,44 @@ func (listener *Listener) processIncomingLine(line string) {
 	// Don't let a single users error kill the entire bnc for everyone
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("[ERROR] Recovered from %s\n%s", r, debug.Stack())
+			listenerLog.Error("Recovered from panic", "panic", r, "stack", string(debug.Stack()))
 		}
 	}()
 
 	msg, parseLineErr := ircmsg.ParseLine(line)
 
+	// Multi-network listeners say which network each message is for
+	server := listener.ServerConnection
+	if listener.MultiNetwork && listener.Registered && parseLineErr == nil {
+		var demultiplexErr error
+		server, msg, demultiplexErr = listener.demultiplex(msg)
+		if demultiplexErr != nil {
+			listener.SendStatus(demultiplexErr.Error())
+			return
+		}
+	}
+
+	// Messages we store need a msgid. The hook gets its own copy of the tags so that
+	// the msgid isn't forwarded on to the server
+	hookMsg := msg
+	if parseLineErr == nil && MsgidMessages[strings.ToUpper(msg.Command)] {
+		hookMsg.Tags = make(map[string]ircmsg.TagValue, len(msg.Tags)+1)
+		for name, value := range msg.Tags {
+			hookMsg.Tags[name] = value
+		}
+		delete(hookMsg.Tags, "msgid")
+		EnsureMsgid(&hookMsg)
+	}
+
 	// Trigger the event if the line parsed or not just incase something else wants to
 	// deal with them
 	hook := &HookIrcRaw{
 		FromClient: true,
 		Listener:   listener,
 		User:       listener.User,
-		Server:     listener.ServerConnection,
+		Server:     server,
 		Raw:        line,
-		Message:    msg,
+		Message:    hookMsg,
 	}
 	listener.Manager.Bus.Dispatch(HookIrcRawName, hook)
 	if hook.Halt {
@@ -232,11 +350,13 @@ func (listener *Listener) processIncomingLine(line string) {
 	}
 
 	// Forward the data
-	if listener.Registered && listener.ServerConnection != nil {
+	if listener.Registered && listener.MultiNetwork {
+		listener.forwardMultiNetwork(server, msg)
+	} else if listener.Registered && listener.ServerConnection != nil {
 		line, _ := msg.Line()
 		_, err := listener.ServerConnection.Foo.WriteLine(line)
 		if err != nil {
-			log.Println(err.Error())
+			listenerLog.Warn("Could not forward line", "user", listener.User.ID, "network", listener.ServerConnection.Name, "error", err)
 		}
 	}
 
@@ -290,3 +410,61 @@ func (listener *Listener) SendLine(line string) {
 func (listener *Listener) SendStatus(line string) {
 	listener.Send(nil, listener.Manager.StatusSource, "PRIVMSG", listener.ClientNick, line)
 }
+
+// SendReadMarker tells the listener where the read marker for a buffer on the given
+// network is, if it has enabled draft/read-marker
+func (listener *Listener) SendReadMarker(sc *ServerConnection, buffer *ServerConnectionBuffer) {
+	if !listener.IsCapEnabled("draft/read-marker") {
+		return
+	}
+
+	timestamp := "*"
+	if !buffer.LastSeen.IsZero() {
+		timestamp = "timestamp=" + buffer.LastSeen.UTC().Format(TimestampFormat)
+	}
+
+	name := buffer.Name
+	if listener.MultiNetwork {
+		name += "/" + sc.Name
+	}
+
+	listener.Send(nil, listener.Manager.Source, "MARKREAD", name, timestamp)
+}
+
+// SendBatch sends the messages to the listener, wrapped up in a batch of the given type
+// if the listener has enabled batches
+func (listener *Listener) SendBatch(batchType string, params []string, messages []*ircmsg.IrcMessage) {
+	batchID := ""
+	if listener.IsCapEnabled("batch") {
+		batchID = MakeBatchID()
+		batchParams := append([]string{"+" + batchID, batchType}, params...)
+		listener.Send(nil, "", "BATCH", batchParams...)
+	}
+
+	for _, message := range messages {
+		if batchID != "" {
+			if message.Tags == nil {
+				message.Tags = make(map[string]ircmsg.TagValue)
+			}
+			message.Tags["batch"] = ircmsg.MakeTagValue(batchID)
+		}
+
+		err := listener.SendMessage(message)
+		if err != nil {
+			listenerLog.Error("Could not send batched message", "error", err)
+		}
+	}
+
+	if batchID != "" {
+		listener.Send(nil, "", "BATCH", "-"+batchID)
+	}
+}
+
+// MakeBatchID returns a new random batch reference
+func MakeBatchID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%X", b)
+}
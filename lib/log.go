@@ -0,0 +1,12 @@
+package ircbnc
+
+import (
+	"github.com/goshuirc/bnc/lib/logger"
+)
+
+// Loggers for the parts of the core
+var (
+	coreLog     = bncLog.New("core")
+	listenerLog = bncLog.New("listener")
+	upstreamLog = bncLog.New("upstream")
+)
@@ -0,0 +1,236 @@
+// Package bncLog is the bouncer's own log, with levels and a logger for each part of
+// the bouncer. It has no dependencies on the rest of the bouncer so that the IRC client
+// can use it too.
+package bncLog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log line is.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+// ParseLevel returns the level with the given name, eg. "debug" or "warn".
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %s, it must be debug, info, warn or error", name)
+}
+
+// Config says where the log goes and how much is written to it.
+type Config struct {
+	// Level is the least important level that gets logged, info by default
+	Level string
+	// Format is text or json
+	Format string
+	// Output is stderr, stdout or the path of a file to append to
+	Output string
+	// Subsystems override Level for parts of the bouncer, eg. {"upstream": "debug"}
+	Subsystems map[string]string
+}
+
+// state is the current config, shared by every Logger
+var state = struct {
+	sync.RWMutex
+	level      Level
+	subsystems map[string]Level
+	json       bool
+	output     io.Writer
+	file       *os.File
+}{
+	level:  LevelInfo,
+	output: os.Stderr,
+}
+
+// Configure applies a logging config, opening the output file if there is one. If the
+// config isn't valid, the current one is kept.
+func Configure(config Config) error {
+	level := LevelInfo
+	var err error
+	if config.Level != "" {
+		level, err = ParseLevel(config.Level)
+		if err != nil {
+			return err
+		}
+	}
+
+	subsystems := make(map[string]Level)
+	for subsystem, levelName := range config.Subsystems {
+		subsystems[subsystem], err = ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+	}
+
+	var useJSON bool
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+	case "json":
+		useJSON = true
+	default:
+		return errors.New("Unknown log format " + config.Format + ", it must be text or json")
+	}
+
+	var output io.Writer
+	var file *os.File
+	switch config.Output {
+	case "", "stderr":
+		output = os.Stderr
+	case "stdout":
+		output = os.Stdout
+	default:
+		file, err = os.OpenFile(config.Output, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+
+	state.Lock()
+	oldFile := state.file
+	state.level = level
+	state.subsystems = subsystems
+	state.json = useJSON
+	state.output = output
+	state.file = file
+	state.Unlock()
+
+	// Reopening the file each time we're configured lets logs be rotated with a rehash
+	if oldFile != nil {
+		oldFile.Close()
+	}
+	return nil
+}
+
+// Logger writes log lines for one part of the bouncer.
+type Logger struct {
+	subsystem string
+}
+
+// New returns a logger for the given subsystem, eg. "listener" or "datastore".
+// Components are named "components.<name>" so that they can be configured together.
+func New(subsystem string) *Logger {
+	return &Logger{
+		subsystem: subsystem,
+	}
+}
+
+// Enabled returns true if lines at the given level are being logged. It saves building
+// expensive log lines that would be thrown away.
+func (logger *Logger) Enabled(level Level) bool {
+	state.RLock()
+	defer state.RUnlock()
+	return level >= logger.minLevel()
+}
+
+// minLevel returns the least important level this logger writes. state must be locked.
+func (logger *Logger) minLevel() Level {
+	if level, exists := state.subsystems[logger.subsystem]; exists {
+		return level
+	}
+	if idx := strings.Index(logger.subsystem, "."); idx != -1 {
+		if level, exists := state.subsystems[logger.subsystem[:idx]]; exists {
+			return level
+		}
+	}
+	return state.level
+}
+
+// Debug, Info, Warn and Error log a message along with key/value pairs describing it,
+// eg. logger.Info("Connected", "network", name, "address", address)
+func (logger *Logger) Debug(message string, fields ...interface{}) {
+	logger.log(LevelDebug, message, fields)
+}
+
+func (logger *Logger) Info(message string, fields ...interface{}) {
+	logger.log(LevelInfo, message, fields)
+}
+
+func (logger *Logger) Warn(message string, fields ...interface{}) {
+	logger.log(LevelWarn, message, fields)
+}
+
+func (logger *Logger) Error(message string, fields ...interface{}) {
+	logger.log(LevelError, message, fields)
+}
+
+// Fatal logs an error and exits.
+func (logger *Logger) Fatal(message string, fields ...interface{}) {
+	logger.log(LevelError, message, fields)
+	os.Exit(1)
+}
+
+func (logger *Logger) log(level Level, message string, fields []interface{}) {
+	state.RLock()
+	defer state.RUnlock()
+
+	if level < logger.minLevel() {
+		return
+	}
+
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+
+	var line string
+	if state.json {
+		entry := map[string]interface{}{
+			"time":      now,
+			"level":     level.String(),
+			"subsystem": logger.subsystem,
+			"msg":       message,
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry[fmt.Sprint(fields[i])] = fieldValue(fields[i+1])
+		}
+		encoded, _ := json.Marshal(entry)
+		line = string(encoded)
+	} else {
+		var text strings.Builder
+		fmt.Fprintf(&text, "%s %-5s [%s] %s", now, strings.ToUpper(level.String()), logger.subsystem, message)
+		for i := 0; i+1 < len(fields); i += 2 {
+			value := fmt.Sprint(fieldValue(fields[i+1]))
+			if value == "" || strings.ContainsAny(value, " \"=") {
+				value = fmt.Sprintf("%q", value)
+			}
+			fmt.Fprintf(&text, " %s=%s", fields[i], value)
+		}
+		line = text.String()
+	}
+
+	fmt.Fprintln(state.output, line)
+}
+
+// fieldValue turns errors into their message so that they show up in JSON
+func fieldValue(value interface{}) interface{} {
+	if err, isErr := value.(error); isErr {
+		return err.Error()
+	}
+	return value
+}
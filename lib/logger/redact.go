@@ -0,0 +1,96 @@
+package bncLog
+
+import (
+	"strings"
+)
+
+// redacted replaces secrets in the lines we log
+const redacted = "<redacted>"
+
+// saslMechanisms are the AUTHENTICATE parameters that can be logged as they are
+var saslMechanisms = map[string]bool{
+	"PLAIN":                    true,
+	"EXTERNAL":                 true,
+	"SCRAM-SHA-1":              true,
+	"SCRAM-SHA-256":            true,
+	"SCRAM-SHA-512":            true,
+	"ECDSA-NIST256P-CHALLENGE": true,
+}
+
+// nickServCommands are the NickServ commands that have a password in them
+var nickServCommands = map[string]bool{
+	"IDENTIFY": true,
+	"ID":       true,
+	"LOGIN":    true,
+	"REGISTER": true,
+	"GHOST":    true,
+	"RECOVER":  true,
+	"REGAIN":   true,
+	"RELEASE":  true,
+	"SET":      true,
+	"CONFIRM":  true,
+}
+
+// RedactLine hides the passwords in a raw IRC line so that it can be logged, eg. in
+// PASS, OPER and AUTHENTICATE, and messages to NickServ.
+func RedactLine(line string) string {
+	// Skip over the tags and prefix to find the command
+	rest := line
+	var start string
+	for _, marker := range []string{"@", ":"} {
+		if strings.HasPrefix(rest, marker) {
+			end := strings.Index(rest, " ")
+			if end == -1 {
+				return line
+			}
+			start += rest[:end+1]
+			rest = rest[end+1:]
+		}
+	}
+
+	command := rest
+	var params string
+	if idx := strings.Index(rest, " "); idx != -1 {
+		command, params = rest[:idx], rest[idx+1:]
+	}
+	start += command + " "
+
+	switch strings.ToUpper(command) {
+	case "PASS":
+		return start + redacted
+
+	case "OPER":
+		name := strings.SplitN(params, " ", 2)[0]
+		return start + name + " " + redacted
+
+	case "AUTHENTICATE":
+		// Mechanism names, aborts and empty responses are fine to log
+		param := strings.TrimPrefix(params, ":")
+		if param == "+" || param == "*" || saslMechanisms[strings.ToUpper(param)] {
+			return line
+		}
+		return start + redacted
+
+	case "NICKSERV", "NS":
+		return start + redactNickServ(strings.TrimPrefix(params, ":"))
+
+	case "PRIVMSG", "NOTICE":
+		parts := strings.SplitN(params, " ", 2)
+		target := strings.ToLower(parts[0])
+		if len(parts) < 2 || (target != "nickserv" && !strings.HasPrefix(target, "nickserv@")) {
+			return line
+		}
+		return start + parts[0] + " :" + redactNickServ(strings.TrimPrefix(parts[1], ":"))
+	}
+
+	return line
+}
+
+// redactNickServ hides everything after a NickServ command that could contain a password
+func redactNickServ(text string) string {
+	words := strings.SplitN(text, " ", 2)
+	if len(words) < 2 || !nickServCommands[strings.ToUpper(words[0])] {
+		return text
+	}
+	return words[0] + " " + redacted
+}
@@ -0,0 +1,58 @@
+package bncLog
+
+import (
+	"testing"
+)
+
+func TestRedactLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		// PASS
+		{"PASS hunter2", "PASS <redacted>"},
+		{"PASS :hunter2 with spaces", "PASS <redacted>"},
+		{"pass hunter2", "pass <redacted>"},
+		{"@label=1 PASS hunter2", "@label=1 PASS <redacted>"},
+		{":dan!d@localhost PASS hunter2", ":dan!d@localhost PASS <redacted>"},
+		{"@label=1 :dan!d@localhost PASS hunter2", "@label=1 :dan!d@localhost PASS <redacted>"},
+
+		// OPER
+		{"OPER dan hunter2", "OPER dan <redacted>"},
+		{"@label=2 OPER dan :hunter2", "@label=2 OPER dan <redacted>"},
+
+		// AUTHENTICATE
+		{"AUTHENTICATE PLAIN", "AUTHENTICATE PLAIN"},
+		{"AUTHENTICATE scram-sha-256", "AUTHENTICATE scram-sha-256"},
+		{"AUTHENTICATE +", "AUTHENTICATE +"},
+		{"AUTHENTICATE *", "AUTHENTICATE *"},
+		{"AUTHENTICATE ZGFuAGRhbgBodW50ZXIy", "AUTHENTICATE <redacted>"},
+		{":irc.example.com AUTHENTICATE :ZGFuAGRhbgBodW50ZXIy", ":irc.example.com AUTHENTICATE <redacted>"},
+
+		// NickServ
+		{"PRIVMSG NickServ :IDENTIFY hunter2", "PRIVMSG NickServ :IDENTIFY <redacted>"},
+		{"PRIVMSG nickserv :identify dan hunter2", "PRIVMSG nickserv :identify <redacted>"},
+		{"PRIVMSG NickServ@services.example.com :GHOST dan hunter2", "PRIVMSG NickServ@services.example.com :GHOST <redacted>"},
+		{"@+draft/reply=1 :dan!d@localhost PRIVMSG NickServ :REGISTER hunter2 dan@example.com", "@+draft/reply=1 :dan!d@localhost PRIVMSG NickServ :REGISTER <redacted>"},
+		{"NOTICE NickServ :LOGIN dan hunter2", "NOTICE NickServ :LOGIN <redacted>"},
+		{"NICKSERV IDENTIFY hunter2", "NICKSERV IDENTIFY <redacted>"},
+		{"NS :id hunter2", "NS id <redacted>"},
+		{"PRIVMSG NickServ :INFO dan", "PRIVMSG NickServ :INFO dan"},
+		{"PRIVMSG NickServ :IDENTIFY", "PRIVMSG NickServ :IDENTIFY"},
+
+		// Lines without secrets are left alone
+		{"PRIVMSG #chat :IDENTIFY hunter2", "PRIVMSG #chat :IDENTIFY hunter2"},
+		{"NICK dan", "NICK dan"},
+		{"@label=1 :dan!d@localhost NICK dan", "@label=1 :dan!d@localhost NICK dan"},
+		{"@label=1", "@label=1"},
+		{":dan!d@localhost", ":dan!d@localhost"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		got := RedactLine(test.line)
+		if got != test.want {
+			t.Errorf("RedactLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
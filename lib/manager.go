@@ -7,20 +7,29 @@ package ircbnc
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/goshuirc/bnc/lib/logger"
 )
 
 var (
 	// QuitSignals is the list of signals we quit on
-	//TODO(dan): Rehash on one of these signals instead, same as Oragono.
-	QuitSignals = []os.Signal{syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT}
+	QuitSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT}
+	// RehashSignals is the list of signals we reload our config on
+	RehashSignals = []os.Signal{syscall.SIGHUP}
 	// BNC: The global instance of Manager.
 	// TODO: NewManager() sets this each time it's run. It's only run once so no issue.. but it's not tidy
 	BNC *Manager
+
+	// how long we give servers and clients to receive our goodbyes when shutting down
+	shutdownTimeout = 5 * time.Second
 )
 
 // Manager handles the different components that keep GoshuBNC spinning.
@@ -29,11 +38,25 @@ type Manager struct {
 	Ds       DataStoreInterface
 	Messages MessageDatastore
 
+	// Users should be looked at and changed through User, UserList, AddUser and
+	// DeleteUser, which hold usersLock. It also covers the Networks of every user.
 	Users     map[string]*User
-	Listeners []net.Listener
+	usersLock sync.RWMutex
+	Listeners map[string]net.Listener
+	// WebSocketListeners are the listeners browser clients connect to
+	WebSocketListeners map[string]net.Listener
+
+	// clients holds every Listener currently connected to us
+	clients     map[*Listener]bool
+	clientsLock sync.Mutex
+
+	// tlsCerts holds the current certificate for each TLS listener address
+	tlsCerts     map[string]*tls.Certificate
+	tlsCertsLock sync.RWMutex
 
-	newConns    chan net.Conn
-	quitSignals chan os.Signal
+	newConns      chan net.Conn
+	quitSignals   chan os.Signal
+	rehashSignals chan os.Signal
 
 	Source       string
 	StatusNick   string
@@ -56,8 +79,13 @@ func NewManager(config *Config, ds DataStoreInterface) *Manager {
 
 	m.newConns = make(chan net.Conn)
 	m.quitSignals = make(chan os.Signal, len(QuitSignals))
+	m.rehashSignals = make(chan os.Signal, len(RehashSignals))
 
 	m.Users = make(map[string]*User)
+	m.Listeners = make(map[string]net.Listener)
+	m.WebSocketListeners = make(map[string]net.Listener)
+	m.clients = make(map[*Listener]bool)
+	m.tlsCerts = make(map[string]*tls.Certificate)
 
 	// source on our outgoing message/status bot/etc
 	m.StatusNick = "*status"
@@ -69,6 +97,8 @@ func NewManager(config *Config, ds DataStoreInterface) *Manager {
 
 // Run starts the bouncer, creating the listeners and server connections.
 func (m *Manager) Run() error {
+	signal.Notify(m.quitSignals, QuitSignals...)
+	signal.Notify(m.rehashSignals, RehashSignals...)
 
 	// load users
 	users := m.Ds.GetAllUsers()
@@ -79,37 +109,16 @@ func (m *Manager) Run() error {
 
 	// open listeners
 	for _, address := range m.Config.Bouncer.Listeners {
-		config, listenTLS := m.Config.Bouncer.TLSListeners[address]
-
-		listener, err := net.Listen("tcp", address)
+		err := m.openListener(address, m.Config.Bouncer.TLSListeners[address])
 		if err != nil {
-			log.Fatal(address, "listen error: ", err)
+			coreLog.Fatal("Could not open listener", "error", err)
 		}
-
-		tlsString := "plaintext"
-		if listenTLS {
-			tlsConfig, err := config.Config()
-			if err != nil {
-				log.Fatal(address, "tls listen error: ", err)
-			}
-			listener = tls.NewListener(listener, tlsConfig)
-			tlsString = "TLS"
+	}
+	for _, address := range m.Config.Bouncer.WebSocketListeners {
+		err := m.openWebSocketListener(address, m.Config.Bouncer.TLSListeners[address])
+		if err != nil {
+			coreLog.Fatal("Could not open websocket listener", "error", err)
 		}
-		fmt.Println(fmt.Sprintf("listening on %s using %s.", address, tlsString))
-
-		go func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					fmt.Println(fmt.Sprintf("%s accept error: %s", address, err))
-				}
-				fmt.Println(fmt.Sprintf("%s accept: %s", address, conn.RemoteAddr()))
-
-				m.newConns <- conn
-			}
-		}()
-
-		m.Listeners = append(m.Listeners, listener)
 	}
 
 	// and wait
@@ -117,9 +126,13 @@ func (m *Manager) Run() error {
 	for !done {
 		select {
 		case <-m.quitSignals:
-			//TODO(dan): Write real shutdown code
-			log.Fatal("Shutting down! (TODO: write real shutdown code)")
+			m.Shutdown()
 			done = true
+		case <-m.rehashSignals:
+			err := m.Rehash()
+			if err != nil {
+				coreLog.Error("Could not rehash", "error", err)
+			}
 		case conn := <-m.newConns:
 			go NewListener(m, conn)
 		}
@@ -127,3 +140,251 @@ func (m *Manager) Run() error {
 
 	return nil
 }
+
+// listen opens a TCP listener on the given address, using TLS if tlsConf is set. It
+// also returns what kind of listener it is, for logging.
+func (m *Manager) listen(address string, tlsConf *TLSListenConfig) (net.Listener, string, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s listen error: %s", address, err.Error())
+	}
+
+	tlsString := "plaintext"
+	if tlsConf != nil {
+		cert, err := tlsConf.Certificate()
+		if err != nil {
+			listener.Close()
+			return nil, "", fmt.Errorf("%s tls listen error: %s", address, err.Error())
+		}
+		m.setTLSCert(address, cert)
+
+		// Certificates are looked up for each new connection so that they can be
+		// swapped out during a rehash without touching the listener
+		tlsConfig := &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return m.getTLSCert(address), nil
+			},
+			// Ask for a client certificate so users can log in with their CertFP
+			ClientAuth: tls.RequestClientCert,
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		tlsString = "TLS"
+	}
+
+	return listener, tlsString, nil
+}
+
+// openListener starts listening on the given address, using TLS if tlsConf is set.
+func (m *Manager) openListener(address string, tlsConf *TLSListenConfig) error {
+	listener, tlsString, err := m.listen(address, tlsConf)
+	if err != nil {
+		return err
+	}
+	listenerLog.Info("Listening", "address", address, "type", tlsString)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// we closed this listener ourselves
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				listenerLog.Warn("Accept error", "address", address, "error", err)
+				continue
+			}
+			listenerLog.Debug("Accepted connection", "address", address, "remote", conn.RemoteAddr())
+
+			m.newConns <- conn
+		}
+	}()
+
+	m.Listeners[address] = listener
+	return nil
+}
+
+// closeListener stops listening on the given address, which is one of listeners.
+func (m *Manager) closeListener(listeners map[string]net.Listener, address string) {
+	listener, exists := listeners[address]
+	if !exists {
+		return
+	}
+
+	delete(listeners, address)
+	listener.Close()
+	m.setTLSCert(address, nil)
+	listenerLog.Info("Stopped listening", "address", address)
+}
+
+func (m *Manager) getTLSCert(address string) *tls.Certificate {
+	m.tlsCertsLock.RLock()
+	defer m.tlsCertsLock.RUnlock()
+	return m.tlsCerts[address]
+}
+
+func (m *Manager) setTLSCert(address string, cert *tls.Certificate) {
+	m.tlsCertsLock.Lock()
+	defer m.tlsCertsLock.Unlock()
+	if cert == nil {
+		delete(m.tlsCerts, address)
+	} else {
+		m.tlsCerts[address] = cert
+	}
+}
+
+// addClient keeps track of a newly connected Listener.
+func (m *Manager) addClient(listener *Listener) {
+	m.clientsLock.Lock()
+	m.clients[listener] = true
+	m.clientsLock.Unlock()
+}
+
+// removeClient stops keeping track of a Listener that has disconnected.
+func (m *Manager) removeClient(listener *Listener) {
+	m.clientsLock.Lock()
+	delete(m.clients, listener)
+	m.clientsLock.Unlock()
+}
+
+// Clients returns all of the Listeners currently connected to us.
+func (m *Manager) Clients() []*Listener {
+	m.clientsLock.Lock()
+	defer m.clientsLock.Unlock()
+
+	clients := make([]*Listener, 0, len(m.clients))
+	for listener := range m.clients {
+		clients = append(clients, listener)
+	}
+	return clients
+}
+
+// Rehash reloads our config file and applies any listener, TLS and logging changes
+// without dropping established sessions.
+func (m *Manager) Rehash() error {
+	coreLog.Info("Rehashing config", "file", m.Config.Filename)
+
+	newConfig, err := LoadConfig(m.Config.Filename)
+	if err != nil {
+		return err
+	}
+	oldConfig := m.Config
+
+	// Reopening the log here also lets it be rotated
+	err = bncLog.Configure(newConfig.Bouncer.Log)
+	if err != nil {
+		coreLog.Error("Keeping the old log config, could not use the new one", "error", err)
+	}
+
+	// Everything is closed before anything is opened, so that an address can switch
+	// between plain and WebSocket listeners
+	m.updateListeners(m.Listeners, oldConfig, newConfig, newConfig.Bouncer.Listeners)
+	m.updateListeners(m.WebSocketListeners, oldConfig, newConfig, newConfig.Bouncer.WebSocketListeners)
+	m.openNewListeners(m.Listeners, newConfig, newConfig.Bouncer.Listeners, m.openListener)
+	m.openNewListeners(m.WebSocketListeners, newConfig, newConfig.Bouncer.WebSocketListeners, m.openWebSocketListener)
+
+	m.Config = newConfig
+	for _, user := range m.UserList() {
+		user.Config = newConfig
+	}
+
+	m.Bus.Dispatch(HookRehashName, &HookRehash{
+		OldConfig: oldConfig,
+		NewConfig: newConfig,
+	})
+
+	coreLog.Info("Rehash complete")
+	return nil
+}
+
+// updateListeners closes the listeners the new config doesn't want and reloads the
+// certificates of the rest. addresses are where the new config wants this kind of listener.
+func (m *Manager) updateListeners(listeners map[string]net.Listener, oldConfig *Config, newConfig *Config, addresses []string) {
+	// Close listeners we no longer want, or that have switched between plaintext and TLS
+	wanted := make(map[string]bool)
+	for _, address := range addresses {
+		wanted[address] = true
+	}
+	for address := range listeners {
+		_, wasTLS := oldConfig.Bouncer.TLSListeners[address]
+		_, isTLS := newConfig.Bouncer.TLSListeners[address]
+		if !wanted[address] || wasTLS != isTLS {
+			m.closeListener(listeners, address)
+		}
+	}
+
+	// Reload the certificates for any TLS listeners we're keeping
+	for address := range listeners {
+		tlsConf, isTLS := newConfig.Bouncer.TLSListeners[address]
+		if !isTLS {
+			continue
+		}
+
+		cert, err := tlsConf.Certificate()
+		if err != nil {
+			listenerLog.Error("Keeping the old certificate, could not load the new one", "address", address, "error", err)
+			continue
+		}
+		m.setTLSCert(address, cert)
+	}
+}
+
+// openNewListeners opens the listeners the new config wants that aren't open yet, using open.
+func (m *Manager) openNewListeners(listeners map[string]net.Listener, newConfig *Config, addresses []string, open func(string, *TLSListenConfig) error) {
+	for _, address := range addresses {
+		if _, exists := listeners[address]; exists {
+			continue
+		}
+
+		err := open(address, newConfig.Bouncer.TLSListeners[address])
+		if err != nil {
+			listenerLog.Error("Could not open listener", "error", err)
+		}
+	}
+}
+
+// Shutdown disconnects everything cleanly, saying goodbye to servers and clients and
+// closing our datastores.
+func (m *Manager) Shutdown() {
+	coreLog.Info("Shutting down")
+
+	// Stop accepting new clients
+	for address := range m.Listeners {
+		m.closeListener(m.Listeners, address)
+	}
+	for address := range m.WebSocketListeners {
+		m.closeListener(m.WebSocketListeners, address)
+	}
+
+	// Say goodbye to the networks we're connected to
+	for _, user := range m.UserList() {
+		for _, sc := range user.NetworkList() {
+			sc.Quit(m.Config.Bouncer.QuitMessage)
+		}
+	}
+
+	// And to every client attached to us
+	var clients []*Listener
+	for _, listener := range m.Clients() {
+		listener.Socket.SetFinalData(fmt.Sprintf("ERROR :%s\r\n", m.Config.Bouncer.QuitMessage))
+		listener.Socket.Close()
+		clients = append(clients, listener)
+	}
+
+	// Give the ERRORs a moment to make it out before we pull the plug
+	deadline := time.Now().Add(shutdownTimeout)
+	for _, listener := range clients {
+		listener.Socket.WaitUntilClosed(time.Until(deadline))
+	}
+
+	if m.Messages != nil {
+		err := m.Messages.Close()
+		if err != nil {
+			coreLog.Error("Could not close the message store", "error", err)
+		}
+	}
+
+	err := m.Ds.Close()
+	if err != nil {
+		coreLog.Error("Could not close the datastore", "error", err)
+	}
+}
@@ -1,18 +1,85 @@
 package ircbnc
 
 import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+// TimestampFormat is the format used for IRCv3 message timestamps
+const TimestampFormat = "2006-01-02T15:04:05.000Z"
+
+// BatchTypeSearch is the batch that search results are sent to clients in
+const BatchTypeSearch = "goshuirc.net/search"
+
+// HistoryTarget is a buffer that has had messages within a period of time
+type HistoryTarget struct {
+	Name       string
+	LatestTime time.Time
+}
+
 type MessageDatastore interface {
 	Store(hookEvent *HookIrcRaw)
 	GetFromTime(userID string, networkID string, bufferName string, timeFrom time.Time, num int) []*ircmsg.IrcMessage
 	GetBeforeTime(userID string, networkID string, bufferName string, timeFrom time.Time, num int) []*ircmsg.IrcMessage
-	Search(userID string, networkID string, bufferName string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage
+	// GetBetweenTime returns the first num messages after timeFrom and before timeTo. If
+	// timeFrom is later than timeTo, it returns the last num messages before timeFrom.
+	GetBetweenTime(userID string, networkID string, bufferName string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage
+	// CountBetweenTime returns how many messages there are between the given times
+	CountBetweenTime(userID string, networkID string, bufferName string, timeFrom time.Time, timeTo time.Time) int
+	// GetTargets returns the buffers with messages between the given times, ordered by
+	// the time of their latest message
+	GetTargets(userID string, networkID string, timeFrom time.Time, timeTo time.Time, num int) []HistoryTarget
+	// GetMsgidTime returns the time of the message with the given msgid
+	GetMsgidTime(userID string, networkID string, msgid string) (time.Time, bool)
+	// GetByMsgid returns the message with the given msgid
+	GetByMsgid(userID string, networkID string, msgid string) (*ircmsg.IrcMessage, bool)
+	// Search returns the latest num messages between the given times that contain every
+	// word in query. An empty bufferName searches every buffer on the network.
+	Search(userID string, networkID string, bufferName string, query string, timeFrom time.Time, timeTo time.Time, num int) []*ircmsg.IrcMessage
 
 	SupportsStore() bool
 	SupportsRetrieve() bool
 	SupportsSearch() bool
+
+	// Close finishes writing any queued messages and closes the store
+	Close() error
+}
+
+// MsgidMessages are the commands that get a msgid tag if they don't already have one
+var MsgidMessages = map[string]bool{
+	"PRIVMSG": true,
+	"NOTICE":  true,
+	"TAGMSG":  true,
+}
+
+// GenerateMsgid returns a new random message ID
+func GenerateMsgid() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+// EnsureMsgid gives the message a msgid tag if it should have one and doesn't already.
+// Messages from servers with message-tags keep the msgid the server gave them.
+func EnsureMsgid(message *ircmsg.IrcMessage) {
+	if !MsgidMessages[strings.ToUpper(message.Command)] {
+		return
+	}
+
+	if message.Tags == nil {
+		message.Tags = make(map[string]ircmsg.TagValue)
+	}
+
+	existing, exists := message.Tags["msgid"]
+	if exists && existing.HasValue && existing.Value != "" {
+		return
+	}
+
+	message.Tags["msgid"] = ircmsg.MakeTagValue(GenerateMsgid())
 }
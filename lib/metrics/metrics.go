@@ -0,0 +1,166 @@
+// Package bncMetrics keeps the counters the bouncer exposes to Prometheus. It has no
+// dependencies of its own so that both the bouncer and the IRC client can update them.
+package bncMetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters and gauges updated from the core as things happen
+var (
+	// ClientLinesIn and ClientLinesOut count lines read from and written to clients
+	ClientLinesIn  Counter
+	ClientLinesOut Counter
+	// ServerLinesIn and ServerLinesOut count lines read from and written to networks
+	ServerLinesIn  Counter
+	ServerLinesOut Counter
+	// SendQDrops counts clients disconnected for having too much waiting to be sent
+	SendQDrops Counter
+
+	// StoreQueueDepth is how many messages are waiting to be written to the message store
+	StoreQueueDepth Gauge
+	// StoreWriteSeconds is how long writing each message to the message store takes
+	StoreWriteSeconds = NewHistogram([]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+)
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Histogram counts observations into buckets, eg. how long something took.
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram returns a histogram with the given upper bounds, in increasing order.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince records how long it's been since start, in seconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// labelEscaper escapes label values the way the Prometheus text format wants
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Labels are the label names and values of a metric, eg. {"user": "dan"}
+type Labels map[string]string
+
+func (labels Labels) String() string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(labels[name]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Writer writes metrics in the Prometheus text format.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Header describes the metric whose values follow. kind is counter, gauge or histogram.
+func (w *Writer) Header(name string, kind string, help string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w.w, "# TYPE %s %s\n", name, kind)
+}
+
+func (w *Writer) Value(name string, labels Labels, value float64) {
+	fmt.Fprintf(w.w, "%s%s %s\n", name, labels, formatValue(value))
+}
+
+// Histogram writes the buckets, sum and count of a histogram.
+func (w *Writer) Histogram(name string, labels Labels, h *Histogram) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	bucketLabels := Labels{}
+	for label, value := range labels {
+		bucketLabels[label] = value
+	}
+	for i, bound := range h.buckets {
+		bucketLabels["le"] = formatValue(bound)
+		w.Value(name+"_bucket", bucketLabels, float64(h.counts[i]))
+	}
+	bucketLabels["le"] = "+Inf"
+	w.Value(name+"_bucket", bucketLabels, float64(h.count))
+	w.Value(name+"_sum", labels, h.sum)
+	w.Value(name+"_count", labels, float64(h.count))
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,258 @@
+package ircbnc
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/goshuirc/bnc/lib/ircclient"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// Multi-network listeners have every one of the user's networks on a single connection,
+// for clients that don't support any bouncer extensions. Channels and nicks are given
+// a "/<network>" suffix, eg. #chan/freenode, so the client can tell them apart.
+
+// MultiNetworkLogin is the network name used to log in to multi-network mode, eg.
+// a PASS of "<username>/*:<password>".
+const MultiNetworkLogin = "*"
+
+// multiNetworkTargets lists the params of each command that hold a channel or nick.
+// Numerics all have our own nick as their first param which is handled separately.
+var multiNetworkTargets = map[string][]int{
+	"PRIVMSG": {0},
+	"NOTICE":  {0},
+	"TAGMSG":  {0},
+	"JOIN":    {0},
+	"PART":    {0},
+	"TOPIC":   {0},
+	"MODE":    {0},
+	"KICK":    {0, 1},
+	"INVITE":  {0, 1},
+	"NICK":    {0},
+	"NAMES":   {0},
+	"WHO":     {0},
+	"WHOIS":   {0},
+	"WHOWAS":  {0},
+
+	ircclient.RPL_CHANNELMODEIS: {1},
+	ircclient.RPL_NOTOPIC:       {1},
+	ircclient.RPL_TOPIC:         {1},
+	ircclient.RPL_TOPICTIME:     {1},
+	ircclient.RPL_NAMREPLY:      {2},
+	ircclient.RPL_ENDOFNAMES:    {1},
+	"311":                       {1}, // RPL_WHOISUSER
+	"312":                       {1}, // RPL_WHOISSERVER
+	"318":                       {1}, // RPL_ENDOFWHOIS
+	"319":                       {1}, // RPL_WHOISCHANNELS
+	"329":                       {1}, // RPL_CREATIONTIME
+	"352":                       {1}, // RPL_WHOREPLY
+	"315":                       {1}, // RPL_ENDOFWHO
+	"401":                       {1}, // ERR_NOSUCHNICK
+	"403":                       {1}, // ERR_NOSUCHCHANNEL
+	"404":                       {1}, // ERR_CANNOTSENDTOCHAN
+	"442":                       {1}, // ERR_NOTONCHANNEL
+	"471":                       {1}, // ERR_CHANNELISFULL
+	"473":                       {1}, // ERR_INVITEONLYCHAN
+	"474":                       {1}, // ERR_BANNEDFROMCHAN
+	"475":                       {1}, // ERR_BADCHANNELKEY
+	"482":                       {1}, // ERR_CHANOPRIVSNEEDED
+}
+
+// multiNetworkBroadcasts are sent on to every network when they don't name one
+var multiNetworkBroadcasts = map[string]bool{
+	"AWAY": true,
+	"NICK": true,
+}
+
+// isNumeric returns true if the command is a numeric reply
+func isNumeric(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+	for _, char := range command {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// SendMessageFrom sends a message that came from the given network to the listener,
+// adding the network to any channels and nicks if it's a multi-network listener.
+func (listener *Listener) SendMessageFrom(sc *ServerConnection, msg *ircmsg.IrcMessage) error {
+	if !listener.MultiNetwork {
+		return listener.SendMessage(msg)
+	}
+
+	rewritten := *msg
+	rewritten.Params = make([]string, len(msg.Params))
+	copy(rewritten.Params, msg.Params)
+
+	ownNick := strings.ToLower(sc.Foo.Nick)
+	suffix := func(name string) string {
+		if name == "" || name == "*" {
+			return name
+		}
+		if strings.ToLower(name) == ownNick {
+			return listener.ClientNick
+		}
+		return name + "/" + sc.Name
+	}
+
+	// Users get their nick suffixed. Servers are left alone
+	if strings.Contains(rewritten.Prefix, "!") {
+		nick, username, host := SplitMask(rewritten.Prefix)
+		rewritten.Prefix = suffix(nick) + "!" + username + "@" + host
+	}
+
+	if isNumeric(rewritten.Command) && len(rewritten.Params) > 0 {
+		rewritten.Params[0] = listener.ClientNick
+	}
+
+	for _, idx := range multiNetworkTargets[rewritten.Command] {
+		if idx < len(rewritten.Params) {
+			rewritten.Params[idx] = suffix(rewritten.Params[idx])
+		}
+	}
+
+	// Every member in a NAMES reply gets suffixed, keeping their prefixes
+	if rewritten.Command == ircclient.RPL_NAMREPLY && len(rewritten.Params) >= 4 {
+		names := strings.Fields(rewritten.Params[3])
+		for i, name := range names {
+			prefixes, mask := sc.splitNamesPrefix(name)
+			nick, username, host := SplitMask(mask)
+			name = prefixes + suffix(nick)
+			if username != "" || host != "" {
+				name += "!" + username + "@" + host
+			}
+			names[i] = name
+		}
+		rewritten.Params[3] = strings.Join(names, " ")
+	}
+
+	return listener.SendMessage(&rewritten)
+}
+
+// sendToListener builds a message from this network and sends it to the listener
+func (sc *ServerConnection) sendToListener(listener *Listener, prefix string, command string, params ...string) {
+	msg := ircmsg.MakeMessage(nil, prefix, command, params...)
+	listener.SendMessageFrom(sc, &msg)
+}
+
+// demultiplex works out which network a message from a multi-network listener is for,
+// returning the message with the network suffixes removed. Messages without a network
+// return nil, and messages naming more than one network return an error.
+func (listener *Listener) demultiplex(msg ircmsg.IrcMessage) (*ServerConnection, ircmsg.IrcMessage, error) {
+	rewritten := msg
+	rewritten.Params = make([]string, len(msg.Params))
+	copy(rewritten.Params, msg.Params)
+
+	var network *ServerConnection
+	for _, idx := range multiNetworkTargets[strings.ToUpper(msg.Command)] {
+		if idx >= len(rewritten.Params) {
+			continue
+		}
+
+		// JOIN and PART may be given a comma separated list, which all need to be on
+		// the same network
+		targets := strings.Split(rewritten.Params[idx], ",")
+		for i, target := range targets {
+			sc, name := listener.splitNetworkTarget(target)
+			if sc == nil {
+				if len(targets) > 1 {
+					return nil, msg, errors.New("Add /<network> to every channel in the list, eg. #a/network,#b/network")
+				}
+				continue
+			}
+			if network != nil && sc != network {
+				return nil, msg, errors.New("Every channel and nick in a command must be on the same network")
+			}
+
+			network = sc
+			targets[i] = name
+		}
+		rewritten.Params[idx] = strings.Join(targets, ",")
+	}
+
+	return network, rewritten, nil
+}
+
+// splitNetworkTarget splits the network off a channel or nick from a multi-network
+// listener, eg. #chan/network. Targets without a known network return nil.
+func (listener *Listener) splitNetworkTarget(target string) (*ServerConnection, string) {
+	pos := strings.LastIndex(target, "/")
+	if pos == -1 {
+		return nil, target
+	}
+
+	sc := listener.User.NetworkByName(target[pos+1:])
+	if sc == nil {
+		return nil, target
+	}
+	return sc, target[:pos]
+}
+
+// forwardMultiNetwork sends a line from a multi-network listener on to the right network
+func (listener *Listener) forwardMultiNetwork(sc *ServerConnection, msg ircmsg.IrcMessage) {
+	line, err := msg.Line()
+	if err != nil {
+		return
+	}
+
+	if sc != nil {
+		sc.Foo.WriteLine("%s", line)
+		return
+	}
+
+	if multiNetworkBroadcasts[strings.ToUpper(msg.Command)] {
+		for _, network := range listener.User.NetworkList() {
+			if network.Foo.Connected {
+				network.Foo.WriteLine("%s", line)
+			}
+		}
+		return
+	}
+
+	listener.SendStatus("Add /<network> to the channel or nick you're talking to, eg. #chan/network")
+}
+
+// attachMultiNetwork attaches the listener to every one of the user's networks,
+// connecting to any that aren't connected, the same as logging in to a single network.
+func (listener *Listener) attachMultiNetwork() {
+	listener.MultiNetwork = true
+	for _, network := range listener.User.NetworkList() {
+		network.AddListener(listener)
+
+		if !network.Foo.Connected && !listener.User.Disabled {
+			go network.Connect()
+		}
+	}
+}
+
+// detachMultiNetwork removes the listener from every network it's attached to.
+func (listener *Listener) detachMultiNetwork() {
+	for _, network := range listener.User.NetworkList() {
+		network.RemoveListener(listener)
+	}
+}
+
+// sendMultiNetworkRegistration welcomes a multi-network listener and joins it to the
+// channels of every network.
+func (listener *Listener) sendMultiNetworkRegistration() {
+	nick := listener.ClientNick
+	listener.Send(nil, listener.Source, ircclient.RPL_WELCOME, nick, "- Welcome to GoshuBNC -")
+	listener.SendExtraISupports()
+	listener.Send(nil, listener.Source, ircclient.ERR_NOMOTD, nick, "MOTD File is missing")
+	listener.SendStatus("All of your networks are available on this connection")
+	listener.SendStatus("Channels and nicks end with the network they're on, eg. #chan/network")
+}
+
+// NetworkByName returns the user's network with the given name, ignoring case.
+func (user *User) NetworkByName(name string) *ServerConnection {
+	for _, network := range user.NetworkList() {
+		if strings.ToLower(network.Name) == strings.ToLower(name) {
+			return network
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package ircbnc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// newMultiNetworkListener returns a multi-network listener for a user with the given networks
+func newMultiNetworkListener(networks ...string) *Listener {
+	manager := &Manager{
+		Users: make(map[string]*User),
+	}
+	user := NewUser(manager)
+	user.ID = "dan"
+	for _, name := range networks {
+		sc := NewServerConnection()
+		sc.Name = name
+		sc.User = user
+		user.Networks[name] = sc
+	}
+
+	return &Listener{
+		Manager:      manager,
+		User:         user,
+		MultiNetwork: true,
+	}
+}
+
+func TestSplitNetworkTarget(t *testing.T) {
+	listener := newMultiNetworkListener("freenode", "OFTC")
+
+	tests := []struct {
+		target  string
+		network string
+		name    string
+	}{
+		{"#chan/freenode", "freenode", "#chan"},
+		{"dan/freenode", "freenode", "dan"},
+		{"#chan/oftc", "OFTC", "#chan"},
+		{"#a/b/freenode", "freenode", "#a/b"},
+		{"#chan/unknown", "", "#chan/unknown"},
+		{"#chan", "", "#chan"},
+		{"/freenode", "freenode", ""},
+	}
+
+	for _, test := range tests {
+		sc, name := listener.splitNetworkTarget(test.target)
+		network := ""
+		if sc != nil {
+			network = sc.Name
+		}
+		if network != test.network || name != test.name {
+			t.Errorf("splitNetworkTarget(%q) = %q, %q, want %q, %q", test.target, network, name, test.network, test.name)
+		}
+	}
+}
+
+func TestDemultiplex(t *testing.T) {
+	listener := newMultiNetworkListener("freenode", "oftc")
+
+	tests := []struct {
+		line    string
+		network string
+		params  []string
+		wantErr bool
+	}{
+		{"PRIVMSG #chan/freenode :hi /oftc", "freenode", []string{"#chan", "hi /oftc"}, false},
+		{"PRIVMSG dan/oftc :hi", "oftc", []string{"dan", "hi"}, false},
+		{"JOIN #a/freenode,#b/freenode key", "freenode", []string{"#a,#b", "key"}, false},
+		{"PART #a/oftc,#b/oftc :bye", "oftc", []string{"#a,#b", "bye"}, false},
+		{"KICK #chan/freenode dan/freenode :bye", "freenode", []string{"#chan", "dan", "bye"}, false},
+		{"KICK #chan/freenode dan :bye", "freenode", []string{"#chan", "dan", "bye"}, false},
+		{"MODE #chan/oftc +o dan", "oftc", []string{"#chan", "+o", "dan"}, false},
+		{"PRIVMSG #chan :hi", "", []string{"#chan", "hi"}, false},
+		{"PRIVMSG #chan/unknown :hi", "", []string{"#chan/unknown", "hi"}, false},
+		{"AWAY :gone/oftc", "", []string{"gone/oftc"}, false},
+		{"JOIN #a/freenode,#b/oftc", "", nil, true},
+		{"JOIN #a/freenode,#b", "", nil, true},
+		{"PART #a,#b/oftc", "", nil, true},
+		{"KICK #chan/freenode dan/oftc :bye", "", nil, true},
+	}
+
+	for _, test := range tests {
+		msg, err := ircmsg.ParseLine(test.line)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %s", test.line, err.Error())
+		}
+
+		original := append([]string(nil), msg.Params...)
+		sc, rewritten, err := listener.demultiplex(msg)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("demultiplex(%q) didn't return an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("demultiplex(%q) returned an error: %s", test.line, err.Error())
+			continue
+		}
+
+		network := ""
+		if sc != nil {
+			network = sc.Name
+		}
+		if network != test.network || !reflect.DeepEqual(rewritten.Params, test.params) {
+			t.Errorf("demultiplex(%q) = %q, %q, want %q, %q", test.line, network, rewritten.Params, test.network, test.params)
+		}
+		if !reflect.DeepEqual(msg.Params, original) {
+			t.Errorf("demultiplex(%q) changed the original message", test.line)
+		}
+	}
+}
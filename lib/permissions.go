@@ -0,0 +1,153 @@
+package ircbnc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Permissions that users can be given. Permissions can be matched with wildcards, eg.
+// "network.*" or "*", and taken away by starting them with a "-", eg. "-raw.send".
+const (
+	// PermNetworkAdd lets the user add their own networks
+	PermNetworkAdd = "network.add"
+	// PermNetworkMax limits how many networks the user can have, eg. "network.max=5"
+	PermNetworkMax = "network.max"
+	// PermUserAdmin lets the user manage the other users of the bouncer
+	PermUserAdmin = "user.admin"
+	// PermLogSearch lets the user search their logged messages
+	PermLogSearch = "log.search"
+	// PermRawSend lets the user send raw lines to their networks through the bouncer
+	PermRawSend = "raw.send"
+	// PermBindHost lets the user choose the local address their networks connect from.
+	// It can be limited to addresses or ranges, eg. "network.bindhost=2001:db8::/64"
+	PermBindHost = "network.bindhost"
+)
+
+// RolePermissions are the permissions each role has on top of the user's own.
+var RolePermissions = map[string][]string{
+	RoleOwner: {"*"},
+	RoleUser: {
+		PermNetworkAdd,
+		PermNetworkMax + "=5",
+		PermLogSearch,
+	},
+}
+
+// matchPermission returns true if the granted permission covers the one asked for
+func matchPermission(granted string, name string) bool {
+	// Limits are looked up separately
+	if idx := strings.Index(granted, "="); idx != -1 {
+		granted = granted[:idx]
+	}
+
+	if granted == "*" || granted == name {
+		return true
+	}
+	return strings.HasSuffix(granted, ".*") && strings.HasPrefix(name, granted[:len(granted)-1])
+}
+
+// checkPermission returns whether the permissions grant or revoke the given one, and
+// false for found if they don't mention it at all
+func checkPermission(permissions []string, name string) (allowed bool, found bool) {
+	for _, permission := range permissions {
+		if strings.HasPrefix(permission, "-") && matchPermission(permission[1:], name) {
+			return false, true
+		}
+	}
+	for _, permission := range permissions {
+		if matchPermission(permission, name) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// HasPermission returns true if the user has been given the permission, either directly
+// or by their role.
+func (user *User) HasPermission(name string) bool {
+	allowed, found := checkPermission(user.Permissions, name)
+	if found {
+		return allowed
+	}
+
+	allowed, _ = checkPermission(RolePermissions[user.Role], name)
+	return allowed
+}
+
+// PermissionLimit returns the limit the user has for a permission such as "network.max=5".
+// It returns false if the user isn't limited.
+func (user *User) PermissionLimit(name string) (int, bool) {
+	for _, permissions := range [][]string{user.Permissions, RolePermissions[user.Role]} {
+		for _, permission := range permissions {
+			if strings.HasPrefix(permission, name+"=") {
+				limit, err := strconv.Atoi(permission[len(name)+1:])
+				if err == nil {
+					return limit, true
+				}
+			}
+		}
+
+		// A permission or wildcard without a limit means there is none, but limits we
+		// can't read don't lift it
+		if allowed, _ := checkPermission(permissions, name); allowed {
+			for _, permission := range permissions {
+				if !strings.Contains(permission, "=") && matchPermission(permission, name) {
+					return 0, false
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// CanUseBindHost returns true if the user is allowed to connect to networks from the
+// given local address.
+func (user *User) CanUseBindHost(bindHost string) bool {
+	ip := net.ParseIP(bindHost)
+	if ip == nil {
+		return false
+	}
+
+	for _, permissions := range [][]string{user.Permissions, RolePermissions[user.Role]} {
+		for _, permission := range permissions {
+			if strings.HasPrefix(permission, "-") && matchPermission(permission[1:], PermBindHost) {
+				return false
+			}
+		}
+
+		for _, permission := range permissions {
+			if strings.HasPrefix(permission, PermBindHost+"=") {
+				if matchAddress(permission[len(PermBindHost)+1:], ip) {
+					return true
+				}
+			} else if !strings.Contains(permission, "=") && matchPermission(permission, PermBindHost) {
+				// Without any addresses given, every address can be used
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchAddress returns true if the IP is the given address or inside the given range
+func matchAddress(allowed string, ip net.IP) bool {
+	if strings.Contains(allowed, "/") {
+		_, ipNet, err := net.ParseCIDR(allowed)
+		return err == nil && ipNet.Contains(ip)
+	}
+	allowedIP := net.ParseIP(allowed)
+	return allowedIP != nil && allowedIP.Equal(ip)
+}
+
+// CanAddNetwork returns true if the user is allowed to add another network.
+func (user *User) CanAddNetwork() bool {
+	if !user.HasPermission(PermNetworkAdd) {
+		return false
+	}
+
+	limit, limited := user.PermissionLimit(PermNetworkMax)
+	return !limited || len(user.NetworkList()) < limit
+}
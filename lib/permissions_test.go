@@ -0,0 +1,141 @@
+package ircbnc
+
+import (
+	"testing"
+)
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		granted string
+		name    string
+		want    bool
+	}{
+		{"network.add", "network.add", true},
+		{"network.add", "network.max", false},
+		{"*", "raw.send", true},
+		{"network.*", "network.add", true},
+		{"network.*", "network.bindhost", true},
+		{"network.*", "raw.send", false},
+		{"network.*", "network", false},
+		{"network.max=5", "network.max", true},
+		{"network.bindhost=192.0.2.1", "network.bindhost", true},
+		{"network.add", "network.addx", false},
+	}
+
+	for _, test := range tests {
+		got := matchPermission(test.granted, test.name)
+		if got != test.want {
+			t.Errorf("matchPermission(%q, %q) = %v, want %v", test.granted, test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	tests := []struct {
+		permissions []string
+		name        string
+		allowed     bool
+		found       bool
+	}{
+		{nil, "raw.send", false, false},
+		{[]string{"raw.send"}, "raw.send", true, true},
+		{[]string{"log.search"}, "raw.send", false, false},
+		{[]string{"*"}, "raw.send", true, true},
+		{[]string{"*", "-raw.send"}, "raw.send", false, true},
+		{[]string{"-raw.send", "*"}, "raw.send", false, true},
+		{[]string{"*", "-raw.send"}, "log.search", true, true},
+		{[]string{"network.*", "-network.add"}, "network.add", false, true},
+		{[]string{"network.*", "-network.add"}, "network.max", true, true},
+		{[]string{"-network.*"}, "network.add", false, true},
+		{[]string{"network.max=5"}, "network.max", true, true},
+	}
+
+	for _, test := range tests {
+		allowed, found := checkPermission(test.permissions, test.name)
+		if allowed != test.allowed || found != test.found {
+			t.Errorf("checkPermission(%q, %q) = %v, %v, want %v, %v", test.permissions, test.name, allowed, found, test.allowed, test.found)
+		}
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		role        string
+		permissions []string
+		name        string
+		want        bool
+	}{
+		{RoleOwner, nil, PermRawSend, true},
+		{RoleOwner, []string{"-raw.send"}, PermRawSend, false},
+		{RoleUser, nil, PermNetworkAdd, true},
+		{RoleUser, nil, PermRawSend, false},
+		{RoleUser, []string{"raw.*"}, PermRawSend, true},
+		{RoleUser, []string{"-network.add"}, PermNetworkAdd, false},
+		{"", nil, PermNetworkAdd, false},
+	}
+
+	for _, test := range tests {
+		user := &User{Role: test.role, Permissions: test.permissions}
+		got := user.HasPermission(test.name)
+		if got != test.want {
+			t.Errorf("HasPermission(%q) for %s %q = %v, want %v", test.name, test.role, test.permissions, got, test.want)
+		}
+	}
+}
+
+func TestPermissionLimit(t *testing.T) {
+	tests := []struct {
+		role        string
+		permissions []string
+		limit       int
+		limited     bool
+	}{
+		{RoleUser, nil, 5, true},
+		{RoleUser, []string{"network.max=2"}, 2, true},
+		{RoleUser, []string{"network.*"}, 0, false},
+		{RoleUser, []string{"network.max=lots"}, 5, true},
+		{RoleUser, []string{"network.*", "-network.max"}, 5, true},
+		{RoleOwner, nil, 0, false},
+		{RoleOwner, []string{"network.max=10"}, 10, true},
+	}
+
+	for _, test := range tests {
+		user := &User{Role: test.role, Permissions: test.permissions}
+		limit, limited := user.PermissionLimit(PermNetworkMax)
+		if limit != test.limit || limited != test.limited {
+			t.Errorf("PermissionLimit for %s %q = %d, %v, want %d, %v", test.role, test.permissions, limit, limited, test.limit, test.limited)
+		}
+	}
+}
+
+func TestCanUseBindHost(t *testing.T) {
+	tests := []struct {
+		role        string
+		permissions []string
+		bindHost    string
+		want        bool
+	}{
+		{RoleOwner, nil, "192.0.2.1", true},
+		{RoleOwner, nil, "not an address", false},
+		{RoleOwner, []string{"-network.bindhost"}, "192.0.2.1", false},
+		{RoleOwner, []string{"-network.*"}, "192.0.2.1", false},
+		{RoleUser, nil, "192.0.2.1", false},
+		{RoleUser, []string{"network.bindhost"}, "2001:db8::1", true},
+		{RoleUser, []string{"network.*"}, "192.0.2.1", true},
+		{RoleUser, []string{"network.bindhost=192.0.2.1"}, "192.0.2.1", true},
+		{RoleUser, []string{"network.bindhost=192.0.2.1"}, "192.0.2.2", false},
+		{RoleUser, []string{"network.bindhost=2001:db8::/64"}, "2001:db8::5", true},
+		{RoleUser, []string{"network.bindhost=2001:db8::/64"}, "2001:db8:1::5", false},
+		{RoleUser, []string{"network.bindhost=192.0.2.0/24", "network.bindhost=198.51.100.7"}, "198.51.100.7", true},
+		{RoleUser, []string{"network.bindhost=not/a/range"}, "192.0.2.1", false},
+		{RoleUser, []string{"network.bindhost=192.0.2.1", "-network.bindhost"}, "192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		user := &User{Role: test.role, Permissions: test.permissions}
+		got := user.CanUseBindHost(test.bindHost)
+		if got != test.want {
+			t.Errorf("CanUseBindHost(%q) for %s %q = %v, want %v", test.bindHost, test.role, test.permissions, got, test.want)
+		}
+	}
+}
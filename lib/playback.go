@@ -0,0 +1,95 @@
+package ircbnc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// SendPlayback sends the listener the messages it has missed in each of the network's
+// buffers. Clients that logged in with a client name get everything since they last
+// detached, otherwise playback starts at the buffer's read marker.
+func (listener *Listener) SendPlayback(sc *ServerConnection) {
+	store := listener.Manager.Messages
+	if store == nil || !store.SupportsRetrieve() {
+		return
+	}
+
+	var since time.Time
+	if listener.ClientID != "" {
+		since, _ = listener.Manager.Ds.GetClientPosition(listener.User.ID, sc.Name, listener.ClientID)
+	}
+
+	limit := listener.Manager.Config.Bouncer.PlaybackLines
+	now := time.Now().Add(time.Second)
+
+	for _, buffer := range sc.Buffers {
+		start := since
+		if start.IsZero() {
+			start = buffer.LastSeen
+		}
+
+		// With nothing to go on, just send the latest lines
+		var msgs []*ircmsg.IrcMessage
+		if start.IsZero() {
+			msgs = store.GetBeforeTime(listener.User.ID, sc.Name, buffer.Name, now, limit)
+		} else {
+			msgs = store.GetBetweenTime(listener.User.ID, sc.Name, buffer.Name, now, start, limit)
+		}
+
+		if len(msgs) == limit && !start.IsZero() {
+			total := store.CountBetweenTime(listener.User.ID, sc.Name, buffer.Name, start, now)
+			if total > limit {
+				target := listener.ClientNick
+				if buffer.Channel {
+					target = buffer.Name
+					if listener.MultiNetwork {
+						target += "/" + sc.Name
+					}
+				}
+				listener.Send(nil, listener.Manager.StatusSource, "NOTICE", target, fmt.Sprintf("%d lines skipped", total-limit))
+			}
+		}
+
+		for _, message := range msgs {
+			// Sent through the caps so clients without message-tags don't get msgids
+			err := listener.SendMessageFrom(sc, message)
+			if err != nil {
+				listenerLog.Error("Could not build message from storage", "error", err)
+				continue
+			}
+		}
+	}
+}
+
+// savePlaybackPosition remembers when a named client detached from its network so that
+// playback can start from there when it comes back.
+func (listener *Listener) savePlaybackPosition() {
+	if listener.ClientID == "" || listener.User == nil {
+		return
+	}
+
+	// Clients of a deleted user are closed after the user is gone, with nothing to save
+	if listener.Manager.User(listener.User.ID) != listener.User {
+		return
+	}
+
+	networks := []*ServerConnection{listener.ServerConnection}
+	if listener.MultiNetwork {
+		networks = networks[:0]
+		for _, network := range listener.User.NetworkList() {
+			networks = append(networks, network)
+		}
+	}
+
+	for _, network := range networks {
+		if network == nil {
+			continue
+		}
+		err := listener.Manager.Ds.SaveClientPosition(listener.User.ID, network.Name, listener.ClientID, time.Now())
+		if err != nil {
+			listenerLog.Error("Could not save playback position", "error", err)
+		}
+	}
+}
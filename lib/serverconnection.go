@@ -4,8 +4,10 @@
 package ircbnc
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -36,9 +38,47 @@ type ServerConnection struct {
 	ListenersLock sync.Mutex
 	Listeners     []*Listener
 
+	// channels we're currently joined to, by lowercase name
+	channels     map[string]*ChannelState
+	channelsLock sync.RWMutex
+	// modeReplyChannel is the channel whose modes we just asked for, in case the server
+	// follows them with its creation time
+	modeReplyChannel string
+
 	Password  string
 	Addresses []ServerConnectionAddress
 	Foo       *ircclient.Client
+
+	SaslMechanism string
+	SaslAccount   string
+	SaslPassword  string
+
+	// BindHost is the local IP address we connect to the network from, if any
+	BindHost string
+	// AddressFamily chooses between IPv4 and IPv6, see ircclient.AddressFamilies
+	AddressFamily string
+	// ClientCert is the PEM encoded certificate and key we connect with, eg. for CertFP
+	ClientCert string
+
+	// the last server certificate we refused, so that the user can accept it
+	tlsLock              sync.Mutex
+	untrustedFingerprint string
+	untrustedHost        string
+	untrustedPort        int
+
+	// the address to try next, so that reconnects rotate through Addresses
+	nextAddress int
+	connectedAt time.Time
+
+	reconnectLock  sync.Mutex
+	reconnecting   bool
+	reconnectDelay time.Duration
+	stopReconnect  chan bool
+
+	// set once we've quit or been disconnected so that we don't reconnect, or finish a
+	// connection we were still making. Quitting doesn't mark the network as disabled.
+	// Guarded by reconnectLock.
+	quitting bool
 }
 
 func NewServerConnection() *ServerConnection {
@@ -48,18 +88,36 @@ func NewServerConnection() *ServerConnection {
 		ReceiveEvents:          make(chan Message),
 		Foo:                    ircclient.NewClient(),
 		Buffers:                make(ServerConnectionBuffers),
+		channels:               make(map[string]*ChannelState),
 	}
 
 	// Note: Foo dispatches specific commands first, and then "ALL" second.
 	sc.Foo.HandleCommand(ircclient.RPL_WELCOME, sc.updateNickHandler)
 	sc.Foo.HandleCommand(ircclient.RPL_WELCOME, sc.joinSavedChannels)
+	sc.Foo.HandleCommand(ircclient.RPL_WELCOME, sc.registeredHandler)
 	sc.Foo.HandleCommand("NICK", sc.updateNickHandler)
 	sc.Foo.HandleCommand("ALL", sc.connectLinesHandler)
 	sc.Foo.HandleCommand("ALL", sc.rawToListeners)
 	sc.Foo.HandleCommand("CLOSED", sc.disconnectHandler)
 	sc.Foo.HandleCommand("JOIN", sc.handleJoin)
+	sc.Foo.HandleCommand("JOIN", sc.channelStateJoin)
+	sc.Foo.HandleCommand("PART", sc.channelStatePart)
+	sc.Foo.HandleCommand("KICK", sc.channelStateKick)
+	sc.Foo.HandleCommand("QUIT", sc.channelStateQuit)
+	sc.Foo.HandleCommand("NICK", sc.channelStateNick)
+	sc.Foo.HandleCommand("MODE", sc.channelStateMode)
+	sc.Foo.HandleCommand("TOPIC", sc.channelStateTopic)
+	sc.Foo.HandleCommand(ircclient.RPL_TOPIC, sc.channelStateNumeric)
+	sc.Foo.HandleCommand(ircclient.RPL_TOPICTIME, sc.channelStateNumeric)
+	sc.Foo.HandleCommand(ircclient.RPL_CHANNELMODEIS, sc.channelStateNumeric)
+	sc.Foo.HandleCommand(ircclient.RPL_NAMREPLY, sc.channelStateNumeric)
+	sc.Foo.HandleCommand(ircclient.RPL_ENDOFNAMES, sc.channelStateNumeric)
 	sc.Foo.HandleCommand("PRIVMSG", sc.maybeCreateQueryBuffer)
 	sc.Foo.HandleCommand("NOTICE", sc.maybeCreateQueryBuffer)
+	sc.Foo.HandleCommand(ircclient.RPL_SASLSUCCESS, sc.saslResultHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_SASLFAIL, sc.saslResultHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_SASLTOOLONG, sc.saslResultHandler)
+	sc.Foo.HandleCommand(ircclient.ERR_NICKLOCKED, sc.saslResultHandler)
 
 	return sc
 }
@@ -69,10 +127,33 @@ type ServerConnectionAddress struct {
 	Port      int
 	UseTLS    bool
 	VerifyTLS bool
+	// Proxy is the URL of a SOCKS5 or HTTP CONNECT proxy to connect through, if any
+	Proxy string
+	// Fingerprint is the SHA-256 fingerprint of the server's certificate, if it's pinned
+	Fingerprint string
 }
 
 type ServerConnectionAddresses []ServerConnectionAddress
 
+// SaslMechanisms are the SASL mechanisms we can use to authenticate to servers
+var SaslMechanisms = map[string]bool{
+	"PLAIN":    true,
+	"EXTERNAL": true,
+}
+
+// errConnectStopped is returned when we stop a connection that was still being made
+var errConnectStopped = errors.New("Connecting was stopped")
+
+// saslResultNumerics are the replies that end our SASL authentication to a server
+var saslResultNumerics = map[string]bool{
+	ircclient.RPL_SASLSUCCESS: true,
+	ircclient.ERR_SASLFAIL:    true,
+	ircclient.ERR_SASLTOOLONG: true,
+	ircclient.ERR_SASLABORTED: true,
+	ircclient.ERR_SASLALREADY: true,
+	ircclient.ERR_NICKLOCKED:  true,
+}
+
 type ServerConnectionBuffer struct {
 	Channel  bool
 	Name     string
@@ -138,23 +219,146 @@ func (sc *ServerConnection) Save() error {
 	return BNC.Ds.SaveConnection(sc)
 }
 
-// disconnectHandler extracts and stores .
+// disconnectHandler lets our listeners know we've lost the connection and starts
+// reconnecting if the network is still meant to be connected.
 func (sc *ServerConnection) disconnectHandler(message *ircmsg.IrcMessage) {
+	sc.clearChannelState()
+	sc.dispatchState("disconnected", "")
+
 	for _, listener := range sc.Listeners {
 		listener.SendStatus("Disconnected from " + sc.Name)
 	}
+
+	if !sc.Enabled || sc.isQuitting() {
+		return
+	}
+
+	// A connection that stayed up for a while means the network is healthy again, so
+	// don't keep waiting as long as we did for the last batch of failures
+	stableAfter := sc.User.Manager.Config.Bouncer.Reconnect.StableAfter
+	sc.reconnectLock.Lock()
+	if !sc.connectedAt.IsZero() && time.Since(sc.connectedAt) >= stableAfter {
+		sc.reconnectDelay = 0
+	}
+	sc.reconnectLock.Unlock()
+
+	sc.startReconnecting()
+}
+
+// saslResultHandler lets our listeners know how authenticating to the network went.
+func (sc *ServerConnection) saslResultHandler(message *ircmsg.IrcMessage) {
+	var status string
+	if message.Command == ircclient.RPL_SASLSUCCESS {
+		status = "Authenticated to " + sc.Name + " with SASL " + sc.SaslMechanism
+	} else {
+		status = "SASL authentication to " + sc.Name + " failed: " + sc.Foo.SaslError
+	}
+
+	for _, listener := range sc.Listeners {
+		listener.SendStatus(status)
+	}
+}
+
+// CheckSasl returns an error if the SASL details can't be used with this network
+func (sc *ServerConnection) CheckSasl(mechanism string, account string, password string) error {
+	mechanism = strings.ToUpper(mechanism)
+	if mechanism != "" && !SaslMechanisms[mechanism] {
+		return fmt.Errorf("Unsupported SASL mechanism %s", mechanism)
+	}
+	if mechanism == "PLAIN" && (account == "" || password == "") {
+		return fmt.Errorf("SASL PLAIN needs both an account and a password")
+	}
+	if mechanism == "EXTERNAL" && sc.ClientCert == "" {
+		return fmt.Errorf("SASL EXTERNAL needs a client certificate, use genclientcert to make one")
+	}
+
+	return nil
+}
+
+// SetSasl sets the SASL details used when connecting to this network. An empty
+// mechanism disables SASL.
+func (sc *ServerConnection) SetSasl(mechanism string, account string, password string) error {
+	err := sc.CheckSasl(mechanism, account, password)
+	if err != nil {
+		return err
+	}
+
+	mechanism = strings.ToUpper(mechanism)
+	sc.SaslMechanism = mechanism
+	sc.SaslAccount = account
+	sc.SaslPassword = password
+	if mechanism == "" {
+		sc.SaslAccount = ""
+		sc.SaslPassword = ""
+	}
+
+	return nil
+}
+
+// CheckBindHost returns an error if the user can't connect to this network from the
+// bind host and address family.
+func (sc *ServerConnection) CheckBindHost(bindHost string, family string) error {
+	family = strings.ToLower(family)
+	if !ircclient.AddressFamilies[family] {
+		return fmt.Errorf("Address family must be ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+	}
+
+	if bindHost != "" {
+		ip := net.ParseIP(bindHost)
+		if ip == nil {
+			return fmt.Errorf("Bind host must be an IP address")
+		}
+		if !sc.User.CanUseBindHost(bindHost) {
+			return fmt.Errorf("You aren't allowed to use the bind host %s", bindHost)
+		}
+		if (ip.To4() != nil && family == "ipv6") || (ip.To4() == nil && family == "ipv4") {
+			return fmt.Errorf("Bind host %s can't be used with %s", bindHost, family)
+		}
+	}
+
+	return nil
+}
+
+// SetBindHost sets the local address and address family used when connecting to this
+// network. The user must be allowed to use the bind host, an empty one uses the default.
+func (sc *ServerConnection) SetBindHost(bindHost string, family string) error {
+	err := sc.CheckBindHost(bindHost, family)
+	if err != nil {
+		return err
+	}
+
+	sc.BindHost = bindHost
+	sc.AddressFamily = strings.ToLower(family)
+	return nil
 }
 
 func (sc *ServerConnection) updateNickHandler(message *ircmsg.IrcMessage) {
 	// Update the nick we have for the client before the message gets piped down
 	// to the client
 	for _, listener := range sc.Listeners {
-		if listener.Registered && sc.Foo.Nick != listener.ClientNick {
+		if listener.Registered && !listener.MultiNetwork && sc.Foo.Nick != listener.ClientNick {
 			listener.ClientNick = sc.Foo.Nick
 		}
 	}
 }
 
+func (sc *ServerConnection) registeredHandler(message *ircmsg.IrcMessage) {
+	sc.dispatchState("connected", "")
+}
+
+// dispatchState lets components know that the state of our connection has changed
+func (sc *ServerConnection) dispatchState(state string, errorMessage string) {
+	if sc.User == nil || sc.User.Manager == nil {
+		return
+	}
+
+	sc.User.Manager.Bus.Dispatch(HookNetworkStateName, &HookNetworkState{
+		Server: sc,
+		State:  state,
+		Error:  errorMessage,
+	})
+}
+
 func (sc *ServerConnection) joinSavedChannels(message *ircmsg.IrcMessage) {
 	// Join our channels
 	for _, channel := range sc.Buffers {
@@ -165,6 +369,17 @@ func (sc *ServerConnection) joinSavedChannels(message *ircmsg.IrcMessage) {
 }
 
 func (sc *ServerConnection) rawToListeners(message *ircmsg.IrcMessage) {
+	// Clients never started our SASL authentication, so the replies to it are only for us
+	if saslResultNumerics[message.Command] {
+		return
+	}
+	if sc.ownModeReply(message) {
+		return
+	}
+
+	// Stored and relayed messages need the same msgid so clients can match them up
+	EnsureMsgid(message)
+
 	hook := &HookIrcRaw{
 		FromServer: true,
 		User:       sc.User,
@@ -180,7 +395,7 @@ func (sc *ServerConnection) rawToListeners(message *ircmsg.IrcMessage) {
 	sc.ListenersLock.Lock()
 	for _, listener := range sc.Listeners {
 		if listener.Registered {
-			listener.SendMessage(message)
+			listener.SendMessageFrom(sc, message)
 		}
 	}
 	sc.ListenersLock.Unlock()
@@ -255,20 +470,56 @@ func (sc *ServerConnection) DumpRegistration(listener *Listener) {
 
 func (sc *ServerConnection) DumpChannels(listener *Listener) {
 	for _, buffer := range sc.Buffers {
-		if buffer.Channel {
-			listener.Send(nil, sc.CurrentMask, "JOIN", buffer.Name)
-			sc.Foo.WriteLine("NAMES %s", buffer.Name)
+		if !buffer.Channel {
+			listener.SendReadMarker(sc, buffer)
+			continue
 		}
+
+		// Channels we're not in right now, eg. while reconnecting, still get a JOIN so
+		// that clients keep them open
+		channel := sc.Channel(buffer.Name)
+		if channel != nil {
+			sc.DumpChannelState(listener, channel)
+		} else {
+			sc.sendToListener(listener, sc.CurrentMask, "JOIN", buffer.Name)
+		}
+		listener.SendReadMarker(sc, buffer)
 	}
 }
 
+// SetReadMarker moves the read marker of a buffer forward to seen, saving it and letting
+// every attached listener know. Markers never move backwards, so false is returned if
+// seen is not later than the current marker.
+func (sc *ServerConnection) SetReadMarker(buffer *ServerConnectionBuffer, seen time.Time) (bool, error) {
+	seen = seen.UTC()
+	if !seen.After(buffer.LastSeen) {
+		return false, nil
+	}
+
+	buffer.LastSeen = seen
+	err := sc.Save()
+
+	sc.ListenersLock.Lock()
+	for _, listener := range sc.Listeners {
+		if listener.Registered {
+			listener.SendReadMarker(sc, buffer)
+		}
+	}
+	sc.ListenersLock.Unlock()
+
+	return true, err
+}
+
 // AddListener adds the given listener to this ServerConnection.
 func (sc *ServerConnection) AddListener(listener *Listener) {
 	sc.ListenersLock.Lock()
 	sc.Listeners = append(sc.Listeners, listener)
 	sc.ListenersLock.Unlock()
 
-	listener.ServerConnection = sc
+	// Multi-network listeners aren't tied to any one network
+	if !listener.MultiNetwork {
+		listener.ServerConnection = sc
+	}
 }
 
 func (sc *ServerConnection) RemoveListener(listener *Listener) {
@@ -294,12 +545,46 @@ func (sc *ServerConnection) ReadyToConnect() bool {
 }
 
 func (sc *ServerConnection) Disconnect() {
+	// Mark ourselves as disabled first so the disconnect handler doesn't try to reconnect
+	sc.Enabled = false
+	sc.setQuitting(true)
+	sc.stopReconnecting()
+
+	// This also stops a connection that's still being made
+	sc.Foo.Close()
+
+	sc.User.Manager.Ds.SaveConnection(sc)
+}
+
+// Quit sends a QUIT to the server and closes the connection without disabling this
+// network, so that it is connected to again the next time the bouncer starts.
+func (sc *ServerConnection) Quit(message string) {
+	sc.setQuitting(true)
+	sc.stopReconnecting()
+
 	if sc.Foo.Connected {
-		sc.Foo.Close()
+		sc.Foo.WriteLine("QUIT :%s", message)
 	}
 
-	sc.Enabled = false
-	sc.User.Manager.Ds.SaveConnection(sc)
+	// Don't wait for the server to hang up on us, and stop a connection that's still
+	// being made
+	sc.Foo.Close()
+}
+
+// setQuitting sets whether we've been told to stop connecting to this network
+func (sc *ServerConnection) setQuitting(quitting bool) {
+	sc.reconnectLock.Lock()
+	defer sc.reconnectLock.Unlock()
+
+	sc.quitting = quitting
+}
+
+// isQuitting returns true if we've been told to stop connecting to this network
+func (sc *ServerConnection) isQuitting() bool {
+	sc.reconnectLock.Lock()
+	defer sc.reconnectLock.Unlock()
+
+	return sc.quitting
 }
 
 func (sc *ServerConnection) Connect() {
@@ -311,35 +596,34 @@ func (sc *ServerConnection) Connect() {
 		return
 	}
 
-	sc.Foo.Nick = sc.Nickname
-	sc.Foo.Username = sc.Username
-	sc.Foo.Realname = sc.Realname
-	sc.Foo.Password = sc.Password
+	// We may have quit the network earlier, eg. when the user was disabled
+	sc.setQuitting(false)
 
+	// Try each address once, starting from wherever we got up to last time
 	var err error
-	for _, address := range sc.Addresses {
-		sc.Foo.Host = address.Host
-		sc.Foo.Port = address.Port
-		sc.Foo.TLS = address.UseTLS
-
-		tlsConfig := &tls.Config{}
-		if !address.VerifyTLS {
-			tlsConfig.InsecureSkipVerify = true
-		}
-		sc.Foo.TLSConfig = tlsConfig
-
-		err = sc.Foo.Connect()
-		if err == nil {
+	for range sc.Addresses {
+		err = sc.connectNextAddress()
+		if err == nil || err == errConnectStopped {
 			break
 		}
 	}
 
+	if err == errConnectStopped {
+		return
+	}
+
 	if err != nil {
+		sc.dispatchState("disconnected", err.Error())
+
 		name := fmt.Sprintf("%s/%s", sc.User.ID, sc.Name)
-		fmt.Println("ERROR: Could not connect to", name, err.Error())
+		upstreamLog.Warn("Could not connect", "network", name, "error", err)
 		for _, listener := range sc.Listeners {
 			listener.SendStatus("Error connecting to " + name + ". " + err.Error())
 		}
+
+		if sc.Enabled {
+			sc.startReconnecting()
+		}
 	} else {
 		// If not currently enabled, since we've just connected then mark as enabled and save the
 		// new connection state
@@ -350,6 +634,194 @@ func (sc *ServerConnection) Connect() {
 	}
 }
 
+// connectNextAddress makes a single connection attempt to the next address in the rotation.
+func (sc *ServerConnection) connectNextAddress() error {
+	if len(sc.Addresses) == 0 {
+		return fmt.Errorf("No addresses have been set for this network")
+	}
+
+	if sc.nextAddress >= len(sc.Addresses) {
+		sc.nextAddress = 0
+	}
+	addressIdx := sc.nextAddress
+	address := sc.Addresses[addressIdx]
+	sc.nextAddress = (sc.nextAddress + 1) % len(sc.Addresses)
+
+	sc.Foo.Nick = sc.Nickname
+	sc.Foo.Username = sc.Username
+	sc.Foo.Realname = sc.Realname
+	sc.Foo.Password = sc.Password
+	sc.Foo.SaslMechanism = sc.SaslMechanism
+	sc.Foo.SaslAccount = sc.SaslAccount
+	sc.Foo.SaslPassword = sc.SaslPassword
+
+	sc.Foo.Host = address.Host
+	sc.Foo.Port = address.Port
+	sc.Foo.TLS = address.UseTLS
+	sc.Foo.Proxy = address.Proxy
+	sc.Foo.BindHost = sc.BindHost
+	sc.Foo.AddressFamily = sc.AddressFamily
+
+	tlsConfig, err := sc.newTLSConfig(addressIdx)
+	if err != nil {
+		return err
+	}
+	sc.Foo.TLSConfig = tlsConfig
+
+	upstreamConfig := sc.User.Manager.Config.Bouncer.Upstream
+	sc.Foo.DialTimeout = upstreamConfig.DialTimeout
+	sc.Foo.PingInterval = upstreamConfig.PingInterval
+	sc.Foo.PingTimeout = upstreamConfig.PingTimeout
+
+	// A new connection gets a new set of registration lines
+	sc.storingConnectMessages = true
+	sc.connectMessages = nil
+
+	sc.dispatchState("connecting", "")
+
+	err = sc.Foo.Connect()
+
+	// We may have been quit or disconnected while we were still connecting, eg. when the
+	// user was deleted during a slow proxy handshake
+	if sc.isQuitting() {
+		if err == nil {
+			// Closing the connection lets everyone know we've disconnected
+			sc.Foo.Close()
+		} else {
+			sc.dispatchState("disconnected", "")
+		}
+		return errConnectStopped
+	}
+	if err != nil {
+		return err
+	}
+
+	sc.reconnectLock.Lock()
+	sc.connectedAt = time.Now()
+	sc.reconnectLock.Unlock()
+
+	return nil
+}
+
+// startReconnecting starts the reconnect supervisor if it isn't already running.
+func (sc *ServerConnection) startReconnecting() {
+	sc.reconnectLock.Lock()
+	defer sc.reconnectLock.Unlock()
+
+	if sc.reconnecting {
+		return
+	}
+
+	sc.reconnecting = true
+	sc.stopReconnect = make(chan bool)
+	go sc.reconnectLoop(sc.stopReconnect)
+}
+
+// stopReconnecting stops any pending reconnect attempts.
+func (sc *ServerConnection) stopReconnecting() {
+	sc.reconnectLock.Lock()
+	defer sc.reconnectLock.Unlock()
+
+	if sc.reconnecting {
+		close(sc.stopReconnect)
+		sc.reconnecting = false
+	}
+	sc.reconnectDelay = 0
+}
+
+// reconnectLoop keeps trying to connect, waiting longer between each attempt, until we
+// either connect or the network gets disabled.
+func (sc *ServerConnection) reconnectLoop(stop chan bool) {
+	defer func() {
+		sc.reconnectLock.Lock()
+		if sc.stopReconnect != stop {
+			sc.reconnectLock.Unlock()
+			return
+		}
+		sc.reconnecting = false
+		sc.reconnectLock.Unlock()
+
+		// We may have lost the connection again while finishing up, when starting to
+		// reconnect would have done nothing as we were still running
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if sc.Enabled && !sc.isQuitting() && !sc.Foo.Connected && !sc.Foo.Connecting {
+			sc.startReconnecting()
+		}
+	}()
+
+	for {
+		delay := sc.nextReconnectDelay()
+
+		name := fmt.Sprintf("%s/%s", sc.User.ID, sc.Name)
+		upstreamLog.Info("Reconnecting", "network", name, "delay", delay)
+		for _, listener := range sc.Listeners {
+			listener.SendStatus(fmt.Sprintf("Reconnecting to %s in %s", sc.Name, delay))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !sc.Enabled || sc.isQuitting() {
+			return
+		}
+
+		// Someone may have connected us manually while we were waiting
+		if sc.Foo.Connected || sc.Foo.Connecting {
+			return
+		}
+
+		sc.User.Manager.Bus.Dispatch(HookReconnectName, &HookReconnect{
+			Server: sc,
+		})
+
+		err := sc.connectNextAddress()
+		if err == nil || err == errConnectStopped {
+			return
+		}
+
+		upstreamLog.Warn("Could not reconnect", "network", name, "error", err)
+		for _, listener := range sc.Listeners {
+			listener.SendStatus("Error connecting to " + name + ". " + err.Error())
+		}
+	}
+}
+
+// nextReconnectDelay returns how long to wait before the next reconnect attempt and
+// backs off the delay for the attempt after it.
+func (sc *ServerConnection) nextReconnectDelay() time.Duration {
+	conf := sc.User.Manager.Config.Bouncer.Reconnect
+
+	sc.reconnectLock.Lock()
+	if sc.reconnectDelay < conf.MinDelay {
+		sc.reconnectDelay = conf.MinDelay
+	}
+	delay := sc.reconnectDelay
+
+	next := time.Duration(float64(sc.reconnectDelay) * conf.Multiplier)
+	if next > conf.MaxDelay {
+		next = conf.MaxDelay
+	}
+	sc.reconnectDelay = next
+	sc.reconnectLock.Unlock()
+
+	// Spread the delay out by up to +/- the jitter fraction
+	if conf.Jitter > 0 {
+		spread := float64(delay) * conf.Jitter
+		delay += time.Duration((rand.Float64()*2 - 1) * spread)
+	}
+
+	return delay.Round(time.Millisecond)
+}
+
 func (sc *ServerConnection) handleJoin(message *ircmsg.IrcMessage) {
 	params := message.Params
 	if len(params) < 1 {
@@ -0,0 +1,232 @@
+package ircbnc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// CertFingerprint returns the SHA-256 fingerprint of a DER encoded certificate, the same
+// way fingerprints are shown to users and given to NickServ.
+func CertFingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateClientCert makes a new self-signed certificate for connecting to networks with,
+// returning the certificate and its key PEM encoded together.
+func GenerateClientCert(name string) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// Servers don't check the dates on client certs, the fingerprint is what matters
+		NotAfter:    time.Now().AddDate(20, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return string(certPem) + string(keyPem), nil
+}
+
+// parseClientCert loads a PEM encoded certificate and key
+func parseClientCert(certPem string) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair([]byte(certPem), []byte(certPem))
+	if err != nil {
+		return cert, errors.New("Client certificates must be a PEM encoded certificate and key")
+	}
+	return cert, nil
+}
+
+// SetClientCert sets the certificate and key, PEM encoded together, that we connect to
+// this network with. An empty certificate stops us sending one.
+func (sc *ServerConnection) SetClientCert(certPem string) error {
+	if certPem != "" {
+		_, err := parseClientCert(certPem)
+		if err != nil {
+			return err
+		}
+	} else if sc.SaslMechanism == "EXTERNAL" {
+		return errors.New("SASL EXTERNAL needs the client certificate, change the SASL mechanism first")
+	}
+
+	sc.ClientCert = certPem
+	return nil
+}
+
+// ClientCertFingerprint returns the fingerprint of the network's client certificate, or
+// an empty string if it doesn't have one.
+func (sc *ServerConnection) ClientCertFingerprint() string {
+	if sc.ClientCert == "" {
+		return ""
+	}
+	cert, err := parseClientCert(sc.ClientCert)
+	if err != nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	return CertFingerprint(cert.Certificate[0])
+}
+
+// UntrustedServerCert returns the fingerprint of the last certificate we refused to
+// connect with, and the address that sent it.
+func (sc *ServerConnection) UntrustedServerCert() (string, string, bool) {
+	sc.tlsLock.Lock()
+	defer sc.tlsLock.Unlock()
+
+	if sc.untrustedFingerprint == "" {
+		return "", "", false
+	}
+	return sc.untrustedFingerprint, sc.untrustedHost, true
+}
+
+// AcceptServerCert pins a server certificate fingerprint, so that we'll connect to a
+// server using it even if it's self-signed. Without a fingerprint, the last certificate
+// we refused is accepted for the address that sent it. Otherwise the fingerprint is
+// pinned for every address of the network. It returns the fingerprint that was pinned.
+func (sc *ServerConnection) AcceptServerCert(fingerprint string) (string, error) {
+	if fingerprint == "" {
+		sc.tlsLock.Lock()
+		defer sc.tlsLock.Unlock()
+
+		if sc.untrustedFingerprint == "" {
+			return "", errors.New("No certificate has been refused for this network")
+		}
+		for i := range sc.Addresses {
+			if sc.Addresses[i].Host == sc.untrustedHost && sc.Addresses[i].Port == sc.untrustedPort {
+				sc.Addresses[i].Fingerprint = sc.untrustedFingerprint
+			}
+		}
+
+		fingerprint = sc.untrustedFingerprint
+		sc.untrustedFingerprint = ""
+		return fingerprint, nil
+	}
+
+	fingerprint = NormaliseCertFP(fingerprint)
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 64 {
+		return "", errors.New("Certificate fingerprints must be a SHA-256 hash (64 hex characters)")
+	}
+	for i := range sc.Addresses {
+		sc.Addresses[i].Fingerprint = fingerprint
+	}
+	return fingerprint, nil
+}
+
+// newTLSConfig returns the TLS config for connecting to one of the network's addresses
+func (sc *ServerConnection) newTLSConfig(addressIdx int) (*tls.Config, error) {
+	address := sc.Addresses[addressIdx]
+	config := &tls.Config{
+		ServerName: address.Host,
+		// We check the certificate ourselves, so that pinned ones don't need to be
+		// signed by a CA
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return sc.verifyServerCert(addressIdx, address, state)
+		},
+	}
+
+	if sc.ClientCert != "" {
+		cert, err := parseClientCert(sc.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// verifyServerCert checks the certificate a server sent us. Pinned fingerprints have to
+// match, and otherwise the certificate must be signed by a CA we trust. If the network
+// doesn't verify certificates, the first one we see gets pinned.
+func (sc *ServerConnection) verifyServerCert(addressIdx int, address ServerConnectionAddress, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("The server did not send a certificate")
+	}
+	fingerprint := CertFingerprint(state.PeerCertificates[0].Raw)
+
+	if address.Fingerprint != "" {
+		if fingerprint == address.Fingerprint {
+			return nil
+		}
+		sc.refuseServerCert(address, fingerprint)
+		return fmt.Errorf("The certificate of %s has changed to %s. If you trust it, use: /msg *status acceptcert %s", address.Host, fingerprint, sc.Name)
+	}
+
+	if address.VerifyTLS {
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       address.Host,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			sc.refuseServerCert(address, fingerprint)
+			return fmt.Errorf("The certificate of %s (%s) could not be verified: %s. If you trust it, use: /msg *status acceptcert %s", address.Host, fingerprint, err.Error(), sc.Name)
+		}
+		return nil
+	}
+
+	// Trust on first use
+	sc.tlsLock.Lock()
+	if addressIdx < len(sc.Addresses) && sc.Addresses[addressIdx].Host == address.Host {
+		sc.Addresses[addressIdx].Fingerprint = fingerprint
+	}
+	sc.tlsLock.Unlock()
+
+	upstreamLog.Info("Pinned server certificate", "network", sc.User.ID+"/"+sc.Name, "host", address.Host, "fingerprint", fingerprint)
+	sc.ListenersLock.Lock()
+	for _, listener := range sc.Listeners {
+		listener.SendStatus(fmt.Sprintf("%s doesn't verify certificates, so the certificate of %s (%s) will be trusted from now on", sc.Name, address.Host, fingerprint))
+	}
+	sc.ListenersLock.Unlock()
+
+	err := sc.User.Manager.Ds.SaveConnection(sc)
+	if err != nil {
+		upstreamLog.Error("Could not save the pinned certificate", "network", sc.User.ID+"/"+sc.Name, "error", err)
+	}
+	return nil
+}
+
+// refuseServerCert remembers a certificate we didn't trust, so that it can be accepted
+func (sc *ServerConnection) refuseServerCert(address ServerConnectionAddress, fingerprint string) {
+	sc.tlsLock.Lock()
+	defer sc.tlsLock.Unlock()
+
+	sc.untrustedFingerprint = fingerprint
+	sc.untrustedHost = address.Host
+	sc.untrustedPort = address.Port
+}
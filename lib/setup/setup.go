@@ -213,7 +213,7 @@ func InitialSetup(manager *ircbnc.Manager) {
 
 	user := ircbnc.NewUser(manager)
 	user.Name = username
-	user.Role = "Owner"
+	user.Role = ircbnc.RoleOwner
 	user.DefaultNick = ircNick
 	user.DefaultFbNick = ircFbNick
 	user.DefaultUser = ircUser
@@ -278,7 +278,7 @@ func InitialSetup(manager *ircbnc.Manager) {
 
 		var serverVerifyTLS bool
 		if serverUseTLS {
-			serverVerifyTLS, err = QueryBool("Verify SSL/TLS certificates? (y/n) ")
+			serverVerifyTLS, err = QueryBool("Verify SSL/TLS certificates? If not, the first certificate seen is trusted (y/n) ")
 			if err != nil {
 				log.Fatal(err.Error())
 			}
@@ -8,6 +8,7 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -15,6 +16,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/goshuirc/bnc/lib/metrics"
 )
 
 var (
@@ -39,6 +42,9 @@ type Socket struct {
 	lineToSendExists chan bool
 	linesToSend      []string
 	linesToSendMutex sync.Mutex
+
+	// writerDone is closed once the SocketWriter has finished and closed the connection
+	writerDone chan bool
 }
 
 // NewSocket returns a new Socket.
@@ -48,6 +54,7 @@ func NewSocket(conn net.Conn, maxSendQBytes uint64) Socket {
 		reader:           bufio.NewReader(conn),
 		MaxSendQBytes:    maxSendQBytes,
 		lineToSendExists: make(chan bool),
+		writerDone:       make(chan bool),
 	}
 }
 
@@ -66,21 +73,31 @@ func (socket *Socket) Close() {
 
 // CertFP returns the fingerprint of the certificate provided by our peer.
 func (socket *Socket) CertFP() (string, error) {
-	var tlsConn, isTLS = socket.conn.(*tls.Conn)
-	if !isTLS {
-		return "", errNotTLS
-	}
+	var peerCerts []*x509.Certificate
+	if wsConn, isWebSocket := socket.conn.(*wsConn); isWebSocket {
+		// the handshake happened before the WebSocket was opened
+		if wsConn.tlsState == nil {
+			return "", errNotTLS
+		}
+		peerCerts = wsConn.tlsState.PeerCertificates
+	} else {
+		var tlsConn, isTLS = socket.conn.(*tls.Conn)
+		if !isTLS {
+			return "", errNotTLS
+		}
 
-	// ensure handehake is performed, and timeout after a few seconds
-	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
-	err := tlsConn.Handshake()
-	tlsConn.SetDeadline(time.Time{})
+		// ensure handehake is performed, and timeout after a few seconds
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
 
-	if err != nil {
-		return "", err
+		if err != nil {
+			return "", err
+		}
+
+		peerCerts = tlsConn.ConnectionState().PeerCertificates
 	}
 
-	peerCerts := tlsConn.ConnectionState().PeerCertificates
 	if len(peerCerts) < 1 {
 		return "", errNoPeerCerts
 	}
@@ -113,6 +130,7 @@ func (socket *Socket) Read() (string, error) {
 		return "", err
 	}
 
+	bncMetrics.ClientLinesIn.Inc()
 	return strings.TrimRight(line, "\r\n"), nil
 }
 
@@ -125,6 +143,7 @@ func (socket *Socket) Write(data string) error {
 	socket.linesToSendMutex.Lock()
 	socket.linesToSend = append(socket.linesToSend, data)
 	socket.linesToSendMutex.Unlock()
+	bncMetrics.ClientLinesOut.Inc()
 
 	go socket.timedFillLineToSendExists(15 * time.Second)
 
@@ -188,7 +207,10 @@ func (socket *Socket) RunSocketWriter() {
 			}
 			if socket.MaxSendQBytes < sendQBytes {
 				socket.SetFinalData("\r\nERROR :SendQ Exceeded\r\n")
+				bncMetrics.SendQDrops.Inc()
 				socket.linesToSendMutex.Unlock()
+				// the break below only leaves the select, so make sure the loop ends too
+				socket.Close()
 				break
 			}
 
@@ -227,6 +249,7 @@ func (socket *Socket) RunSocketWriter() {
 
 	// close the connection
 	socket.conn.Close()
+	close(socket.writerDone)
 
 	// empty the lineToSendExists channel
 	for 0 < len(socket.lineToSendExists) {
@@ -234,6 +257,17 @@ func (socket *Socket) RunSocketWriter() {
 	}
 }
 
+// WaitUntilClosed waits for the SocketWriter to send its final data and close the
+// connection, giving up after the given timeout.
+func (socket *Socket) WaitUntilClosed(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-socket.writerDone:
+	case <-timer.C:
+	}
+}
+
 // WriteLine writes the given line out of Socket.
 func (socket *Socket) WriteLine(line string) error {
 	return socket.Write(line + "\r\n")
@@ -3,6 +3,23 @@
 
 package ircbnc
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Roles a user can have. Owners can manage the other users of the bouncer.
+const (
+	RoleOwner = "Owner"
+	RoleUser  = "User"
+)
+
 // User represents an ircbnc user.
 type User struct {
 	Manager *Manager
@@ -15,6 +32,15 @@ type User struct {
 	HashedPassword []byte
 	Salt           []byte
 	Permissions    []string
+	// CertFPs are the SHA-256 fingerprints of client certificates that can log in as this user
+	CertFPs []string
+	// MultiNetwork puts all of the user's networks on one connection when they log in
+	// without choosing a network
+	MultiNetwork bool
+	// Disabled users can't log in and aren't connected to their networks
+	Disabled bool
+	// APITokens let scripts use the HTTP API as this user without their password
+	APITokens []APIToken
 
 	DefaultNick   string
 	DefaultFbNick string
@@ -24,6 +50,14 @@ type User struct {
 	Networks map[string]*ServerConnection
 }
 
+// APIToken is a named token that can be used to log in to the HTTP API. Only a hash of
+// the token is kept.
+type APIToken struct {
+	Name    string
+	Hash    string
+	Created time.Time
+}
+
 func NewUser(manager *Manager) *User {
 	return &User{
 		Manager:  manager,
@@ -31,11 +65,290 @@ func NewUser(manager *Manager) *User {
 	}
 }
 
+// NormaliseCertFP returns the given certificate fingerprint as lowercase hex without separators.
+func NormaliseCertFP(certfp string) string {
+	certfp = strings.ToLower(strings.TrimSpace(certfp))
+	return strings.Replace(certfp, ":", "", -1)
+}
+
+// HasCertFP returns true if the given certificate fingerprint can log in as this user.
+func (user *User) HasCertFP(certfp string) bool {
+	certfp = NormaliseCertFP(certfp)
+	for _, userCertfp := range user.CertFPs {
+		if userCertfp == certfp {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCertFP lets the given certificate fingerprint log in as this user.
+func (user *User) AddCertFP(certfp string) error {
+	certfp = NormaliseCertFP(certfp)
+	if len(certfp) != 64 {
+		return errors.New("Certificate fingerprints must be a SHA-256 hash (64 hex characters)")
+	}
+	if _, err := hex.DecodeString(certfp); err != nil {
+		return errors.New("Certificate fingerprints must only contain hex characters")
+	}
+	if user.HasCertFP(certfp) {
+		return errors.New("That certificate fingerprint has already been added")
+	}
+
+	user.CertFPs = append(user.CertFPs, certfp)
+	return nil
+}
+
+// DelCertFP stops the given certificate fingerprint from logging in as this user.
+func (user *User) DelCertFP(certfp string) bool {
+	certfp = NormaliseCertFP(certfp)
+	for idx, userCertfp := range user.CertFPs {
+		if userCertfp == certfp {
+			user.CertFPs = append(user.CertFPs[:idx], user.CertFPs[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // StartServerConnections starts running the server connections of this user.
 func (user *User) StartServerConnections() {
-	for _, sc := range user.Networks {
+	if user.Disabled {
+		return
+	}
+
+	for _, sc := range user.NetworkList() {
 		if sc.Enabled {
 			go sc.Connect()
 		}
 	}
 }
+
+// Network returns the user's network with the given name, or nil if there isn't one.
+func (user *User) Network(name string) *ServerConnection {
+	user.Manager.usersLock.RLock()
+	defer user.Manager.usersLock.RUnlock()
+
+	return user.Networks[name]
+}
+
+// NetworkList returns all of the user's networks.
+func (user *User) NetworkList() []*ServerConnection {
+	user.Manager.usersLock.RLock()
+	defer user.Manager.usersLock.RUnlock()
+
+	networks := make([]*ServerConnection, 0, len(user.Networks))
+	for _, sc := range user.Networks {
+		networks = append(networks, sc)
+	}
+	return networks
+}
+
+// Listeners returns the clients currently logged in as this user.
+func (user *User) Listeners() []*Listener {
+	var listeners []*Listener
+	for _, listener := range user.Manager.Clients() {
+		if listener.User == user {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners
+}
+
+// AddNetwork adds a new network to the user and saves it. The user's multi-network
+// clients get the network too, and it's connected if it's enabled or one of them is
+// waiting for it.
+func (user *User) AddNetwork(sc *ServerConnection) error {
+	user.Manager.usersLock.Lock()
+	user.Networks[sc.Name] = sc
+	err := user.Manager.Ds.SaveConnection(sc)
+	if err != nil {
+		delete(user.Networks, sc.Name)
+	}
+	user.Manager.usersLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	attached := false
+	for _, listener := range user.Listeners() {
+		if listener.MultiNetwork {
+			sc.AddListener(listener)
+			attached = true
+		}
+	}
+
+	if (sc.Enabled || attached) && !user.Disabled {
+		go sc.Connect()
+	}
+	return nil
+}
+
+// DelNetwork removes one of the user's networks, disconnecting from it once it's gone.
+func (user *User) DelNetwork(sc *ServerConnection) error {
+	user.Manager.usersLock.Lock()
+	err := user.Manager.Ds.DelConnection(sc)
+	if err == nil {
+		delete(user.Networks, sc.Name)
+	}
+	user.Manager.usersLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sc.Disconnect()
+	return nil
+}
+
+// disconnectListeners closes the connections of every client logged in as this user.
+func (user *User) disconnectListeners(message string) {
+	for _, listener := range user.Listeners() {
+		listener.Socket.SetFinalData(fmt.Sprintf("ERROR :%s\r\n", message))
+		listener.Socket.Close()
+	}
+}
+
+// Disable stops the user from logging in, disconnecting them from their networks and
+// closing their clients.
+func (user *User) Disable(message string) error {
+	user.Disabled = true
+	err := user.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.Disabled = false
+		return err
+	}
+
+	// Networks stay enabled so that they're connected to again if the user is enabled
+	for _, sc := range user.NetworkList() {
+		sc.Quit(message)
+	}
+	user.disconnectListeners(message)
+	return nil
+}
+
+// Enable lets a disabled user log in again and reconnects their networks.
+func (user *User) Enable() error {
+	user.Disabled = false
+	err := user.Manager.Ds.SaveUser(user)
+	if err != nil {
+		user.Disabled = true
+		return err
+	}
+
+	user.StartServerConnections()
+	return nil
+}
+
+// User returns the user with the given ID, or nil if there isn't one.
+func (m *Manager) User(id string) *User {
+	m.usersLock.RLock()
+	defer m.usersLock.RUnlock()
+
+	return m.Users[id]
+}
+
+// UserList returns every user of the bouncer.
+func (m *Manager) UserList() []*User {
+	m.usersLock.RLock()
+	defer m.usersLock.RUnlock()
+
+	users := make([]*User, 0, len(m.Users))
+	for _, user := range m.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// AddUser saves a new user and adds them to the bouncer.
+func (m *Manager) AddUser(user *User) error {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+
+	if _, exists := m.Users[user.Name]; exists {
+		return fmt.Errorf("User %s already exists", user.Name)
+	}
+
+	err := m.Ds.SaveUser(user)
+	if err != nil {
+		return err
+	}
+
+	m.Users[user.ID] = user
+	return nil
+}
+
+// DeleteUser removes the user from the bouncer, then disconnects them from their
+// networks and closes their clients. If they can't be removed, nothing changes.
+func (m *Manager) DeleteUser(user *User, message string) error {
+	m.usersLock.Lock()
+	err := m.Ds.DelUser(user)
+	if err == nil {
+		delete(m.Users, user.ID)
+	}
+	m.usersLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, sc := range user.NetworkList() {
+		sc.Quit(message)
+	}
+	user.disconnectListeners(message)
+	return nil
+}
+
+// hashAPIToken returns the hash of an API token that we keep instead of the token itself
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// AddAPIToken creates a new API token with the given name, returning the token. It
+// can't be retrieved again later.
+func (user *User) AddAPIToken(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("API tokens need a name")
+	}
+	for _, apiToken := range user.APITokens {
+		if apiToken.Name == name {
+			return "", errors.New("An API token with that name already exists")
+		}
+	}
+
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	user.APITokens = append(user.APITokens, APIToken{
+		Name:    name,
+		Hash:    hashAPIToken(token),
+		Created: time.Now().UTC(),
+	})
+	return token, nil
+}
+
+// DelAPIToken removes the API token with the given name.
+func (user *User) DelAPIToken(name string) bool {
+	for idx, apiToken := range user.APITokens {
+		if apiToken.Name == name {
+			user.APITokens = append(user.APITokens[:idx], user.APITokens[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// HasAPIToken returns true if the given token belongs to this user.
+func (user *User) HasAPIToken(token string) bool {
+	hash := []byte(hashAPIToken(token))
+	for _, apiToken := range user.APITokens {
+		if subtle.ConstantTimeCompare(hash, []byte(apiToken.Hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
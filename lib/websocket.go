@@ -0,0 +1,181 @@
+package ircbnc
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols from the IRCv3 WebSocket spec. Each frame carries one IRC line without
+// the trailing CRLF. Clients that don't ask for either get text frames.
+const (
+	wsTextProtocol   = "text.ircv3.net"
+	wsBinaryProtocol = "binary.ircv3.net"
+
+	// The longest line a client can send: 8191 bytes of tags plus the 512 byte message
+	wsMaxLineLength = 8191 + 512
+)
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{wsTextProtocol, wsBinaryProtocol},
+	// Browser clients are usually served from somewhere else, and logging in happens
+	// over IRC rather than with cookies, so any origin is fine
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// wsConn lets a WebSocket connection be used as a net.Conn, so that WebSocket clients
+// go through the same Socket and Listener as everyone else.
+type wsConn struct {
+	ws          *websocket.Conn
+	messageType int
+	// tlsState is set if the client connected over TLS, for logging in with a CertFP
+	tlsState *tls.ConnectionState
+
+	// what's left of the last line read, with the CRLF added back on
+	readBuf []byte
+
+	writeLock sync.Mutex
+}
+
+func newWsConn(ws *websocket.Conn, tlsState *tls.ConnectionState) *wsConn {
+	messageType := websocket.TextMessage
+	if ws.Subprotocol() == wsBinaryProtocol {
+		messageType = websocket.BinaryMessage
+	}
+
+	// Stop clients from making us buffer huge frames
+	ws.SetReadLimit(wsMaxLineLength)
+
+	return &wsConn{
+		ws:          ws,
+		messageType: messageType,
+		tlsState:    tlsState,
+	}
+}
+
+// Read reads IRC lines from the WebSocket frames.
+func (conn *wsConn) Read(b []byte) (int, error) {
+	for len(conn.readBuf) == 0 {
+		messageType, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		line := strings.TrimRight(string(data), "\r\n")
+		if line != "" {
+			conn.readBuf = []byte(line + "\r\n")
+		}
+	}
+
+	n := copy(b, conn.readBuf)
+	conn.readBuf = conn.readBuf[n:]
+	return n, nil
+}
+
+// Write sends each IRC line in b as its own WebSocket frame.
+func (conn *wsConn) Write(b []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		err := conn.ws.WriteMessage(conn.messageType, []byte(line))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close says goodbye to the client and closes the connection.
+func (conn *wsConn) Close() error {
+	conn.writeLock.Lock()
+	conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.writeLock.Unlock()
+	return conn.ws.Close()
+}
+
+func (conn *wsConn) LocalAddr() net.Addr {
+	return conn.ws.LocalAddr()
+}
+
+func (conn *wsConn) RemoteAddr() net.Addr {
+	return conn.ws.RemoteAddr()
+}
+
+func (conn *wsConn) SetDeadline(t time.Time) error {
+	return conn.ws.UnderlyingConn().SetDeadline(t)
+}
+
+func (conn *wsConn) SetReadDeadline(t time.Time) error {
+	return conn.ws.SetReadDeadline(t)
+}
+
+func (conn *wsConn) SetWriteDeadline(t time.Time) error {
+	return conn.ws.SetWriteDeadline(t)
+}
+
+// wsHandler upgrades HTTP requests to WebSockets and passes them on as new clients.
+type wsHandler struct {
+	manager *Manager
+	address string
+}
+
+func (handler *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already told the client what went wrong
+		return
+	}
+	listenerLog.Debug("Accepted websocket", "address", handler.address, "remote", ws.RemoteAddr())
+
+	handler.manager.newConns <- newWsConn(ws, r.TLS)
+}
+
+// openWebSocketListener starts listening for WebSocket clients on the given address,
+// using TLS if tlsConf is set.
+func (m *Manager) openWebSocketListener(address string, tlsConf *TLSListenConfig) error {
+	listener, tlsString, err := m.listen(address, tlsConf)
+	if err != nil {
+		return err
+	}
+	listenerLog.Info("Listening for websockets", "address", address, "type", tlsString)
+
+	server := &http.Server{
+		Handler: &wsHandler{
+			manager: m,
+			address: address,
+		},
+		// Don't let connections that never finish their request hang around
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			listenerLog.Error("Websocket listener stopped", "address", address, "error", err)
+		}
+	}()
+
+	m.WebSocketListeners[address] = listener
+	return nil
+}